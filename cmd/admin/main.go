@@ -0,0 +1,228 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"img-resizer/internal/auth"
+	"img-resizer/internal/config"
+	"img-resizer/internal/fetcher"
+	"img-resizer/internal/metadata"
+	"img-resizer/internal/models"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const usage = `Usage:
+  admin keys create -name NAME -scopes upload,read,delete,admin [-webhook URL] [-tenant ID]
+  admin keys list
+  admin keys revoke ID
+  admin tenants create -id ID [-name NAME] [-max-bytes N] [-max-images N] [-presets FILE]
+  admin tenants update ID [-name NAME] [-max-bytes N] [-max-images N] [-presets FILE]
+  admin tenants list
+  admin config print [-config FILE] [-SETTING VALUE ...]
+`
+
+func main() {
+	if len(os.Args) < 3 {
+		usageExit()
+	}
+	if os.Args[1] == "config" && os.Args[2] == "print" {
+		printConfig(os.Args[3:])
+		return
+	}
+
+	cfg, err := config.Load(nil)
+	if err != nil {
+		fail("%v", err)
+	}
+	store, err := metadata.NewStore(cfg)
+	if err != nil {
+		fail("Failed to initialize metadata store: %v", err)
+	}
+
+	switch os.Args[1] + " " + os.Args[2] {
+	case "keys create":
+		createKey(store, os.Args[3:])
+	case "keys list":
+		listKeys(store)
+	case "keys revoke":
+		if len(os.Args) != 4 {
+			usageExit()
+		}
+		revokeKey(store, os.Args[3])
+	case "tenants create":
+		createTenant(store, os.Args[3:])
+	case "tenants update":
+		if len(os.Args) < 4 {
+			usageExit()
+		}
+		updateTenant(store, os.Args[3], os.Args[4:])
+	case "tenants list":
+		listTenants(store)
+	default:
+		usageExit()
+	}
+}
+
+// createKey stores a new key and prints it. The key cannot be shown again
+func createKey(store metadata.Store, args []string) {
+	flags := flag.NewFlagSet("create", flag.ExitOnError)
+	name := flags.String("name", "", "name describing the client")
+	scopes := flags.String("scopes", "upload,read", "comma separated scopes")
+	webhook := flags.String("webhook", "", "default webhook URL for uploads with this key")
+	tenant := flags.String("tenant", "", "tenant whose images the key manages")
+	if err := flags.Parse(args); err != nil {
+		os.Exit(2)
+	}
+	if *name == "" {
+		fail("-name is required")
+	}
+
+	parsed, err := auth.ParseScopes(*scopes)
+	if err != nil {
+		fail("Invalid scopes: %v", err)
+	}
+	if *webhook != "" {
+		if err := fetcher.ValidateURL(*webhook); err != nil {
+			fail("Invalid webhook url: %v", err)
+		}
+	}
+	if *tenant != "" {
+		if _, err := store.GetTenant(*tenant); err != nil {
+			fail("Failed to get tenant %s: %v", *tenant, err)
+		}
+	}
+
+	token, key, err := auth.GenerateKey(*name, parsed)
+	if err != nil {
+		fail("Failed to generate key: %v", err)
+	}
+	key.WebhookURL = *webhook
+	key.TenantID = *tenant
+
+	// Webhooks are signed with a secret of the key, or of the tenant for
+	// keys of a tenant, so receivers of one client cannot forge those of
+	// another
+	secret, err := webhookSecret(store, key)
+	if err != nil {
+		fail("Failed to create webhook secret: %v", err)
+	}
+	if err := store.SaveAPIKey(key); err != nil {
+		fail("Failed to save key: %v", err)
+	}
+
+	fmt.Printf("Created key %s (%s) with scopes %s\n", key.ID, key.Name, *scopes)
+	fmt.Printf("API key: %s\n", token)
+	fmt.Println("Store it now, it cannot be shown again.")
+	if key.TenantID != "" {
+		fmt.Printf("Webhook secret of tenant %s: %s\n", key.TenantID, secret)
+	} else {
+		fmt.Printf("Webhook secret: %s\n", secret)
+	}
+}
+
+// webhookSecret returns the secret signing the webhooks of a new key. Keys
+// without a tenant get their own, the first key of a tenant creates the one
+// of the tenant
+func webhookSecret(store metadata.Store, key *models.APIKey) (string, error) {
+	if key.TenantID == "" {
+		secret, err := auth.GenerateWebhookSecret()
+		if err != nil {
+			return "", err
+		}
+		key.WebhookSecret = secret
+		return secret, nil
+	}
+
+	tenant, err := store.GetTenant(key.TenantID)
+	if err != nil {
+		return "", fmt.Errorf("failed to get tenant %s: %w", key.TenantID, err)
+	}
+	if tenant.WebhookSecret == "" {
+		if tenant.WebhookSecret, err = auth.GenerateWebhookSecret(); err != nil {
+			return "", err
+		}
+		if err := store.SaveTenant(tenant); err != nil {
+			return "", fmt.Errorf("failed to save tenant: %w", err)
+		}
+	}
+	return tenant.WebhookSecret, nil
+}
+
+func listKeys(store metadata.Store) {
+	keys, err := store.ListAPIKeys()
+	if err != nil {
+		fail("Failed to list keys: %v", err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tTENANT\tSCOPES\tCREATED\tREVOKED")
+	for _, key := range keys {
+		scopes := make([]string, 0, len(key.Scopes))
+		for _, scope := range key.Scopes {
+			scopes = append(scopes, string(scope))
+		}
+		revoked := "-"
+		if key.RevokedAt != nil {
+			revoked = key.RevokedAt.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", key.ID, key.Name, orDash(key.TenantID), strings.Join(scopes, ","), key.CreatedAt.Format(time.RFC3339), revoked)
+	}
+	if err := w.Flush(); err != nil {
+		fail("Failed to print keys: %v", err)
+	}
+}
+
+// revokeKey marks a key revoked. It is kept so images stay attributed
+func revokeKey(store metadata.Store, id string) {
+	key, err := store.GetAPIKey(id)
+	if err != nil {
+		fail("Failed to get key %s: %v", id, err)
+	}
+	if key.RevokedAt != nil {
+		fmt.Printf("Key %s was already revoked\n", id)
+		return
+	}
+
+	now := time.Now()
+	key.RevokedAt = &now
+	if err := store.SaveAPIKey(key); err != nil {
+		fail("Failed to revoke key: %v", err)
+	}
+	fmt.Printf("Revoked key %s (%s)\n", key.ID, key.Name)
+}
+
+// printConfig prints the configuration the API and worker would load with
+// the same file, environment and flags
+func printConfig(args []string) {
+	cfg, err := config.Load(args)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		fail("%v", err)
+	}
+	if err := cfg.Print(os.Stdout); err != nil {
+		fail("%v", err)
+	}
+}
+
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+func usageExit() {
+	fmt.Fprint(os.Stderr, usage)
+	os.Exit(2)
+}
+
+func fail(format string, args ...any) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+	os.Exit(1)
+}
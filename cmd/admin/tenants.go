@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"img-resizer/internal/config"
+	"img-resizer/internal/metadata"
+	"img-resizer/internal/models"
+	"img-resizer/internal/processor"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+// tenantFlags are the settings shared by tenants create and update
+type tenantFlags struct {
+	set       *flag.FlagSet
+	name      *string
+	maxBytes  *int64
+	maxImages *int
+	presets   *string
+}
+
+func newTenantFlags(command string) *tenantFlags {
+	set := flag.NewFlagSet(command, flag.ExitOnError)
+	return &tenantFlags{
+		set:       set,
+		name:      set.String("name", "", "display name of the tenant"),
+		maxBytes:  set.Int64("max-bytes", 0, "storage quota in bytes, 0 for unlimited"),
+		maxImages: set.Int("max-images", 0, "image quota, 0 for unlimited"),
+		presets:   set.String("presets", "", "JSON file with the presets of the tenant, replacing the configured ones"),
+	}
+}
+
+// apply copies the flags given on the command line to tenant
+func (f *tenantFlags) apply(tenant *models.Tenant) {
+	f.set.Visit(func(fl *flag.Flag) {
+		switch fl.Name {
+		case "name":
+			tenant.Name = *f.name
+		case "max-bytes":
+			tenant.Quota.MaxBytes = *f.maxBytes
+		case "max-images":
+			tenant.Quota.MaxImages = *f.maxImages
+		case "presets":
+			presets, err := loadPresets(*f.presets)
+			if err != nil {
+				fail("Invalid presets: %v", err)
+			}
+			tenant.Presets = presets
+		}
+	})
+	if tenant.Quota.MaxBytes < 0 || tenant.Quota.MaxImages < 0 {
+		fail("Quotas cannot be negative")
+	}
+}
+
+func createTenant(store metadata.Store, args []string) {
+	flags := newTenantFlags("create")
+	id := flags.set.String("id", "", "tenant id, used as storage prefix")
+	if err := flags.set.Parse(args); err != nil {
+		os.Exit(2)
+	}
+	if !models.ValidTenantID(*id) {
+		fail("-id must be 1 to 63 lowercase letters, digits and dashes")
+	}
+	if _, err := store.GetTenant(*id); err == nil {
+		fail("Tenant %s already exists", *id)
+	} else if !errors.Is(err, metadata.ErrNotFound) {
+		fail("Failed to get tenant %s: %v", *id, err)
+	}
+
+	tenant := &models.Tenant{ID: *id, Name: *id, CreatedAt: time.Now()}
+	flags.apply(tenant)
+	if err := store.SaveTenant(tenant); err != nil {
+		fail("Failed to save tenant: %v", err)
+	}
+	fmt.Printf("Created tenant %s (%s)\n", tenant.ID, tenant.Name)
+}
+
+func updateTenant(store metadata.Store, id string, args []string) {
+	flags := newTenantFlags("update")
+	if err := flags.set.Parse(args); err != nil {
+		os.Exit(2)
+	}
+
+	tenant, err := store.GetTenant(id)
+	if err != nil {
+		fail("Failed to get tenant %s: %v", id, err)
+	}
+	flags.apply(tenant)
+	if err := store.SaveTenant(tenant); err != nil {
+		fail("Failed to save tenant: %v", err)
+	}
+	fmt.Printf("Updated tenant %s (%s)\n", tenant.ID, tenant.Name)
+}
+
+func listTenants(store metadata.Store) {
+	tenants, err := store.ListTenants()
+	if err != nil {
+		fail("Failed to list tenants: %v", err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tPRESETS\tIMAGES\tBYTES")
+	for _, tenant := range tenants {
+		usage, err := store.GetUsage(tenant.ID)
+		if err != nil {
+			fail("Failed to get usage of tenant %s: %v", tenant.ID, err)
+		}
+		presets := "default"
+		if len(tenant.Presets) > 0 {
+			presets = fmt.Sprintf("%d custom", len(tenant.Presets))
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", tenant.ID, tenant.Name, presets,
+			withLimit(int64(usage.Images), int64(tenant.Quota.MaxImages)),
+			withLimit(usage.Bytes, tenant.Quota.MaxBytes))
+	}
+	if err := w.Flush(); err != nil {
+		fail("Failed to print tenants: %v", err)
+	}
+}
+
+// loadPresets reads a JSON array of presets, filling in the defaults of the
+// configured presets
+func loadPresets(path string) ([]models.Preset, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var presets []models.Preset
+	if err := json.Unmarshal(data, &presets); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+
+	for i := range presets {
+		presets[i].ApplyDefaults()
+	}
+	if err := config.ValidatePresets(presets); err != nil {
+		return nil, err
+	}
+	if _, err := processor.PresetsFromConfig(presets); err != nil {
+		return nil, err
+	}
+	return presets, nil
+}
+
+func withLimit(value, limit int64) string {
+	if limit == 0 {
+		return fmt.Sprintf("%d", value)
+	}
+	return fmt.Sprintf("%d/%d", value, limit)
+}
@@ -4,49 +4,110 @@ import (
 	"context"
 	"fmt"
 	"img-resizer/internal/api"
+	"img-resizer/internal/auth"
 	"img-resizer/internal/config"
+	"img-resizer/internal/events"
+	"img-resizer/internal/logging"
+	"img-resizer/internal/metadata"
 	"img-resizer/internal/queue"
+	"img-resizer/internal/ratelimit"
 	"img-resizer/internal/storage"
-	"log"
+	"img-resizer/internal/tracing"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 func main() {
-	cfg := config.NewConfig()
+	cfg := config.FromCommandLine()
+	if _, err := logging.Setup(cfg.Log, os.Stderr); err != nil {
+		logging.Fatal("Failed to initialize logging", "error", err)
+	}
+
+	// Init tracing before anything that creates spans
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg.Tracing, "img-resizer-api")
+	if err != nil {
+		logging.Fatal("Failed to initialize tracing", "error", err)
+	}
 
 	// Init storage
 	storageProvider, err := storage.NewStorage(cfg)
 	if err != nil {
-		log.Fatalf("Failed to initialize storage: %v", err)
+		logging.Fatal("Failed to initialize storage", "error", err)
+	}
+	if cfg.Storage.Cache.Enabled {
+		cache, err := storage.NewCachedStorage(storageProvider, cfg.Storage.Cache)
+		if err != nil {
+			logging.Fatal("Failed to initialize storage cache", "error", err)
+		}
+		prometheus.MustRegister(cache)
+		storageProvider = cache
+	}
+
+	// Init metadata store
+	metadataStore, err := metadata.NewStore(cfg)
+	if err != nil {
+		logging.Fatal("Failed to initialize metadata store", "error", err)
 	}
 
 	// Init RabbitMQ
 	rabbitMQ, err := queue.NewRabbitMQ(cfg)
 	if err != nil {
-		log.Fatalf("Failed to initialize RabbitMQ: %v", err)
+		logging.Fatal("Failed to initialize RabbitMQ", "error", err)
 	}
 	defer func() {
 		if err := rabbitMQ.Close(); err != nil {
-			log.Printf("Failed to close RabbitMQ: %v", err)
+			slog.Error("Failed to close RabbitMQ", "error", err)
 		}
 	}()
 
-	router := api.SetupRouter(storageProvider, rabbitMQ)
+	// Relay progress events published by workers to streaming clients
+	hub := events.NewHub()
+	go rabbitMQ.RelayEvents(hub.Publish)
+
+	// Accept JWTs from the identity provider next to API keys
+	var tokens *auth.TokenVerifier
+	if cfg.Auth.Enabled && cfg.Auth.JWT.JWKS != "" {
+		keys, err := auth.NewKeySet(cfg.Auth.JWT.JWKS, cfg.Auth.JWT.JWKSRefresh)
+		if err != nil {
+			logging.Fatal("Failed to load JWKS", "error", err)
+		}
+		tokens = auth.NewTokenVerifier(cfg.Auth.JWT, keys)
+	}
+
+	var limiter ratelimit.Limiter
+	if cfg.RateLimit.Enabled {
+		limiter, err = ratelimit.NewLimiter(cfg.RateLimit)
+		if err != nil {
+			logging.Fatal("Failed to initialize rate limiter", "error", err)
+		}
+		defer func() {
+			if err := limiter.Close(); err != nil {
+				slog.Error("Failed to close rate limiter", "error", err)
+			}
+		}()
+	}
+
+	router := api.SetupRouter(cfg, storageProvider, metadataStore, rabbitMQ, hub, tokens, limiter)
 
 	srv := &http.Server{
 		Addr:    fmt.Sprintf(":%s", cfg.Server.Port),
 		Handler: router,
 	}
+	// Shutdown waits for requests to finish, event streams only end when
+	// told to
+	srv.RegisterOnShutdown(hub.Close)
 
 	// Start server in a goroutine
 	go func() {
-		log.Printf("Starting server on %s", srv.Addr)
+		slog.Info("Starting server", "addr", srv.Addr)
 		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("Failed to start server: %v", err)
+			logging.Fatal("Failed to start server", "error", err)
 		}
 	}()
 
@@ -55,14 +116,18 @@ func main() {
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
 
-	log.Println("Shutting down server...")
+	slog.Info("Shutting down server")
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
+	// Exiting here would skip the deferred closes and the trace flush
 	if err := srv.Shutdown(ctx); err != nil {
-		log.Fatalf("Server forced to shutdown: %v", err)
+		slog.Error("Server forced to shutdown", "error", err)
+	}
+	if err := shutdownTracing(ctx); err != nil {
+		slog.Error("Failed to flush traces", "error", err)
 	}
 
-	log.Println("Server exited properly")
+	slog.Info("Server exited properly")
 }
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"img-resizer/internal/health"
+	"img-resizer/internal/processor"
+	"img-resizer/internal/queue"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// consumerStatus tracks the task consumer for the health endpoints
+type consumerStatus struct {
+	running  atomic.Bool
+	lastTask atomic.Int64 // unix nanoseconds, 0 before the first task
+}
+
+// taskDone records a successfully processed task
+func (s *consumerStatus) taskDone() {
+	s.lastTask.Store(time.Now().UnixNano())
+}
+
+func (s *consumerStatus) check(context.Context) error {
+	if !s.running.Load() {
+		return errors.New("task consumer is not running")
+	}
+	return nil
+}
+
+// lastTaskAt returns when the last task succeeded, nil before the first
+func (s *consumerStatus) lastTaskAt() any {
+	nanos := s.lastTask.Load()
+	if nanos == 0 {
+		return nil
+	}
+	return time.Unix(0, nanos).UTC()
+}
+
+// newHealthCheckers returns the liveness checks, failing only when the
+// worker itself is broken: a stopped consumer or a libvips that no longer
+// decodes. Readiness also checks the connection to RabbitMQ, whose outage
+// a restart does not fix
+func newHealthCheckers(timeout time.Duration, status *consumerStatus, rabbitMQ *queue.RabbitMQ) (liveness, readiness *health.Checker) {
+	liveness = health.NewChecker(timeout)
+	readiness = health.NewChecker(timeout)
+	for _, checker := range []*health.Checker{liveness, readiness} {
+		checker.Add("consumer", status.check)
+		checker.Add("libvips", func(context.Context) error {
+			return processor.CheckVips()
+		})
+		checker.Detail("last_task_at", status.lastTaskAt)
+		checker.Detail("libvips_version", func() any {
+			return processor.VipsVersion()
+		})
+	}
+	readiness.Add("queue", func(context.Context) error {
+		return rabbitMQ.Check()
+	})
+	return liveness, readiness
+}
+
+// serveHealth exposes the health of the worker on addr
+func serveHealth(addr string, liveness, readiness *health.Checker) {
+	mux := http.NewServeMux()
+	mux.Handle("/healthz", liveness.Handler())
+	mux.Handle("/readyz", readiness.Handler())
+
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	slog.Info("Serving health checks", "addr", addr)
+	if err := server.ListenAndServe(); err != nil {
+		slog.Error("Health listener stopped", "error", err)
+	}
+}
@@ -1,41 +1,129 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"img-resizer/internal/config"
+	"img-resizer/internal/fetcher"
+	"img-resizer/internal/logging"
+	"img-resizer/internal/metadata"
+	"img-resizer/internal/metrics"
 	"img-resizer/internal/models"
 	"img-resizer/internal/processor"
 	"img-resizer/internal/queue"
 	"img-resizer/internal/storage"
-	"log"
+	"img-resizer/internal/tracing"
+	"img-resizer/internal/webhook"
+	"io"
+	"log/slog"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func main() {
 	// Load configuration
-	cfg := config.NewConfig()
+	cfg := config.FromCommandLine()
+	if _, err := logging.Setup(cfg.Log, os.Stderr); err != nil {
+		logging.Fatal("Failed to initialize logging", "error", err)
+	}
+
+	// Traces continue the ones the API started for each task
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg.Tracing, "img-resizer-worker")
+	if err != nil {
+		logging.Fatal("Failed to initialize tracing", "error", err)
+	}
 
 	// Initialize storage
 	storageProvider, err := storage.NewStorage(cfg)
 	if err != nil {
-		log.Fatalf("Failed to initialize storage: %v", err)
+		logging.Fatal("Failed to initialize storage", "error", err)
+	}
+
+	// Initialize metadata store
+	metadataStore, err := metadata.NewStore(cfg)
+	if err != nil {
+		logging.Fatal("Failed to initialize metadata store", "error", err)
 	}
 
 	// Initialize RabbitMQ
 	rabbitMQ, err := queue.NewRabbitMQ(cfg)
 	if err != nil {
-		log.Fatalf("Failed to initialize RabbitMQ: %v", err)
+		logging.Fatal("Failed to initialize RabbitMQ", "error", err)
 	}
 	defer func() {
 		if err := rabbitMQ.Close(); err != nil {
-			log.Printf("Failed to close RabbitMQ: %v", err)
+			slog.Error("Failed to close RabbitMQ", "error", err)
 		}
 	}()
 
+	// Report which codecs the linked libvips supports
+	slog.Info(processor.CapabilityReport())
+
 	// Initialize processor
-	proc := processor.NewProcessor()
+	presets, err := processor.PresetsFromConfig(cfg.Presets)
+	if err != nil {
+		logging.Fatal("Invalid presets", "error", err)
+	}
+	for _, preset := range presets {
+		if !processor.CanSave(preset.Format) {
+			logging.Fatal("Preset uses a format the linked libvips cannot encode", "preset", preset.Name, "format", preset.Format)
+		}
+	}
+	if cfg.Animation.ToWebP && !processor.CanSave(processor.FormatWebP) {
+		logging.Fatal("ANIMATION_TO_WEBP is set but the linked libvips cannot encode webp")
+	}
+	if !processor.CanSave(processor.FormatGIF) {
+		slog.Warn("The linked libvips cannot encode gif, animated GIFs are converted to WebP")
+	}
+
+	procOpts := []processor.Option{
+		processor.WithPresets(presets),
+		processor.WithAnimation(cfg.Animation.MaxFrames, cfg.Animation.ToWebP),
+		processor.WithMaxInputSize(cfg.Upload.MaxSize),
+	}
+
+	// Load the watermark once so every task reuses it
+	if cfg.Watermark.Enabled() {
+		watermark, err := processor.LoadWatermark(cfg.Watermark)
+		if err != nil {
+			logging.Fatal("Failed to load watermark", "error", err)
+		}
+		procOpts = append(procOpts, processor.WithStage(watermark))
+	}
+
+	proc := processor.NewProcessor(procOpts...)
+
+	// Downloads of images imported by URL share the upload size limit
+	fetch := fetcher.NewFetcher(cfg.Fetch, cfg.Upload.MaxSize)
+
+	if cfg.Webhook.Secret == "" {
+		slog.Warn("WEBHOOK_SECRET is not set, webhooks of keys and tenants without their own secret will not be signed")
+	}
+	notifier := webhook.NewNotifier(cfg.Webhook, metadataStore)
+	if err := notifier.Resume(); err != nil {
+		slog.Error("Failed to resume webhook deliveries", "error", err)
+	}
+
+	if cfg.Metrics.Enabled {
+		metrics.RegisterVipsMemory(processor.VipsMemory)
+		go serveMetrics(cfg.Metrics.WorkerAddr)
+	}
+
+	status := &consumerStatus{}
+	if cfg.Health.WorkerAddr != "" {
+		liveness, readiness := newHealthCheckers(cfg.Health.Timeout, status, rabbitMQ)
+		go serveHealth(cfg.Health.WorkerAddr, liveness, readiness)
+	}
 
 	// Set up signal handling for graceful shutdown
 	signals := make(chan os.Signal, 1)
@@ -43,63 +131,441 @@ func main() {
 
 	// Start consuming tasks in a separate goroutine
 	go func() {
-		log.Println("Worker started, waiting for tasks...")
-		err := rabbitMQ.ConsumeTask(func(task *models.ImageProcessingTask) error {
-			return processImage(task, storageProvider, proc)
+		slog.Info("Worker started, waiting for tasks")
+		status.running.Store(true)
+		err := rabbitMQ.ConsumeTask(func(ctx context.Context, task *models.ImageProcessingTask) error {
+			taskType := task.Type
+			if taskType == "" {
+				taskType = models.TaskProcess
+			}
+
+			if task.Type == models.TaskImport {
+				if err := importImage(ctx, task, storageProvider, metadataStore, fetch, cfg.Fetch.Timeout); err != nil {
+					// A failed download is final, the client can import again
+					slog.ErrorContext(ctx, "Failed to import image", "error", err)
+					releaseImport(ctx, task, metadataStore)
+					setStatus(ctx, metadataStore, task.ID, models.StatusFailed, err)
+					publishEvent(ctx, rabbitMQ, task.ID, models.EventFailed, "", err)
+					notify(ctx, notifier, metadataStore, task.ID, models.EventImageFailed)
+					metrics.Tasks.WithLabelValues(string(taskType), "failed").Inc()
+					return nil
+				}
+			}
+
+			err := processImage(ctx, task, storageProvider, metadataStore, proc, rabbitMQ)
+			if errors.Is(err, errImageDeleted) {
+				slog.InfoContext(ctx, "Image was deleted, skipping it")
+				metrics.Tasks.WithLabelValues(string(taskType), "deleted").Inc()
+				return nil
+			}
+			if err != nil {
+				// Returning the error requeues the task until its last
+				// attempt, only then is the failure reported
+				if !queue.FinalAttempt(ctx) {
+					slog.WarnContext(ctx, "Failed to process image, retrying", "error", err)
+					setStatus(ctx, metadataStore, task.ID, models.StatusQueued, err)
+					metrics.Tasks.WithLabelValues(string(taskType), "retried").Inc()
+					return err
+				}
+				slog.ErrorContext(ctx, "Failed to process image", "error", err)
+				setStatus(ctx, metadataStore, task.ID, models.StatusFailed, err)
+				publishEvent(ctx, rabbitMQ, task.ID, models.EventFailed, "", err)
+				notify(ctx, notifier, metadataStore, task.ID, models.EventImageFailed)
+				metrics.Tasks.WithLabelValues(string(taskType), "failed").Inc()
+				return err
+			}
+			publishEvent(ctx, rabbitMQ, task.ID, models.EventDone, "", nil)
+			notify(ctx, notifier, metadataStore, task.ID, models.EventImageProcessed)
+			metrics.Tasks.WithLabelValues(string(taskType), "processed").Inc()
+			status.taskDone()
+			return nil
 		})
 		if err != nil {
-			log.Fatalf("Failed to consume tasks: %v", err)
+			logging.Fatal("Failed to consume tasks", "error", err)
 		}
+		// The deliveries end when the connection to RabbitMQ is lost, the
+		// health checks report it so the worker gets restarted
+		status.running.Store(false)
+		slog.Error("Task consumer stopped")
 	}()
 
 	// Wait for termination signal
 	<-signals
-	log.Println("Shutting down worker...")
+	slog.Info("Shutting down worker")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := notifier.Shutdown(ctx); err != nil {
+		slog.Warn("Gave up waiting for webhook deliveries", "error", err)
+	}
+	if err := shutdownTracing(ctx); err != nil {
+		slog.Error("Failed to flush traces", "error", err)
+	}
+}
+
+// serveMetrics exposes the Prometheus metrics of the worker on addr
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	slog.Info("Serving metrics", "addr", addr)
+	if err := server.ListenAndServe(); err != nil {
+		slog.Error("Metrics listener stopped", "error", err)
+	}
+}
+
+// importImage downloads the original of an image imported by URL and
+// streams it to storage. The API could not know its size, so the tenant
+// quota is checked here
+func importImage(ctx context.Context, task *models.ImageProcessingTask, store storage.Storage, metadataStore metadata.Store, fetch *fetcher.Fetcher, timeout time.Duration) (err error) {
+	slog.InfoContext(ctx, "Importing image", "url", task.SourceURL)
+
+	ctx, span := tracing.Tracer().Start(ctx, "import image", trace.WithAttributes(attribute.String("image.id", task.ID)))
+	defer func() { tracing.End(span, err) }()
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	body, err := fetch.Fetch(ctx, task.SourceURL)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := body.Close(); err != nil {
+			slog.WarnContext(ctx, "Failed to close download", "error", err)
+		}
+	}()
+
+	// Check the content before storing, the declared type may be wrong
+	reader := bufio.NewReaderSize(body, processor.SniffLen)
+	head, err := reader.Peek(processor.SniffLen)
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("failed to download image: %w", err)
+	}
+	if processor.DetectFormat(head) == processor.FormatUnknown {
+		return fetcher.ErrNotImage
+	}
+
+	key := storage.Key(task.TenantID, task.ID)
+	counter := &countingReader{reader: reader}
+	if _, err := store.Save(ctx, key, models.QualityOriginal, counter); err != nil {
+		if derr := store.Delete(ctx, key, models.QualityOriginal); derr != nil && !os.IsNotExist(derr) {
+			slog.WarnContext(ctx, "Failed to delete partial download", "error", derr)
+		}
+		return fmt.Errorf("failed to download image: %w", err)
+	}
+
+	if err := recordImport(task, metadataStore, counter.n); err != nil {
+		if derr := store.Delete(ctx, key, models.QualityOriginal); derr != nil && !os.IsNotExist(derr) {
+			slog.WarnContext(ctx, "Failed to delete download", "error", derr)
+		}
+		return err
+	}
+	return nil
+}
+
+// recordImport adds a downloaded original to the usage of its tenant and
+// its metadata, so processing accounts for the variants only
+func recordImport(task *models.ImageProcessingTask, metadataStore metadata.Store, size int64) error {
+	if task.TenantID != "" {
+		tenant, err := metadataStore.GetTenant(task.TenantID)
+		if err != nil {
+			return fmt.Errorf("failed to get tenant %s: %w", task.TenantID, err)
+		}
+		if _, err := metadataStore.AddUsage(tenant.ID, size, 0, &tenant.Quota); err != nil {
+			return err
+		}
+	}
+
+	meta, err := metadataStore.Get(task.ID)
+	if err == nil {
+		meta.Size = size
+		meta.Qualities = []models.ImageQuality{models.QualityOriginal}
+		err = metadataStore.Update(meta)
+	}
+	if err != nil {
+		if task.TenantID != "" {
+			if _, rerr := metadataStore.AddUsage(task.TenantID, -size, 0, nil); rerr != nil {
+				slog.Error("Failed to release usage", "image_id", task.ID, "error", rerr)
+			}
+		}
+		return fmt.Errorf("failed to save metadata: %w", err)
+	}
+	return nil
+}
+
+// releaseImport gives back the image the API reserved for an import whose
+// download failed. The image then no longer counts, see HoldsUsage. An
+// image deleted meanwhile was released by the API
+func releaseImport(ctx context.Context, task *models.ImageProcessingTask, metadataStore metadata.Store) {
+	if task.TenantID == "" {
+		return
+	}
+	if _, err := metadataStore.Get(task.ID); err != nil {
+		return
+	}
+	if _, err := metadataStore.AddUsage(task.TenantID, 0, -1, nil); err != nil {
+		slog.ErrorContext(ctx, "Failed to release usage", "error", err)
+	}
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	reader io.Reader
+	n      int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.n += int64(n)
+	return n, err
 }
 
+// errImageDeleted is returned by processImage for images deleted before
+// their processing finished
+var errImageDeleted = errors.New("image was deleted")
+
 // processImage processes an image from a task
-func processImage(task *models.ImageProcessingTask, storage storage.Storage, proc *processor.Processor) error {
-	log.Printf("Processing image: %s", task.ID)
+func processImage(ctx context.Context, task *models.ImageProcessingTask, store storage.Storage, metadataStore metadata.Store, proc *processor.Processor, rabbitMQ *queue.RabbitMQ) error {
+	slog.InfoContext(ctx, "Processing image")
+	setStatus(ctx, metadataStore, task.ID, models.StatusProcessing, nil)
+	publishEvent(ctx, rabbitMQ, task.ID, models.EventProcessing, "", nil)
+
+	proc, err := tenantProcessor(task.TenantID, metadataStore, proc)
+	if err != nil {
+		return err
+	}
+
+	// Load the metadata written at upload, an image deleted in the meantime
+	// is not processed
+	meta, err := metadataStore.Get(task.ID)
+	if errors.Is(err, metadata.ErrNotFound) {
+		return errImageDeleted
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get metadata: %w", err)
+	}
 
 	// Get the original image from storage
-	originalImage, err := storage.Get(task.ID, models.QualityOriginal)
+	key := storage.Key(task.TenantID, task.ID)
+	originalImage, err := store.Get(ctx, key, models.QualityOriginal)
 	if err != nil {
 		return fmt.Errorf("failed to get original image: %w", err)
 	}
 	defer func() {
 		if err := originalImage.Close(); err != nil {
-			log.Printf("Failed to close original image: %v", err)
+			slog.WarnContext(ctx, "Failed to close original image", "error", err)
 		}
 	}()
 
-	// Read the image data
+	// Read the image data, bounded by the upload limit
 	imageData, err := proc.ReadAll(originalImage)
 	if err != nil {
 		return fmt.Errorf("failed to read image data: %w", err)
 	}
 
 	// Process the image
+	_, span := tracing.Tracer().Start(ctx, "process image", trace.WithAttributes(
+		attribute.String("image.id", task.ID),
+		attribute.Int("image.size", len(imageData)),
+	))
 	variants, err := proc.ProcessImage(imageData)
 	if err != nil {
-		return fmt.Errorf("failed to process image: %w", err)
+		err = fmt.Errorf("failed to process image: %w", err)
+		tracing.End(span, err)
+		return err
+	}
+	for _, preset := range proc.Presets() {
+		span.AddEvent("variant", trace.WithAttributes(
+			attribute.String("image.quality", string(preset.Name)),
+			attribute.Float64("duration_seconds", variants[preset.Name].Duration.Seconds()),
+		))
+	}
+	span.End()
+
+	// Remember what the image used so a reprocessed image is not counted twice
+	previousSize := meta.StoredSize()
+
+	original := variants[models.QualityOriginal]
+	meta.MimeType = original.Format.MimeType()
+	meta.Size = int64(len(original.Data))
+	meta.Width = original.Width
+	meta.Height = original.Height
+	meta.Qualities = []models.ImageQuality{models.QualityOriginal}
+	previousVariants := meta.Variants
+	meta.Variants = nil
+
+	// Placeholders are a nicety, a failure here should not fail the task
+	placeholders, err := proc.GeneratePlaceholders(imageData)
+	if err != nil {
+		slog.WarnContext(ctx, "Failed to generate placeholders", "error", err)
+	}
+	meta.Placeholders = placeholders
+
+	// The API streams uploads without decoding them, so the perceptual hash
+	// used for near-duplicate search is computed here
+	fingerprint, err := proc.Fingerprint(imageData)
+	if err != nil {
+		slog.WarnContext(ctx, "Failed to fingerprint image", "error", err)
+	} else {
+		meta.SHA256 = fingerprint.SHA256
+		meta.PerceptualHash = fingerprint.DHash
 	}
 
 	// Save the processed images
-	for quality, data := range variants {
-		// Skip the original image as it's already saved
-		if quality == models.QualityOriginal {
-			continue
-		}
+	for _, preset := range proc.Presets() {
+		variant := variants[preset.Name]
 
 		// Save the processed image
-		_, err := storage.Save(task.ID, quality, proc.CreateReader(data))
+		_, err := store.Save(ctx, key, preset.Name, proc.CreateReader(variant.Data))
 		if err != nil {
-			return fmt.Errorf("failed to save processed image with quality %s: %w", quality, err)
+			return fmt.Errorf("failed to save processed image with quality %s: %w", preset.Name, err)
+		}
+
+		// The hash is the ETag the API serves the variant with, and the
+		// Last-Modified only changes with it
+		sum := sha256.Sum256(variant.Data)
+		hash := hex.EncodeToString(sum[:])
+		processedAt := time.Now()
+		for _, previous := range previousVariants {
+			if previous.Quality == preset.Name && previous.SHA256 == hash && !previous.ProcessedAt.IsZero() {
+				processedAt = previous.ProcessedAt
+			}
+		}
+		meta.Qualities = append(meta.Qualities, preset.Name)
+		meta.Variants = append(meta.Variants, models.VariantMetadata{
+			Quality:        preset.Name,
+			MimeType:       variant.Format.MimeType(),
+			Size:           int64(len(variant.Data)),
+			Width:          variant.Width,
+			Height:         variant.Height,
+			EncoderQuality: variant.Quality,
+			SSIM:           variant.SSIM,
+			SHA256:         hash,
+			OverMaxBytes:   variant.OverMaxBytes,
+			ProcessedAt:    processedAt,
+		})
+		if variant.OverMaxBytes {
+			slog.WarnContext(ctx, "Variant exceeds the size cap of its preset", "quality", preset.Name, "size", len(variant.Data), "max_bytes", preset.MaxBytes)
 		}
 
-		log.Printf("Saved image %s with quality %s", task.ID, quality)
+		metrics.VariantDuration.WithLabelValues(string(preset.Name), string(variant.Format)).Observe(variant.Duration.Seconds())
+		slog.InfoContext(ctx, "Saved variant", "quality", preset.Name, "format", variant.Format, "size", len(variant.Data), "duration", variant.Duration)
+		publishEvent(ctx, rabbitMQ, task.ID, models.EventVariant, preset.Name, nil)
 	}
 
-	log.Printf("Image processing completed: %s", task.ID)
+	meta.Status = models.StatusDone
+	meta.Error = ""
+	err = metadataStore.Update(meta)
+	if errors.Is(err, metadata.ErrNotFound) {
+		// The image was deleted while it was processed, the variants just
+		// written would be left behind
+		for _, preset := range proc.Presets() {
+			if err := store.Delete(ctx, key, preset.Name); err != nil && !os.IsNotExist(err) {
+				slog.WarnContext(ctx, "Failed to delete variant of deleted image", "quality", preset.Name, "error", err)
+			}
+		}
+		return errImageDeleted
+	}
+	if err != nil {
+		return fmt.Errorf("failed to save metadata: %w", err)
+	}
+
+	// Variants count towards the usage but never fail a finished image
+	if task.TenantID != "" {
+		if _, err := metadataStore.AddUsage(task.TenantID, meta.StoredSize()-previousSize, 0, nil); err != nil {
+			slog.WarnContext(ctx, "Failed to record usage", "error", err)
+		}
+	}
+
+	slog.InfoContext(ctx, "Image processing completed")
 	return nil
 }
+
+// tenantProcessor returns the processor for the images of a tenant, which
+// produces the presets of the tenant when it has its own
+func tenantProcessor(tenantID string, metadataStore metadata.Store, proc *processor.Processor) (*processor.Processor, error) {
+	if tenantID == "" {
+		return proc, nil
+	}
+
+	tenant, err := metadataStore.GetTenant(tenantID)
+	if errors.Is(err, metadata.ErrNotFound) {
+		return proc, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get tenant %s: %w", tenantID, err)
+	}
+	if len(tenant.Presets) == 0 {
+		return proc, nil
+	}
+
+	presets, err := processor.PresetsFromConfig(tenant.Presets)
+	if err != nil {
+		return nil, fmt.Errorf("invalid presets of tenant %s: %w", tenantID, err)
+	}
+	for _, preset := range presets {
+		if !processor.CanSave(preset.Format) {
+			return nil, fmt.Errorf("preset %s of tenant %s uses %s, which the linked libvips cannot encode", preset.Name, tenantID, preset.Format)
+		}
+	}
+	return proc.With(processor.WithPresets(presets)), nil
+}
+
+// publishEvent broadcasts a progress event to the API instances. Events are
+// informational, so failures are only logged
+func publishEvent(ctx context.Context, rabbitMQ *queue.RabbitMQ, id string, eventType models.EventType, quality models.ImageQuality, cause error) {
+	event := &models.ProgressEvent{
+		ImageID: id,
+		Type:    eventType,
+		Quality: quality,
+		At:      time.Now(),
+	}
+	if cause != nil {
+		event.Error = cause.Error()
+	}
+	if err := rabbitMQ.PublishEvent(event); err != nil {
+		slog.WarnContext(ctx, "Failed to publish event", "event", eventType, "error", err)
+	}
+}
+
+// notify sends the webhook of an image, if it has one, with its current
+// metadata
+func notify(ctx context.Context, notifier *webhook.Notifier, metadataStore metadata.Store, id string, event models.WebhookEvent) {
+	meta, err := metadataStore.Get(id)
+	if err != nil {
+		slog.WarnContext(ctx, "Failed to get metadata for webhook", "error", err)
+		return
+	}
+	notifier.Notify(event, meta)
+}
+
+// setStatus records the processing state of an image. Failures are only
+// logged since the status is informational
+func setStatus(ctx context.Context, metadataStore metadata.Store, id string, status models.ImageStatus, cause error) {
+	meta, err := metadataStore.Get(id)
+	if errors.Is(err, metadata.ErrNotFound) {
+		// The image was deleted, saving would bring its record back
+		slog.InfoContext(ctx, "Image was deleted, not recording its status", "status", status)
+		return
+	}
+	if err != nil {
+		slog.WarnContext(ctx, "Failed to get metadata", "error", err)
+		return
+	}
+
+	meta.Status = status
+	meta.Error = ""
+	if cause != nil {
+		meta.Error = cause.Error()
+	}
+
+	if err := metadataStore.Save(meta); err != nil {
+		slog.WarnContext(ctx, "Failed to save status", "status", status, "error", err)
+	}
+}
@@ -0,0 +1,335 @@
+package handlers
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"img-resizer/internal/auth"
+	"img-resizer/internal/metadata"
+	"img-resizer/internal/models"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// archiveSniffLen covers the "ustar" magic of tar headers at offset 257
+const archiveSniffLen = 512
+
+var (
+	zipMagic  = []byte("PK\x03\x04")
+	gzipMagic = []byte{0x1f, 0x8b}
+	tarMagic  = []byte("ustar")
+)
+
+// BatchItemStatus is a batch item together with the state of its image
+type BatchItemStatus struct {
+	models.BatchItem
+	Status models.ImageStatus `json:"status,omitempty"`
+}
+
+// BatchStatus is the aggregate progress of a batch
+type BatchStatus struct {
+	ID         string            `json:"id"`
+	CreatedAt  time.Time         `json:"createdAt"`
+	Complete   bool              `json:"complete"`
+	Progress   float64           `json:"progress"` // share of finished items, 0..1
+	Total      int               `json:"total"`
+	Queued     int               `json:"queued"`
+	Processing int               `json:"processing"`
+	Done       int               `json:"done"`
+	Failed     int               `json:"failed"`
+	Rejected   int               `json:"rejected"` // files that did not become images
+	Items      []BatchItemStatus `json:"items"`
+}
+
+// UploadBatch handles uploads of several images in one request. Every file
+// part is either an image or a ZIP, TAR or TAR.GZ archive of images
+func (h *ImageHandler) UploadBatch(c *gin.Context) {
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, h.maxBatchSize)
+
+	reader, err := c.Request.MultipartReader()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No images provided"})
+		return
+	}
+
+	opts := newUploadOptions(c)
+	if err := opts.validate(); err != nil {
+		respondUploadError(c, err)
+		return
+	}
+
+	batch := &models.Batch{
+		ID:        uuid.New().String(),
+		CreatedAt: time.Now(),
+		OwnerID:   opts.OwnerID,
+		TenantID:  opts.TenantID,
+		Items:     []models.BatchItem{},
+	}
+
+	// Images stored before a failure stay queued, so the batch is saved and
+	// reported even when the request is cut short
+	var failure error
+	for failure == nil {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			failure = bodyError(err)
+			break
+		}
+
+		if part.FileName() != "" {
+			body := &errorReader{reader: part}
+			failure = h.addBatchFile(c.Request.Context(), batch, body, part.FileName(), opts)
+			if failure == nil && body.err != nil {
+				failure = bodyError(body.err)
+			}
+		}
+		if err := part.Close(); err != nil {
+			slog.WarnContext(c.Request.Context(), "failed to close multipart part", "error", err)
+		}
+	}
+
+	if len(batch.Items) == 0 {
+		if failure == nil {
+			failure = &uploadError{http.StatusBadRequest, "No images provided"}
+		}
+		respondUploadError(c, failure)
+		return
+	}
+
+	if err := h.metadata.SaveBatch(batch); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save batch"})
+		return
+	}
+
+	if failure != nil {
+		var uerr *uploadError
+		if !errors.As(failure, &uerr) {
+			uerr = &uploadError{http.StatusInternalServerError, failure.Error()}
+		}
+		c.JSON(uerr.status, gin.H{"error": uerr.message, "batch": batch})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"id":      batch.ID,
+		"items":   batch.Items,
+		"message": "Batch uploaded successfully and queued for processing",
+	})
+}
+
+// addBatchFile adds an uploaded file, unpacking it when it is an archive.
+// Only errors that end the whole batch are returned
+func (h *ImageHandler) addBatchFile(ctx context.Context, batch *models.Batch, reader io.Reader, name string, opts uploadOptions) error {
+	buffered := bufio.NewReaderSize(reader, archiveSniffLen)
+	head, err := buffered.Peek(archiveSniffLen)
+	if err != nil && err != io.EOF {
+		return bodyError(err)
+	}
+
+	switch {
+	case bytes.HasPrefix(head, zipMagic):
+		return h.addZip(ctx, batch, buffered, name, opts)
+	case bytes.HasPrefix(head, gzipMagic):
+		gz, err := gzip.NewReader(buffered)
+		if err != nil {
+			batch.Items = append(batch.Items, models.BatchItem{Name: name, Error: "Invalid archive"})
+			return nil
+		}
+		return h.addTar(ctx, batch, tar.NewReader(gz), name, opts)
+	case isTar(head):
+		return h.addTar(ctx, batch, tar.NewReader(buffered), name, opts)
+	default:
+		return h.addBatchImage(ctx, batch, buffered, name, opts)
+	}
+}
+
+// addTar adds the regular files of a tar stream
+func (h *ImageHandler) addTar(ctx context.Context, batch *models.Batch, archive *tar.Reader, name string, opts uploadOptions) error {
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			batch.Items = append(batch.Items, models.BatchItem{Name: name, Error: "Invalid archive"})
+			return nil
+		}
+
+		if header.Typeflag != tar.TypeReg || skipArchiveEntry(header.Name) {
+			continue
+		}
+		if err := h.addBatchImage(ctx, batch, archive, header.Name, opts); err != nil {
+			return err
+		}
+	}
+}
+
+// addZip adds the files of a ZIP archive. The archive is spooled to disk
+// first since its directory is stored at the end
+func (h *ImageHandler) addZip(ctx context.Context, batch *models.Batch, reader io.Reader, name string, opts uploadOptions) error {
+	tmp, err := os.CreateTemp("", "batch-*.zip")
+	if err != nil {
+		return &uploadError{http.StatusInternalServerError, "Failed to read archive"}
+	}
+	defer func() {
+		if err := tmp.Close(); err != nil {
+			slog.WarnContext(ctx, "failed to close temp file", "error", err)
+		}
+		if err := os.Remove(tmp.Name()); err != nil {
+			slog.WarnContext(ctx, "failed to remove temp file", "path", tmp.Name(), "error", err)
+		}
+	}()
+
+	size, err := io.Copy(tmp, reader)
+	if err != nil {
+		// A failing request body is reported by the caller
+		return nil
+	}
+
+	archive, err := zip.NewReader(tmp, size)
+	if err != nil {
+		batch.Items = append(batch.Items, models.BatchItem{Name: name, Error: "Invalid archive"})
+		return nil
+	}
+
+	for _, file := range archive.File {
+		if file.FileInfo().IsDir() || skipArchiveEntry(file.Name) {
+			continue
+		}
+
+		entry, err := file.Open()
+		if err != nil {
+			batch.Items = append(batch.Items, models.BatchItem{Name: file.Name, Error: "Invalid archive entry"})
+			continue
+		}
+		err = h.addBatchImage(ctx, batch, entry, file.Name, opts)
+		if cerr := entry.Close(); cerr != nil {
+			slog.WarnContext(ctx, "failed to close archive entry", "entry", file.Name, "error", cerr)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addBatchImage ingests one image and records the outcome as a batch item
+func (h *ImageHandler) addBatchImage(ctx context.Context, batch *models.Batch, reader io.Reader, name string, opts uploadOptions) error {
+	if len(batch.Items) >= h.maxBatchItems {
+		return &uploadError{http.StatusRequestEntityTooLarge, "Batch exceeds the maximum number of images"}
+	}
+
+	item := models.BatchItem{Name: name}
+	opts.Filename = path.Base(name)
+	result, err := h.ingestImage(ctx, reader, opts)
+	if err != nil {
+		item.Error = err.Error()
+	} else {
+		item.ImageID = result.ID
+		item.Duplicate = result.Duplicate
+	}
+	batch.Items = append(batch.Items, item)
+	return nil
+}
+
+// GetBatch handles batch progress requests
+func (h *ImageHandler) GetBatch(c *gin.Context) {
+	batch, err := h.metadata.GetBatch(c.Param("id"))
+	if errors.Is(err, metadata.ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Batch not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get batch"})
+		return
+	}
+	if !auth.CanAccess(c, batch.TenantID, batch.OwnerID) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Batch not found"})
+		return
+	}
+
+	status := &BatchStatus{
+		ID:        batch.ID,
+		CreatedAt: batch.CreatedAt,
+		Total:     len(batch.Items),
+		Items:     make([]BatchItemStatus, 0, len(batch.Items)),
+	}
+	for _, item := range batch.Items {
+		itemStatus := BatchItemStatus{BatchItem: item}
+		if item.ImageID == "" {
+			status.Rejected++
+			status.Items = append(status.Items, itemStatus)
+			continue
+		}
+
+		meta, err := h.metadata.Get(item.ImageID)
+		if err != nil {
+			// Deleted since, or unreadable: count it as failed
+			slog.WarnContext(c.Request.Context(), "failed to get metadata of batch image", "batch_id", batch.ID, "image_id", item.ImageID, "error", err)
+			itemStatus.Status = models.StatusFailed
+		} else {
+			itemStatus.Status = meta.Status
+		}
+
+		switch itemStatus.Status {
+		case models.StatusProcessing:
+			status.Processing++
+		case models.StatusDone:
+			status.Done++
+		case models.StatusFailed:
+			status.Failed++
+		default:
+			status.Queued++
+		}
+		status.Items = append(status.Items, itemStatus)
+	}
+
+	finished := status.Done + status.Failed + status.Rejected
+	status.Complete = finished == status.Total
+	if status.Total > 0 {
+		status.Progress = float64(finished) / float64(status.Total)
+	}
+
+	c.JSON(http.StatusOK, status)
+}
+
+// isTar reports whether head starts with a POSIX or GNU tar header
+func isTar(head []byte) bool {
+	offset := 257
+	return len(head) >= offset+len(tarMagic) && bytes.Equal(head[offset:offset+len(tarMagic)], tarMagic)
+}
+
+// skipArchiveEntry leaves out hidden files and macOS resource forks
+func skipArchiveEntry(name string) bool {
+	return strings.HasPrefix(path.Base(name), ".") || strings.Contains(name, "__MACOSX/")
+}
+
+// errorReader remembers the first read error other than io.EOF so that a
+// failing request body can be told apart from a bad file
+type errorReader struct {
+	reader io.Reader
+	err    error
+}
+
+func (r *errorReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if err != nil && err != io.EOF && r.err == nil {
+		r.err = err
+	}
+	return n, err
+}
@@ -0,0 +1,115 @@
+package handlers
+
+import (
+	"errors"
+	"img-resizer/internal/auth"
+	"img-resizer/internal/metadata"
+	"img-resizer/internal/models"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// eventsHeartbeat keeps idle streams open through proxies
+const eventsHeartbeat = 15 * time.Second
+
+// GetEvents streams the state transitions of an image as Server-Sent Events.
+// The current state is sent first, the stream ends after done or failed
+func (h *ImageHandler) GetEvents(c *gin.Context) {
+	id := c.Param("id")
+
+	// Subscribe before reading the state so no transition falls in between
+	events, unsubscribe := h.events.Subscribe(id)
+	defer unsubscribe()
+
+	meta, err := h.metadata.Get(id)
+	if errors.Is(err, metadata.ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Image not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get image metadata"})
+		return
+	}
+	if !auth.CanAccess(c, meta.TenantID, meta.OwnerID) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Image not found"})
+		return
+	}
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+
+	current := statusEvent(meta)
+	sendEvent(c, current)
+	if current.Final() {
+		return
+	}
+
+	ticker := time.NewTicker(eventsHeartbeat)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case <-h.events.Done():
+			// The server is shutting down, clients reconnect to another
+			// instance
+			return
+		case event := <-events:
+			sendEvent(c, event)
+			if event.Final() {
+				return
+			}
+		case <-ticker.C:
+			// Events are dropped for slow clients, so make sure the final
+			// state is not missed
+			if meta, err := h.metadata.Get(id); err == nil {
+				if current := statusEvent(meta); current.Final() {
+					sendEvent(c, current)
+					return
+				}
+			}
+			if _, err := io.WriteString(c.Writer, ": ping\n\n"); err != nil {
+				return
+			}
+			c.Writer.Flush()
+		}
+	}
+}
+
+// publishEvent broadcasts a progress event. Events are informational, so
+// failures are only logged
+func (h *ImageHandler) publishEvent(id string, eventType models.EventType) {
+	event := &models.ProgressEvent{ImageID: id, Type: eventType, At: time.Now()}
+	if err := h.queue.PublishEvent(event); err != nil {
+		slog.Warn("failed to publish event", "event", eventType, "image_id", id, "error", err)
+	}
+}
+
+// statusEvent describes the stored state of an image as an event
+func statusEvent(meta *models.ImageMetadata) *models.ProgressEvent {
+	event := &models.ProgressEvent{ImageID: meta.ID, At: time.Now()}
+	switch meta.Status {
+	case models.StatusProcessing:
+		event.Type = models.EventProcessing
+	case models.StatusDone:
+		event.Type = models.EventDone
+	case models.StatusFailed:
+		event.Type = models.EventFailed
+		event.Error = meta.Error
+	default:
+		event.Type = models.EventQueued
+	}
+	return event
+}
+
+func sendEvent(c *gin.Context, event *models.ProgressEvent) {
+	c.SSEvent(string(event.Type), event)
+	c.Writer.Flush()
+}
@@ -1,88 +1,396 @@
 package handlers
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"img-resizer/internal/auth"
+	"img-resizer/internal/config"
+	"img-resizer/internal/events"
+	"img-resizer/internal/fetcher"
+	"img-resizer/internal/metadata"
+	"img-resizer/internal/metrics"
 	"img-resizer/internal/models"
 	"img-resizer/internal/processor"
 	"img-resizer/internal/queue"
 	"img-resizer/internal/storage"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
+	"os"
+	"path"
 	"path/filepath"
+	"slices"
+	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 )
 
+// defaultSimilarDistance is the Hamming distance under which two perceptual
+// hashes are considered near-duplicates
+const defaultSimilarDistance = 10
+
+// multipartOverhead is allowed on top of the image size for the multipart
+// framing and form fields of an upload
+const multipartOverhead = 64 << 10
+
 type ImageHandler struct {
-	storage   storage.Storage
-	queue     *queue.RabbitMQ
-	processor *processor.Processor
+	storage  storage.Storage
+	metadata metadata.Store
+	queue    *queue.RabbitMQ
+	events   *events.Hub
+	presets  []models.Preset
+
+	maxUploadSize int64
+	maxBatchSize  int64
+	maxBatchItems int
+
+	allowPrivateFetch bool
 }
 
-func NewImageHandler(storage storage.Storage, queue *queue.RabbitMQ) *ImageHandler {
+func NewImageHandler(cfg *config.Config, storage storage.Storage, metadata metadata.Store, queue *queue.RabbitMQ, events *events.Hub) *ImageHandler {
 	return &ImageHandler{
-		storage:   storage,
-		queue:     queue,
-		processor: processor.NewProcessor(),
+		storage:  storage,
+		metadata: metadata,
+		queue:    queue,
+		events:   events,
+		presets:  cfg.Presets,
+
+		maxUploadSize: cfg.Upload.MaxSize,
+		maxBatchSize:  cfg.Upload.MaxBatchSize,
+		maxBatchItems: cfg.Upload.MaxBatchItems,
+
+		allowPrivateFetch: cfg.Fetch.AllowPrivate,
 	}
 }
 
-// UploadImage handles image upload requests
+// UploadImage handles image upload requests. The multipart body is read
+// part by part so the image streams to storage instead of into memory
 func (h *ImageHandler) UploadImage(c *gin.Context) {
-	// Get the file from the request
-	file, header, err := c.Request.FormFile("image")
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, h.maxUploadSize+multipartOverhead)
+
+	reader, err := c.Request.MultipartReader()
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "No image provided"})
 		return
 	}
-	defer func() {
-		if err := file.Close(); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to close file"})
+
+	ctx := c.Request.Context()
+	opts := newUploadOptions(c)
+	var staged *stagedImage
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			h.discardImage(ctx, staged)
+			respondUploadError(c, bodyError(err))
+			return
 		}
-	}()
 
-	if !isImage(header.Filename) {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "File is not an image"})
-		return
+		switch part.FormName() {
+		case "image":
+			// Only the first image of a request is used
+			if staged == nil {
+				opts.Filename = part.FileName()
+				staged, err = h.stageImage(ctx, part, opts.TenantID)
+			}
+		case "dedupe":
+			var value []byte
+			if value, err = io.ReadAll(io.LimitReader(part, 16)); err != nil {
+				err = bodyError(err)
+			}
+			opts.Dedupe, _ = strconv.ParseBool(string(value))
+		case "webhook":
+			var value []byte
+			if value, err = io.ReadAll(io.LimitReader(part, 2048)); err != nil {
+				err = bodyError(err)
+			}
+			opts.WebhookURL = string(value)
+		}
+		if cerr := part.Close(); cerr != nil {
+			slog.WarnContext(ctx, "failed to close multipart part", "error", cerr)
+		}
+		if err != nil {
+			h.discardImage(ctx, staged)
+			respondUploadError(c, err)
+			return
+		}
 	}
 
-	id := uuid.New().String()
+	if staged == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No image provided"})
+		return
+	}
 
-	// Read the image data
-	imageData, err := h.processor.ReadAll(file)
+	result, err := h.commitImage(ctx, staged, opts)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read image"})
+		respondUploadError(c, err)
 		return
 	}
 
-	// Save the original image
-	_, err = h.storage.Save(id, models.QualityOriginal, bytes.NewReader(imageData))
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save image"})
+	if result.Duplicate {
+		c.JSON(http.StatusOK, gin.H{
+			"id":        result.ID,
+			"duplicate": true,
+			"message":   "Image already uploaded",
+		})
+		return
+	}
+
+	// Return the image ID
+	c.JSON(http.StatusOK, gin.H{
+		"id":      result.ID,
+		"message": "Image uploaded successfully and queued for processing",
+	})
+}
+
+// uploadError is a failed upload together with the status code to report
+type uploadError struct {
+	status  int
+	message string
+}
+
+func (e *uploadError) Error() string {
+	return e.message
+}
+
+// respondUploadError writes an error returned by ingestImage
+func respondUploadError(c *gin.Context, err error) {
+	var uerr *uploadError
+	if errors.As(err, &uerr) {
+		c.JSON(uerr.status, gin.H{"error": uerr.message})
 		return
 	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+}
+
+// bodyError converts a failure reading the request body into an uploadError
+func bodyError(err error) error {
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		return &uploadError{http.StatusRequestEntityTooLarge, "Image exceeds the maximum upload size"}
+	}
+	return &uploadError{http.StatusBadRequest, "Failed to read image"}
+}
+
+// uploadResult is the image an upload was stored as
+type uploadResult struct {
+	ID        string
+	Duplicate bool
+}
+
+// uploadOptions are the client's choices for an uploaded image
+type uploadOptions struct {
+	Filename   string
+	Dedupe     bool   // return an earlier upload of the same bytes instead
+	WebhookURL string // notified when processing ends
+	OwnerID    string // API key or token subject uploading the image
+	TenantID   string
+}
+
+// newUploadOptions reads the options given in the query string. The webhook
+// defaults to the one configured for the API key
+func newUploadOptions(c *gin.Context) uploadOptions {
+	opts := uploadOptions{
+		WebhookURL: c.Query("webhook"),
+		OwnerID:    auth.OwnerID(c),
+		TenantID:   auth.TenantID(c),
+	}
+	opts.Dedupe, _ = strconv.ParseBool(c.Query("dedupe"))
+	if key := auth.FromContext(c); key != nil && opts.WebhookURL == "" {
+		opts.WebhookURL = key.WebhookURL
+	}
+	return opts
+}
+
+// validate checks the options before anything is stored
+func (o uploadOptions) validate() error {
+	if o.WebhookURL == "" {
+		return nil
+	}
+	if err := fetcher.ValidateURL(o.WebhookURL); err != nil {
+		return &uploadError{http.StatusBadRequest, "Invalid webhook url: " + err.Error()}
+	}
+	return nil
+}
+
+// stagedImage is an original saved to storage but not registered yet
+type stagedImage struct {
+	ID       string
+	TenantID string
+	SHA256   string
+	Size     int64
+	Format   processor.Format
+}
+
+// ingestImage stores an uploaded image with its metadata and queues it for
+// processing. Every upload endpoint goes through it
+func (h *ImageHandler) ingestImage(ctx context.Context, reader io.Reader, opts uploadOptions) (*uploadResult, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	staged, err := h.stageImage(ctx, reader, opts.TenantID)
+	if err != nil {
+		return nil, err
+	}
+	return h.commitImage(ctx, staged, opts)
+}
+
+// stageImage streams an upload to storage, detecting its format from the
+// first bytes and hashing it on the way
+func (h *ImageHandler) stageImage(ctx context.Context, reader io.Reader, tenantID string) (*stagedImage, error) {
+	buffered := bufio.NewReaderSize(reader, processor.SniffLen)
+	head, err := buffered.Peek(processor.SniffLen)
+	if err != nil && err != io.EOF {
+		return nil, bodyError(err)
+	}
+
+	// The format is detected from the content, not the file name
+	if !isImage(head) {
+		return nil, &uploadError{http.StatusBadRequest, "File is not an image"}
+	}
+
+	staged := &stagedImage{
+		ID:       uuid.New().String(),
+		TenantID: tenantID,
+		Format:   processor.DetectFormat(head),
+	}
+
+	// Read one byte past the limit to tell a full-size image from a larger one
+	hasher := sha256.New()
+	counter := &countingReader{reader: io.TeeReader(io.LimitReader(buffered, h.maxUploadSize+1), hasher)}
+	if _, err := h.storage.Save(ctx, storage.Key(tenantID, staged.ID), models.QualityOriginal, counter); err != nil {
+		h.discardImage(ctx, staged)
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			return nil, bodyError(err)
+		}
+		return nil, &uploadError{http.StatusInternalServerError, "Failed to save image"}
+	}
+	if counter.n > h.maxUploadSize {
+		h.discardImage(ctx, staged)
+		return nil, &uploadError{http.StatusRequestEntityTooLarge, "Image exceeds the maximum upload size"}
+	}
+
+	staged.SHA256 = hex.EncodeToString(hasher.Sum(nil))
+	staged.Size = counter.n
+	metrics.UploadBytes.Add(float64(counter.n))
+	return staged, nil
+}
+
+// commitImage records the metadata of a staged image and queues it. With
+// Dedupe, an earlier upload of the same bytes is returned instead
+func (h *ImageHandler) commitImage(ctx context.Context, staged *stagedImage, opts uploadOptions) (*uploadResult, error) {
+	if err := opts.validate(); err != nil {
+		h.discardImage(ctx, staged)
+		return nil, err
+	}
+
+	if opts.Dedupe {
+		existing, err := h.findDuplicate(opts.TenantID, opts.OwnerID, staged.SHA256)
+		if err != nil {
+			h.discardImage(ctx, staged)
+			return nil, &uploadError{http.StatusInternalServerError, "Failed to look up duplicates"}
+		}
+		// Entries indexed before the index was kept per tenant and owner
+		// are shared, images of others are still never handed out
+		if existing != nil && existing.TenantID == opts.TenantID && (opts.TenantID != "" || existing.OwnerID == opts.OwnerID) {
+			h.discardImage(ctx, staged)
+			return &uploadResult{ID: existing.ID, Duplicate: true}, nil
+		}
+	}
+
+	if err := h.reserveUsage(opts.TenantID, staged.Size, 1); err != nil {
+		h.discardImage(ctx, staged)
+		return nil, err
+	}
+
+	id := staged.ID
+
+	// Record what we know before processing, the worker fills in the rest
+	// including the perceptual hash, which needs the decoded image
+	err := h.metadata.Save(&models.ImageMetadata{
+		ID:           id,
+		OriginalName: opts.Filename,
+		MimeType:     staged.Format.MimeType(),
+		Size:         staged.Size,
+		CreatedAt:    time.Now(),
+		SHA256:       staged.SHA256,
+		Status:       models.StatusQueued,
+		Qualities:    []models.ImageQuality{models.QualityOriginal},
+		WebhookURL:   opts.WebhookURL,
+		OwnerID:      opts.OwnerID,
+		TenantID:     opts.TenantID,
+	})
+	if err != nil {
+		h.releaseUsage(opts.TenantID, staged.Size, 1)
+		h.discardImage(ctx, staged)
+		return nil, &uploadError{http.StatusInternalServerError, "Failed to save image metadata"}
+	}
+	h.publishEvent(id, models.EventUploaded)
 
 	// Create a task for processing the image
 	task := &models.ImageProcessingTask{
 		ID:       id,
-		FilePath: filepath.Join("storage", id[:2], fmt.Sprintf("%s_%s.jpg", id, models.QualityOriginal)),
+		FilePath: filepath.Join("storage", path.Dir(storage.Key(opts.TenantID, id)), id[:2], fmt.Sprintf("%s_%s.jpg", id, models.QualityOriginal)),
+		TenantID: opts.TenantID,
 	}
 
 	// Publish the task to the queue
-	err = h.queue.PublishTask(task)
+	err = h.queue.PublishTask(ctx, task)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to queue image for processing"})
-		return
+		// Nothing will process the image, it is dropped
+		h.deleteMetadata(ctx, id)
+		h.releaseUsage(opts.TenantID, staged.Size, 1)
+		h.discardImage(ctx, staged)
+		return nil, &uploadError{http.StatusInternalServerError, "Failed to queue image for processing"}
 	}
+	h.publishEvent(id, models.EventQueued)
 
-	// Return the image ID
-	c.JSON(http.StatusOK, gin.H{
-		"id":      id,
-		"message": "Image uploaded successfully and queued for processing",
-	})
+	return &uploadResult{ID: id}, nil
+}
+
+// findDuplicate returns the image with the given content hash uploaded by
+// the tenant or owner, nil if none. Images of others are never handed out
+func (h *ImageHandler) findDuplicate(tenantID, ownerID, sum string) (*models.ImageMetadata, error) {
+	id, err := h.metadata.FindBySHA256(tenantID, ownerID, sum)
+	if errors.Is(err, metadata.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	meta, err := h.metadata.Get(id)
+	if errors.Is(err, metadata.ErrNotFound) {
+		return nil, nil
+	}
+	return meta, err
+}
+
+// deleteMetadata deletes the metadata of an image that could not be queued
+func (h *ImageHandler) deleteMetadata(ctx context.Context, id string) {
+	if err := h.metadata.Delete(id); err != nil {
+		slog.ErrorContext(ctx, "failed to delete image metadata", "image_id", id, "error", err)
+	}
+}
+
+// discardImage deletes the original of a staged image that was not committed
+func (h *ImageHandler) discardImage(ctx context.Context, staged *stagedImage) {
+	if staged == nil {
+		return
+	}
+	if err := h.storage.Delete(ctx, storage.Key(staged.TenantID, staged.ID), models.QualityOriginal); err != nil && !os.IsNotExist(err) {
+		slog.ErrorContext(ctx, "failed to delete staged image", "image_id", staged.ID, "error", err)
+	}
 }
 
 // GetImage handles image retrieval requests
@@ -98,47 +406,219 @@ func (h *ImageHandler) GetImage(c *gin.Context) {
 	qualityStr := c.DefaultQuery("quality", string(models.QualityOriginal))
 	quality := models.ImageQuality(qualityStr)
 
-	// Validate the quality
-	switch quality {
-	case models.QualityOriginal, models.QualityHigh, models.QualityMedium, models.QualityLow:
-		// Valid quality
-	default:
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid quality parameter"})
+	// The metadata tells where the image is stored and, since presets
+	// differ between tenants, which qualities it has
+	meta, err := h.metadata.Get(id)
+	if errors.Is(err, metadata.ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Image not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get image metadata"})
+		return
+	}
+	if !slices.Contains(meta.Qualities, quality) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Image quality not available"})
 		return
 	}
 
 	// Get the image from storage
-	image, err := h.storage.Get(id, quality)
+	image, err := h.storage.Get(c.Request.Context(), storage.Key(meta.TenantID, meta.ID), quality)
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Image not found"})
 		return
 	}
 	defer func() {
 		if err := image.Close(); err != nil {
-			log.Printf("failed to close image: %v", err)
+			slog.WarnContext(c.Request.Context(), "failed to close image", "image_id", meta.ID, "error", err)
 		}
 	}()
 
-	// Set the content type
-	c.Header("Content-Type", "image/jpeg")
+	content, err := seekableImage(image)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read image"})
+		return
+	}
+
+	// Originals and variants come in several formats, so sniff the content type
+	head := make([]byte, processor.SniffLen)
+	n, err := io.ReadFull(content, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read image"})
+		return
+	}
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read image"})
+		return
+	}
+
+	c.Header("Content-Type", processor.DetectFormat(head[:n]).MimeType())
 	c.Header("Cache-Control", "public, max-age=31536000")
+	if hash := meta.ContentHash(quality); hash != "" {
+		c.Header("ETag", `"`+hash+`"`)
+	}
+
+	// ServeContent answers conditional, range and HEAD requests and sets
+	// Content-Length and Last-Modified. The time comes from the metadata,
+	// as the files of the cache and the storage are written at other times
+	http.ServeContent(c.Writer, c.Request, "", meta.ModTime(quality), content)
+}
+
+// seekableImage returns a stored image as a seeker. Storage readers that
+// cannot seek are read into memory, which is bounded by the upload size for
+// originals and variants alike
+func seekableImage(image io.Reader) (io.ReadSeeker, error) {
+	if seeker, ok := image.(io.ReadSeeker); ok {
+		return seeker, nil
+	}
+	data, err := io.ReadAll(image)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(data), nil
+}
+
+// GetMetadata handles image metadata requests
+func (h *ImageHandler) GetMetadata(c *gin.Context) {
+	meta, err := h.metadata.Get(c.Param("id"))
+	if errors.Is(err, metadata.ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Image not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get image metadata"})
+		return
+	}
+	// Images of other API keys look missing rather than forbidden
+	if !auth.CanAccess(c, meta.TenantID, meta.OwnerID) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Image not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, meta)
+}
+
+// GetStatus handles image processing status requests
+func (h *ImageHandler) GetStatus(c *gin.Context) {
+	meta, err := h.metadata.Get(c.Param("id"))
+	if errors.Is(err, metadata.ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Image not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get image status"})
+		return
+	}
+	if !auth.CanAccess(c, meta.TenantID, meta.OwnerID) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Image not found"})
+		return
+	}
 
-	// Stream the image to the response
-	_, err = io.Copy(c.Writer, image)
+	c.JSON(http.StatusOK, gin.H{
+		"id":           meta.ID,
+		"status":       meta.Status,
+		"error":        meta.Error,
+		"qualities":    meta.Qualities,
+		"placeholders": meta.Placeholders,
+	})
+}
+
+// GetSimilar handles requests for near-duplicates of an image
+func (h *ImageHandler) GetSimilar(c *gin.Context) {
+	distance, err := strconv.Atoi(c.DefaultQuery("distance", strconv.Itoa(defaultSimilarDistance)))
+	if err != nil || distance < 0 || distance > 64 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid distance parameter"})
+		return
+	}
+
+	meta, err := h.metadata.Get(c.Param("id"))
+	if errors.Is(err, metadata.ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Image not found"})
+		return
+	}
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to stream image"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get image metadata"})
 		return
 	}
+	if !auth.CanAccess(c, meta.TenantID, meta.OwnerID) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Image not found"})
+		return
+	}
+	if meta.PerceptualHash == "" {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Image has no perceptual hash"})
+		return
+	}
+
+	matches, err := h.metadata.FindSimilar(meta.TenantID, meta.OwnerID, meta.PerceptualHash, distance)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to find similar images"})
+		return
+	}
+
+	similar := make([]metadata.Match, 0, len(matches))
+	for _, match := range matches {
+		if match.ID != meta.ID && h.canAccessImage(c, match.ID) {
+			similar = append(similar, match)
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"id":      meta.ID,
+		"similar": similar,
+	})
+}
+
+// DeleteImage handles requests to delete an image with all its variants
+func (h *ImageHandler) DeleteImage(c *gin.Context) {
+	meta, err := h.metadata.Get(c.Param("id"))
+	if errors.Is(err, metadata.ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Image not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get image metadata"})
+		return
+	}
+	if !auth.CanAccess(c, meta.TenantID, meta.OwnerID) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Image not found"})
+		return
+	}
+
+	for _, quality := range meta.Qualities {
+		if err := h.storage.Delete(c.Request.Context(), storage.Key(meta.TenantID, meta.ID), quality); err != nil && !os.IsNotExist(err) {
+			slog.ErrorContext(c.Request.Context(), "failed to delete image", "image_id", meta.ID, "quality", quality, "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete image"})
+			return
+		}
+	}
+
+	// The metadata goes last so a failed deletion can be retried
+	if err := h.metadata.Delete(meta.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete image metadata"})
+		return
+	}
+	if meta.HoldsUsage() {
+		h.releaseUsage(meta.TenantID, meta.StoredSize(), 1)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"id":      meta.ID,
+		"message": "Image deleted",
+	})
 }
 
-// Checks file for extensions
-// Can add more as needed
-func isImage(filename string) bool {
-	ext := filepath.Ext(filename)
-	switch ext {
-	case ".jpg", ".jpeg", ".png", ".webp":
+// canAccessImage reports whether the request may see another image
+func (h *ImageHandler) canAccessImage(c *gin.Context, id string) bool {
+	key := auth.FromContext(c)
+	if key == nil {
 		return true
-	default:
-		return false
 	}
+	meta, err := h.metadata.Get(id)
+	return err == nil && key.Owns(meta.TenantID, meta.OwnerID)
+}
+
+// Checks file content for a supported image format
+// Can add more in processor.DetectFormat as needed
+func isImage(data []byte) bool {
+	return processor.DetectFormat(data) != processor.FormatUnknown
 }
@@ -0,0 +1,99 @@
+package handlers
+
+import (
+	"img-resizer/internal/fetcher"
+	"img-resizer/internal/models"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"path"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// ImportRequest is the body of an import by URL
+type ImportRequest struct {
+	URL     string `json:"url" binding:"required"`
+	Webhook string `json:"webhook"`
+}
+
+// ImportImage handles requests to import an image from a URL. The download
+// happens in the worker, the image is queued right away
+func (h *ImageHandler) ImportImage(c *gin.Context) {
+	var req ImportRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if err := fetcher.ValidateURL(req.URL); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid url: " + err.Error()})
+		return
+	}
+
+	opts := newUploadOptions(c)
+	if req.Webhook != "" {
+		opts.WebhookURL = req.Webhook
+	}
+	if err := opts.validate(); err != nil {
+		respondUploadError(c, err)
+		return
+	}
+
+	// Literal internal addresses are refused early, names are checked by the
+	// worker once resolved
+	source, _ := url.Parse(req.URL)
+	if addr, err := netip.ParseAddr(source.Hostname()); err == nil && !h.allowPrivateFetch && !fetcher.IsPublic(addr) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid url: address is not allowed"})
+		return
+	}
+
+	name := path.Base(source.Path)
+	if name == "." || name == "/" {
+		name = source.Hostname()
+	}
+
+	// The size is unknown until the worker downloads the image, which then
+	// checks it against the quota
+	if err := h.reserveUsage(opts.TenantID, 0, 1); err != nil {
+		respondUploadError(c, err)
+		return
+	}
+
+	id := uuid.New().String()
+	err := h.metadata.Save(&models.ImageMetadata{
+		ID:           id,
+		OriginalName: name,
+		CreatedAt:    time.Now(),
+		Status:       models.StatusQueued,
+		SourceURL:    req.URL,
+		WebhookURL:   opts.WebhookURL,
+		OwnerID:      opts.OwnerID,
+		TenantID:     opts.TenantID,
+	})
+	if err != nil {
+		h.releaseUsage(opts.TenantID, 0, 1)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save image metadata"})
+		return
+	}
+
+	task := &models.ImageProcessingTask{
+		ID:        id,
+		Type:      models.TaskImport,
+		SourceURL: req.URL,
+		TenantID:  opts.TenantID,
+	}
+	if err := h.queue.PublishTask(c.Request.Context(), task); err != nil {
+		h.deleteMetadata(c.Request.Context(), id)
+		h.releaseUsage(opts.TenantID, 0, 1)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to queue image for import"})
+		return
+	}
+	h.publishEvent(id, models.EventQueued)
+
+	c.JSON(http.StatusOK, gin.H{
+		"id":      id,
+		"message": "Image queued for import",
+	})
+}
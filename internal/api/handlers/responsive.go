@@ -0,0 +1,181 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"img-resizer/internal/auth"
+	"img-resizer/internal/metadata"
+	"img-resizer/internal/models"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// defaultSizes is used when the client does not pass a sizes attribute
+const defaultSizes = "100vw"
+
+// sourceTypeOrder lists MIME types from most to least efficient, which is the
+// order browsers expect <picture> sources in
+var sourceTypeOrder = []string{"image/avif", "image/webp", "image/png", "image/gif", "image/jpeg"}
+
+// ResponsiveVariant is one available width/format of an image
+type ResponsiveVariant struct {
+	Quality models.ImageQuality `json:"quality"`
+	URL     string              `json:"url"`
+	Type    string              `json:"type"`
+	Width   int                 `json:"width"`
+	Height  int                 `json:"height"`
+	Size    int64               `json:"size"`
+}
+
+// PictureSource is a ready-to-use <source> element of a <picture>
+type PictureSource struct {
+	Type   string `json:"type"`
+	Srcset string `json:"srcset"`
+	Sizes  string `json:"sizes"`
+}
+
+// ResponsiveImage is the data needed to render an <img srcset> or <picture>
+type ResponsiveImage struct {
+	ID       string              `json:"id"`
+	Family   string              `json:"family"`
+	Width    int                 `json:"width"`
+	Height   int                 `json:"height"`
+	Src      string              `json:"src"`
+	Srcset   string              `json:"srcset"`
+	Sizes    string              `json:"sizes"`
+	Sources  []PictureSource     `json:"sources"`
+	Variants []ResponsiveVariant `json:"variants"`
+}
+
+// GetResponsive handles requests for srcset and <picture> data of a preset family
+func (h *ImageHandler) GetResponsive(c *gin.Context) {
+	id := c.Param("id")
+	family := c.DefaultQuery("family", "default")
+	sizes := c.DefaultQuery("sizes", defaultSizes)
+
+	meta, err := h.metadata.Get(id)
+	if errors.Is(err, metadata.ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Image not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get image metadata"})
+		return
+	}
+	if !auth.CanAccess(c, meta.TenantID, meta.OwnerID) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Image not found"})
+		return
+	}
+
+	presets, err := h.presetsFor(meta.TenantID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get presets"})
+		return
+	}
+
+	// Presets of the requested family, in configured order
+	inFamily := make(map[models.ImageQuality]bool)
+	for _, preset := range presets {
+		if preset.Family == family {
+			inFamily[models.ImageQuality(preset.Name)] = true
+		}
+	}
+	if len(inFamily) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown preset family"})
+		return
+	}
+
+	variants := responsiveVariants(meta, inFamily)
+	if len(variants) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No variants available yet"})
+		return
+	}
+
+	c.JSON(http.StatusOK, buildResponsiveImage(meta, family, sizes, variants))
+}
+
+// responsiveVariants returns the processed variants of the family. When
+// several presets produce the same width and type, the first one wins since
+// a srcset cannot list a width twice
+func responsiveVariants(meta *models.ImageMetadata, inFamily map[models.ImageQuality]bool) []ResponsiveVariant {
+	seen := make(map[string]bool)
+	var variants []ResponsiveVariant
+	for _, variant := range meta.Variants {
+		if !inFamily[variant.Quality] {
+			continue
+		}
+		key := fmt.Sprintf("%s/%d", variant.MimeType, variant.Width)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		variants = append(variants, ResponsiveVariant{
+			Quality: variant.Quality,
+			URL:     variantURL(meta.ID, variant.Quality),
+			Type:    variant.MimeType,
+			Width:   variant.Width,
+			Height:  variant.Height,
+			Size:    variant.Size,
+		})
+	}
+
+	sort.SliceStable(variants, func(i, j int) bool {
+		return variants[i].Width < variants[j].Width
+	})
+	return variants
+}
+
+// buildResponsiveImage groups variants by type into <picture> sources and
+// picks the widest variant of the most compatible type as the fallback src
+func buildResponsiveImage(meta *models.ImageMetadata, family, sizes string, variants []ResponsiveVariant) *ResponsiveImage {
+	byType := make(map[string][]ResponsiveVariant)
+	for _, variant := range variants {
+		byType[variant.Type] = append(byType[variant.Type], variant)
+	}
+
+	result := &ResponsiveImage{
+		ID:       meta.ID,
+		Family:   family,
+		Width:    meta.Width,
+		Height:   meta.Height,
+		Sizes:    sizes,
+		Variants: variants,
+	}
+
+	for _, mimeType := range sourceTypeOrder {
+		typed, ok := byType[mimeType]
+		if !ok {
+			continue
+		}
+		result.Sources = append(result.Sources, PictureSource{
+			Type:   mimeType,
+			Srcset: srcset(typed),
+			Sizes:  sizes,
+		})
+
+		// The last source in order is the most widely supported one
+		result.Srcset = srcset(typed)
+		result.Src = typed[len(typed)-1].URL
+	}
+
+	return result
+}
+
+// srcset formats variants as a srcset attribute using width descriptors
+func srcset(variants []ResponsiveVariant) string {
+	candidates := make([]string, 0, len(variants))
+	for _, variant := range variants {
+		candidates = append(candidates, fmt.Sprintf("%s %dw", variant.URL, variant.Width))
+	}
+	return strings.Join(candidates, ", ")
+}
+
+// variantURL returns the API path serving a variant
+func variantURL(id string, quality models.ImageQuality) string {
+	return fmt.Sprintf("/api/images/%s?quality=%s", url.PathEscape(id), url.QueryEscape(string(quality)))
+}
@@ -0,0 +1,101 @@
+package handlers
+
+import (
+	"errors"
+	"img-resizer/internal/auth"
+	"img-resizer/internal/metadata"
+	"img-resizer/internal/models"
+	"log/slog"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TenantUsage is the usage report of a tenant
+type TenantUsage struct {
+	models.TenantUsage
+	Quota models.Quota `json:"quota"`
+}
+
+// GetTenantUsage handles tenant usage reporting requests
+func (h *ImageHandler) GetTenantUsage(c *gin.Context) {
+	id := c.Param("id")
+	// Other tenants look missing rather than forbidden
+	if !auth.CanAccess(c, id, "") {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Tenant not found"})
+		return
+	}
+
+	tenant, err := h.metadata.GetTenant(id)
+	if errors.Is(err, metadata.ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Tenant not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get tenant"})
+		return
+	}
+
+	usage, err := h.metadata.GetUsage(tenant.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get tenant usage"})
+		return
+	}
+
+	c.JSON(http.StatusOK, TenantUsage{TenantUsage: *usage, Quota: tenant.Quota})
+}
+
+// reserveUsage records an upload against the quota of its tenant before the
+// image is registered
+func (h *ImageHandler) reserveUsage(tenantID string, bytes int64, images int) error {
+	if tenantID == "" {
+		return nil
+	}
+
+	tenant, err := h.metadata.GetTenant(tenantID)
+	if errors.Is(err, metadata.ErrNotFound) {
+		return &uploadError{http.StatusForbidden, "Unknown tenant"}
+	}
+	if err != nil {
+		return &uploadError{http.StatusInternalServerError, "Failed to get tenant"}
+	}
+
+	_, err = h.metadata.AddUsage(tenantID, bytes, images, &tenant.Quota)
+	if errors.Is(err, metadata.ErrQuotaExceeded) {
+		return &uploadError{http.StatusForbidden, "Tenant storage quota exceeded"}
+	}
+	if err != nil {
+		return &uploadError{http.StatusInternalServerError, "Failed to record tenant usage"}
+	}
+	return nil
+}
+
+// releaseUsage gives back the usage of an image that was deleted or could
+// not be registered. Failures are only logged, the image is gone either way
+func (h *ImageHandler) releaseUsage(tenantID string, bytes int64, images int) {
+	if tenantID == "" {
+		return
+	}
+	if _, err := h.metadata.AddUsage(tenantID, -bytes, -images, nil); err != nil {
+		slog.Error("failed to release usage", "tenant_id", tenantID, "error", err)
+	}
+}
+
+// presetsFor returns the presets the images of a tenant are processed with
+func (h *ImageHandler) presetsFor(tenantID string) ([]models.Preset, error) {
+	if tenantID == "" {
+		return h.presets, nil
+	}
+
+	tenant, err := h.metadata.GetTenant(tenantID)
+	if errors.Is(err, metadata.ErrNotFound) {
+		return h.presets, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(tenant.Presets) > 0 {
+		return tenant.Presets, nil
+	}
+	return h.presets, nil
+}
@@ -0,0 +1,558 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"img-resizer/internal/auth"
+	"img-resizer/internal/models"
+	"img-resizer/internal/storage"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// tusVersion is the only tus protocol version supported
+const tusVersion = "1.0.0"
+
+// Staged uploads live in storage next to images, under reserved qualities
+const (
+	tusStateQuality models.ImageQuality = "tus-state"
+	tusPartPrefix                       = "tus-part-"
+)
+
+// tusSweepInterval is how often expired uploads are looked for
+const tusSweepInterval = time.Hour
+
+// tusUpload is the persisted state of a resumable upload. Every PATCH is
+// stored as a separate part so uploads survive API restarts with any storage
+type tusUpload struct {
+	ID        string            `json:"id"`
+	Length    int64             `json:"length"`
+	Offset    int64             `json:"offset"`
+	Metadata  map[string]string `json:"metadata"`
+	Parts     []int64           `json:"parts"` // offsets of the stored parts
+	CreatedAt time.Time         `json:"createdAt"`
+	UpdatedAt time.Time         `json:"updatedAt"`
+	OwnerID   string            `json:"ownerId,omitempty"`
+	TenantID  string            `json:"tenantId,omitempty"`
+	ImageID   string            `json:"imageId,omitempty"`
+	// Reserved is the usage of the tenant held for the upload until it
+	// completes, so uploads in flight count towards the quota
+	Reserved int64 `json:"reserved,omitempty"`
+}
+
+// key is where the state and parts of the upload are stored, under the
+// prefix of its tenant like its image
+func (u *tusUpload) key() string {
+	return storage.Key(u.TenantID, u.ID)
+}
+
+// TusHandler implements the tus resumable upload protocol (core, creation,
+// termination and expiration). Completed uploads go through the same path
+// as UploadImage
+type TusHandler struct {
+	storage storage.Storage
+	images  *ImageHandler
+	maxSize int64
+	expiry  time.Duration
+
+	mu        sync.Mutex
+	lastSweep time.Time
+}
+
+// NewTusHandler creates the handler. Uploads receiving no chunk for expiry
+// are deleted
+func NewTusHandler(storage storage.Storage, images *ImageHandler, maxSize int64, expiry time.Duration) *TusHandler {
+	return &TusHandler{
+		storage: storage,
+		images:  images,
+		maxSize: maxSize,
+		expiry:  expiry,
+	}
+}
+
+// Options advertises the supported protocol and extensions
+func (h *TusHandler) Options(c *gin.Context) {
+	c.Header("Tus-Resumable", tusVersion)
+	c.Header("Tus-Version", tusVersion)
+	c.Header("Tus-Extension", "creation,termination,expiration")
+	c.Header("Tus-Max-Size", strconv.FormatInt(h.maxSize, 10))
+	c.Status(http.StatusNoContent)
+}
+
+// Create starts a new upload of Upload-Length bytes
+func (h *TusHandler) Create(c *gin.Context) {
+	if !h.checkVersion(c) {
+		return
+	}
+
+	length, err := strconv.ParseInt(c.GetHeader("Upload-Length"), 10, 64)
+	if err != nil || length <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid Upload-Length header"})
+		return
+	}
+	if length > h.maxSize {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Upload exceeds the maximum size"})
+		return
+	}
+
+	metadata, err := parseTusMetadata(c.GetHeader("Upload-Metadata"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid Upload-Metadata header"})
+		return
+	}
+
+	if key := auth.FromContext(c); key != nil && metadata["webhook"] == "" && key.WebhookURL != "" {
+		metadata["webhook"] = key.WebhookURL
+	}
+
+	upload := &tusUpload{
+		ID:        uuid.New().String(),
+		Length:    length,
+		Metadata:  metadata,
+		CreatedAt: time.Now(),
+		OwnerID:   auth.OwnerID(c),
+		TenantID:  auth.TenantID(c),
+		Reserved:  length,
+	}
+	if err := h.images.reserveUsage(upload.TenantID, upload.Reserved, 0); err != nil {
+		respondUploadError(c, err)
+		return
+	}
+	if err := h.saveState(c.Request.Context(), upload); err != nil {
+		h.images.releaseUsage(upload.TenantID, upload.Reserved, 0)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create upload"})
+		return
+	}
+	h.maybeSweep()
+
+	c.Header("Location", "/api/uploads/"+upload.ID)
+	c.Header("Upload-Expires", h.expires(upload))
+	c.Status(http.StatusCreated)
+}
+
+// Head reports how much of an upload the server has received
+func (h *TusHandler) Head(c *gin.Context) {
+	if !h.checkVersion(c) {
+		return
+	}
+
+	upload, ok := h.loadState(c)
+	if !ok {
+		return
+	}
+
+	c.Header("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	c.Header("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	c.Header("Cache-Control", "no-store")
+	if upload.ImageID != "" {
+		c.Header("Image-Id", upload.ImageID)
+	} else {
+		c.Header("Upload-Expires", h.expires(upload))
+	}
+	c.Status(http.StatusOK)
+}
+
+// Patch appends a chunk at Upload-Offset. The last chunk hands the assembled
+// file to the regular upload path and reports the image id in Image-Id
+func (h *TusHandler) Patch(c *gin.Context) {
+	if !h.checkVersion(c) {
+		return
+	}
+	if c.ContentType() != "application/offset+octet-stream" {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "Content-Type must be application/offset+octet-stream"})
+		return
+	}
+	offset, err := strconv.ParseInt(c.GetHeader("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid Upload-Offset header"})
+		return
+	}
+
+	unlock, ok := h.lockRequest(c)
+	if !ok {
+		return
+	}
+	defer unlock()
+
+	upload, ok := h.loadState(c)
+	if !ok {
+		return
+	}
+	if upload.ImageID != "" || offset != upload.Offset {
+		c.JSON(http.StatusConflict, gin.H{"error": "Upload-Offset does not match the current offset"})
+		return
+	}
+
+	ctx := c.Request.Context()
+
+	// The bytes received are kept even when the body breaks off, so the
+	// client resumes after them. A part failing to be stored is dropped and
+	// the client resumes from the last stored offset
+	remaining := upload.Length - upload.Offset
+	body := &partialReader{reader: io.LimitReader(c.Request.Body, remaining)}
+	counter := &countingReader{reader: body}
+	part := tusPartQuality(offset)
+	if _, err := h.storage.Save(ctx, upload.key(), part, counter); err != nil {
+		if derr := h.storage.Delete(ctx, upload.key(), part); derr != nil && !os.IsNotExist(derr) {
+			slog.ErrorContext(ctx, "failed to delete incomplete part of upload", "upload_id", upload.ID, "error", derr)
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store chunk"})
+		return
+	}
+
+	if counter.n > 0 {
+		upload.Parts = append(upload.Parts, offset)
+		upload.Offset += counter.n
+		if err := h.saveState(ctx, upload); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update upload"})
+			return
+		}
+	} else if err := h.storage.Delete(ctx, upload.key(), part); err != nil && !os.IsNotExist(err) {
+		slog.ErrorContext(ctx, "failed to delete empty part of upload", "upload_id", upload.ID, "error", err)
+	}
+
+	c.Header("Tus-Resumable", tusVersion)
+	c.Header("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	if body.err != nil {
+		slog.WarnContext(ctx, "chunk of upload broke off", "upload_id", upload.ID, "received", counter.n, "error", body.err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read chunk"})
+		return
+	}
+
+	if upload.Offset == upload.Length {
+		if !h.complete(c, upload) {
+			return
+		}
+		c.Header("Image-Id", upload.ImageID)
+	} else {
+		c.Header("Upload-Expires", h.expires(upload))
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// Terminate deletes an upload and its stored parts
+func (h *TusHandler) Terminate(c *gin.Context) {
+	if !h.checkVersion(c) {
+		return
+	}
+
+	unlock, ok := h.lockRequest(c)
+	if !ok {
+		return
+	}
+	defer unlock()
+
+	upload, ok := h.loadState(c)
+	if !ok {
+		return
+	}
+
+	ctx := c.Request.Context()
+	h.deleteParts(ctx, upload.key(), upload)
+	if err := h.storage.Delete(ctx, upload.key(), tusStateQuality); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete upload"})
+		return
+	}
+	h.images.releaseUsage(upload.TenantID, upload.Reserved, 0)
+
+	c.Header("Tus-Resumable", tusVersion)
+	c.Status(http.StatusNoContent)
+}
+
+// complete streams the parts, in order, into the regular upload path. The
+// state keeps the image id so a client retrying the last PATCH can still
+// learn it
+func (h *TusHandler) complete(c *gin.Context, upload *tusUpload) bool {
+	ctx := c.Request.Context()
+	readers := make([]io.Reader, 0, len(upload.Parts))
+	var closers []io.Closer
+	defer func() {
+		for _, closer := range closers {
+			if err := closer.Close(); err != nil {
+				slog.WarnContext(ctx, "failed to close part of upload", "upload_id", upload.ID, "error", err)
+			}
+		}
+	}()
+	for _, offset := range upload.Parts {
+		part, err := h.storage.Get(ctx, upload.key(), tusPartQuality(offset))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read upload"})
+			return false
+		}
+		readers = append(readers, part)
+		closers = append(closers, part)
+	}
+
+	opts := uploadOptions{
+		Filename:   upload.Metadata["filename"],
+		WebhookURL: upload.Metadata["webhook"],
+		OwnerID:    upload.OwnerID,
+		TenantID:   upload.TenantID,
+	}
+	opts.Dedupe, _ = strconv.ParseBool(upload.Metadata["dedupe"])
+
+	// The image reserves its own usage
+	if upload.Reserved > 0 {
+		reserved := upload.Reserved
+		upload.Reserved = 0
+		if err := h.saveState(ctx, upload); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update upload"})
+			return false
+		}
+		h.images.releaseUsage(upload.TenantID, reserved, 0)
+	}
+
+	result, err := h.images.ingestImage(ctx, io.MultiReader(readers...), opts)
+	if err != nil {
+		respondUploadError(c, err)
+		return false
+	}
+
+	upload.ImageID = result.ID
+	if err := h.saveState(ctx, upload); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update upload"})
+		return false
+	}
+	h.deleteParts(ctx, upload.key(), upload)
+	return true
+}
+
+// checkVersion rejects requests for other protocol versions
+func (h *TusHandler) checkVersion(c *gin.Context) bool {
+	c.Header("Tus-Resumable", tusVersion)
+	if c.GetHeader("Tus-Resumable") != tusVersion {
+		c.Header("Tus-Version", tusVersion)
+		c.JSON(http.StatusPreconditionFailed, gin.H{"error": "Unsupported tus version"})
+		return false
+	}
+	return true
+}
+
+// lockRequest serializes PATCH and DELETE requests and the expiry of one
+// upload. The lock is kept in the metadata store so that API instances
+// sharing the storage exclude each other too
+func (h *TusHandler) lockRequest(c *gin.Context) (func(), bool) {
+	id := c.Param("id")
+	if _, err := uuid.Parse(id); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Upload not found"})
+		return nil, false
+	}
+	unlock, err := h.images.metadata.LockUpload(id)
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "failed to lock upload", "upload_id", id, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to lock upload"})
+		return nil, false
+	}
+	return unlock, true
+}
+
+// expires returns the Upload-Expires header of an upload
+func (h *TusHandler) expires(upload *tusUpload) string {
+	return upload.UpdatedAt.Add(h.expiry).UTC().Format(http.TimeFormat)
+}
+
+// expired reports whether an upload received no chunk within the expiry.
+// Completed uploads expire too, their state only keeps the image id
+func (h *TusHandler) expired(upload *tusUpload) bool {
+	return time.Since(upload.UpdatedAt) > h.expiry
+}
+
+// maybeSweep deletes expired uploads in the background, at most once per
+// tusSweepInterval
+func (h *TusHandler) maybeSweep() {
+	h.mu.Lock()
+	now := time.Now()
+	due := now.Sub(h.lastSweep) > tusSweepInterval
+	if due {
+		h.lastSweep = now
+	}
+	h.mu.Unlock()
+
+	if due {
+		go h.sweep(context.Background())
+	}
+}
+
+// sweep deletes the expired uploads found in storage
+func (h *TusHandler) sweep(ctx context.Context) {
+	ids, err := h.storage.List(ctx)
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to list uploads", "error", err)
+		return
+	}
+	for _, key := range ids {
+		// Uploads are stored under their id, prefixed for tenants
+		if _, err := uuid.Parse(path.Base(key)); err == nil {
+			h.expire(ctx, key)
+		}
+	}
+}
+
+// expire deletes the upload stored under key and its parts if it expired,
+// including the part of a chunk whose offset could not be recorded
+func (h *TusHandler) expire(ctx context.Context, key string) {
+	id := path.Base(key)
+	unlock, err := h.images.metadata.LockUpload(id)
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to lock upload", "upload_id", id, "error", err)
+		return
+	}
+	defer unlock()
+
+	upload, err := h.readState(ctx, key)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			slog.WarnContext(ctx, "failed to read state of upload", "upload_id", id, "error", err)
+		}
+		return
+	}
+	if !h.expired(upload) {
+		return
+	}
+
+	if upload.ImageID == "" {
+		upload.Parts = append(upload.Parts, upload.Offset)
+	}
+	h.deleteParts(ctx, key, upload)
+	if err := h.storage.Delete(ctx, key, tusStateQuality); err != nil && !os.IsNotExist(err) {
+		slog.ErrorContext(ctx, "failed to delete expired upload", "upload_id", id, "error", err)
+		return
+	}
+	h.images.releaseUsage(upload.TenantID, upload.Reserved, 0)
+	slog.InfoContext(ctx, "deleted expired upload", "upload_id", id)
+}
+
+func (h *TusHandler) loadState(c *gin.Context) (*tusUpload, bool) {
+	id := c.Param("id")
+	if _, err := uuid.Parse(id); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Upload not found"})
+		return nil, false
+	}
+
+	// Uploads are looked up under the tenant of the client, those of other
+	// tenants are never found
+	upload, err := h.readState(c.Request.Context(), storage.Key(auth.TenantID(c), id))
+	if errors.Is(err, os.ErrNotExist) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Upload not found"})
+		return nil, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read upload"})
+		return nil, false
+	}
+	if !auth.CanAccess(c, upload.TenantID, upload.OwnerID) || h.expired(upload) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Upload not found"})
+		return nil, false
+	}
+	return upload, true
+}
+
+func (h *TusHandler) readState(ctx context.Context, key string) (*tusUpload, error) {
+	reader, err := h.storage.Get(ctx, key, tusStateQuality)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := reader.Close(); err != nil {
+			slog.WarnContext(ctx, "failed to close state of upload", "key", key, "error", err)
+		}
+	}()
+
+	var upload tusUpload
+	if err := json.NewDecoder(reader).Decode(&upload); err != nil {
+		return nil, fmt.Errorf("failed to decode upload state: %w", err)
+	}
+	// States saved before uploads expired have no update time
+	if upload.UpdatedAt.IsZero() {
+		upload.UpdatedAt = upload.CreatedAt
+	}
+	return &upload, nil
+}
+
+func (h *TusHandler) saveState(ctx context.Context, upload *tusUpload) error {
+	upload.UpdatedAt = time.Now()
+	data, err := json.Marshal(upload)
+	if err != nil {
+		return err
+	}
+	_, err = h.storage.Save(ctx, upload.key(), tusStateQuality, bytes.NewReader(data))
+	return err
+}
+
+// deleteParts deletes the parts of an upload stored under key
+func (h *TusHandler) deleteParts(ctx context.Context, key string, upload *tusUpload) {
+	for _, offset := range upload.Parts {
+		if err := h.storage.Delete(ctx, key, tusPartQuality(offset)); err != nil && !os.IsNotExist(err) {
+			slog.ErrorContext(ctx, "failed to delete part of upload", "upload_id", upload.ID, "error", err)
+		}
+	}
+	upload.Parts = nil
+}
+
+// tusPartQuality is the storage key of the part starting at offset
+func tusPartQuality(offset int64) models.ImageQuality {
+	return models.ImageQuality(fmt.Sprintf("%s%d", tusPartPrefix, offset))
+}
+
+// parseTusMetadata decodes "key base64value,key base64value"
+func parseTusMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	if strings.TrimSpace(header) == "" {
+		return metadata, nil
+	}
+
+	for _, pair := range strings.Split(header, ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, errors.New("empty metadata key")
+		}
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid metadata value for %s: %w", key, err)
+		}
+		metadata[key] = string(value)
+	}
+	return metadata, nil
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	reader io.Reader
+	n      int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// partialReader ends at the first read error, keeping it in err, so the
+// bytes read before it can still be stored
+type partialReader struct {
+	reader io.Reader
+	err    error
+}
+
+func (r *partialReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if err != nil && err != io.EOF {
+		r.err = err
+		err = io.EOF
+	}
+	return n, err
+}
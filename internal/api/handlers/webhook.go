@@ -0,0 +1,43 @@
+package handlers
+
+import (
+	"errors"
+	"img-resizer/internal/auth"
+	"img-resizer/internal/metadata"
+	"img-resizer/internal/models"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GetWebhookDeliveries handles requests for the webhook delivery log of an image
+func (h *ImageHandler) GetWebhookDeliveries(c *gin.Context) {
+	meta, err := h.metadata.Get(c.Param("id"))
+	if errors.Is(err, metadata.ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Image not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get image metadata"})
+		return
+	}
+	if !auth.CanAccess(c, meta.TenantID, meta.OwnerID) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Image not found"})
+		return
+	}
+
+	deliveries, err := h.metadata.ListDeliveries(meta.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get webhook deliveries"})
+		return
+	}
+	if deliveries == nil {
+		deliveries = []models.WebhookDelivery{}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"id":         meta.ID,
+		"webhookUrl": meta.WebhookURL,
+		"deliveries": deliveries,
+	})
+}
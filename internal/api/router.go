@@ -1,23 +1,123 @@
 package api
 
 import (
+	"context"
 	"img-resizer/internal/api/handlers"
+	"img-resizer/internal/auth"
+	"img-resizer/internal/config"
+	"img-resizer/internal/events"
+	"img-resizer/internal/health"
+	"img-resizer/internal/logging"
+	"img-resizer/internal/metadata"
+	"img-resizer/internal/metrics"
+	"img-resizer/internal/models"
 	"img-resizer/internal/queue"
+	"img-resizer/internal/ratelimit"
 	"img-resizer/internal/storage"
+	"img-resizer/internal/tracing"
+	"log/slog"
 
 	"github.com/gin-gonic/gin"
 )
 
-func SetupRouter(storage storage.Storage, queue *queue.RabbitMQ) *gin.Engine {
-	router := gin.Default()
+func SetupRouter(cfg *config.Config, storage storage.Storage, metadata metadata.Store, queue *queue.RabbitMQ, events *events.Hub, tokens *auth.TokenVerifier, limiter ratelimit.Limiter) *gin.Engine {
+	router := gin.New()
+	// Client addresses identify anonymous clients for rate limiting, so
+	// forwarding headers are only believed from known proxies
+	if err := router.SetTrustedProxies(cfg.Server.TrustedProxies); err != nil {
+		slog.Warn("Invalid trusted proxies, trusting none", "error", err)
+		_ = router.SetTrustedProxies(nil)
+	}
+
+	// Probes are routed before any middleware, so they are neither logged,
+	// traced nor measured
+	router.GET("/healthz", gin.WrapH(health.Live()))
+	router.GET("/readyz", gin.WrapH(readiness(cfg, storage, queue).Handler()))
+
+	// Every request gets an id and a span, exported only when tracing is
+	// enabled, which its log records carry
+	router.Use(logging.RequestID())
+	router.Use(tracing.Middleware())
+
+	if cfg.Metrics.Enabled {
+		router.Use(metrics.Middleware())
+		router.GET("/metrics", gin.WrapH(metrics.Handler()))
+	}
 
-	imageHandler := handlers.NewImageHandler(storage, queue)
+	// Recovery is innermost so panics are logged and measured as 500s
+	router.Use(logging.AccessLog(), logging.Recovery())
+
+	imageHandler := handlers.NewImageHandler(cfg, storage, metadata, queue, events)
+	tusHandler := handlers.NewTusHandler(storage, imageHandler, cfg.Upload.MaxSize, cfg.Upload.ResumableExpiry)
+
+	// Routes below need an API key with the given scope, unless
+	// authentication is disabled
+	require := func(models.Scope) gin.HandlerFunc {
+		return func(c *gin.Context) {}
+	}
+
+	// Routes queueing work are limited per client, unless rate limiting is
+	// disabled
+	rateLimit := func(c *gin.Context) {}
+	if limiter != nil {
+		rateLimit = ratelimit.Limit(limiter)
+	}
+	concurrencyLimit := func(c *gin.Context) {}
+	if cfg.RateLimit.Enabled && cfg.RateLimit.MaxConcurrentUploads > 0 {
+		concurrencyLimit = ratelimit.LimitConcurrency(cfg.RateLimit.MaxConcurrentUploads)
+	}
 
 	api := router.Group("/api")
+
+	// Image delivery stays public so variants can be embedded in pages
+	api.GET("/images/:id", imageHandler.GetImage)
+	api.HEAD("/images/:id", imageHandler.GetImage)
+	api.OPTIONS("/uploads", tusHandler.Options)
+
+	protected := api.Group("")
+	if cfg.Auth.Enabled {
+		protected.Use(auth.Authenticate(metadata, tokens))
+		require = auth.RequireScope
+	}
 	{
-		api.POST("/images", imageHandler.UploadImage)
-		api.GET("/images/:id", imageHandler.GetImage)
+		protected.POST("/images", require(models.ScopeUpload), rateLimit, concurrencyLimit, imageHandler.UploadImage)
+		protected.POST("/images/batch", require(models.ScopeUpload), rateLimit, concurrencyLimit, imageHandler.UploadBatch)
+		protected.POST("/images/import", require(models.ScopeUpload), rateLimit, imageHandler.ImportImage)
+		protected.DELETE("/images/:id", require(models.ScopeDelete), imageHandler.DeleteImage)
+		protected.GET("/images/:id/metadata", require(models.ScopeRead), imageHandler.GetMetadata)
+		protected.GET("/images/:id/status", require(models.ScopeRead), imageHandler.GetStatus)
+		protected.GET("/images/:id/responsive", require(models.ScopeRead), imageHandler.GetResponsive)
+		protected.GET("/images/:id/similar", require(models.ScopeRead), imageHandler.GetSimilar)
+		protected.GET("/images/:id/webhooks", require(models.ScopeRead), imageHandler.GetWebhookDeliveries)
+		protected.GET("/images/:id/events", require(models.ScopeRead), imageHandler.GetEvents)
+		protected.GET("/batches/:id", require(models.ScopeRead), imageHandler.GetBatch)
+		protected.GET("/tenants/:id/usage", require(models.ScopeRead), imageHandler.GetTenantUsage)
+
+		// Resumable uploads (tus 1.0)
+		// A tus upload counts once towards the rate, its chunks only towards
+		// the concurrency limit
+		protected.POST("/uploads", require(models.ScopeUpload), rateLimit, tusHandler.Create)
+		protected.HEAD("/uploads/:id", require(models.ScopeUpload), tusHandler.Head)
+		protected.PATCH("/uploads/:id", require(models.ScopeUpload), concurrencyLimit, tusHandler.Patch)
+		protected.DELETE("/uploads/:id", require(models.ScopeUpload), tusHandler.Terminate)
 	}
 
 	return router
 }
+
+// readiness checks the dependencies without which the API cannot accept
+// uploads: a writable storage and an open connection to RabbitMQ. Whether
+// progress events reach the event streams is reported without failing it
+func readiness(cfg *config.Config, store storage.Storage, rabbitMQ *queue.RabbitMQ) *health.Checker {
+	checker := health.NewChecker(cfg.Health.Timeout)
+	checker.Add("storage", func(ctx context.Context) error {
+		return storage.Probe(ctx, store)
+	})
+	checker.Add("queue", func(context.Context) error {
+		return rabbitMQ.Check()
+	})
+	checker.Detail("events_subscribed", func() any {
+		return rabbitMQ.EventsSubscribed()
+	})
+	return checker
+}
@@ -0,0 +1,111 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"img-resizer/internal/models"
+	"strings"
+	"time"
+)
+
+// keyPrefix marks API keys so they are recognisable in configs and leaks
+const keyPrefix = "irk"
+
+// webhookSecretPrefix marks webhook signing secrets
+const webhookSecretPrefix = "whsec"
+
+// ErrInvalidKey is returned for malformed, unknown and revoked keys alike
+var ErrInvalidKey = errors.New("invalid api key")
+
+// GenerateKey creates an API key. The returned secret is shown once, only
+// its hash is kept in the returned key
+func GenerateKey(name string, scopes []models.Scope) (string, *models.APIKey, error) {
+	id, err := randomHex(8)
+	if err != nil {
+		return "", nil, err
+	}
+	secret, err := randomHex(32)
+	if err != nil {
+		return "", nil, err
+	}
+
+	token := fmt.Sprintf("%s_%s_%s", keyPrefix, id, secret)
+	return token, &models.APIKey{
+		ID:        id,
+		Name:      name,
+		Hash:      hashToken(token),
+		Scopes:    scopes,
+		CreatedAt: time.Now(),
+	}, nil
+}
+
+// GenerateWebhookSecret creates a secret signing the webhooks of an API key
+// or tenant
+func GenerateWebhookSecret() (string, error) {
+	secret, err := randomHex(32)
+	if err != nil {
+		return "", err
+	}
+	return webhookSecretPrefix + "_" + secret, nil
+}
+
+// ParseScopes parses a comma separated list of scopes
+func ParseScopes(value string) ([]models.Scope, error) {
+	var scopes []models.Scope
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		scope := models.Scope(name)
+		valid := false
+		for _, known := range models.Scopes {
+			valid = valid || scope == known
+		}
+		if !valid {
+			return nil, fmt.Errorf("unknown scope: %q", name)
+		}
+		scopes = append(scopes, scope)
+	}
+	if len(scopes) == 0 {
+		return nil, errors.New("at least one scope is required")
+	}
+	return scopes, nil
+}
+
+// KeyID returns the id part of a key, used to look up the stored hash
+func KeyID(token string) (string, error) {
+	parts := strings.Split(token, "_")
+	if len(parts) != 3 || parts[0] != keyPrefix || parts[1] == "" || parts[2] == "" {
+		return "", ErrInvalidKey
+	}
+	return parts[1], nil
+}
+
+// Verify checks a presented key against the stored one
+func Verify(key *models.APIKey, token string) error {
+	if key.RevokedAt != nil {
+		return ErrInvalidKey
+	}
+	if subtle.ConstantTimeCompare([]byte(hashToken(token)), []byte(key.Hash)) != 1 {
+		return ErrInvalidKey
+	}
+	return nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate key: %w", err)
+	}
+	return hex.EncodeToString(buf), nil
+}
@@ -0,0 +1,252 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxJWKSSize bounds the key set document
+	maxJWKSSize = 1 << 20
+	// minJWKSRefresh is how long a key set URL is left alone after a fetch,
+	// so tokens with made up key ids cannot hammer the identity provider
+	minJWKSRefresh = time.Minute
+)
+
+// ErrUnknownKey is returned for tokens signed by a key not in the key set
+var ErrUnknownKey = errors.New("unknown signing key")
+
+// jwk is the subset of RFC 7517 needed for signature verification
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// KeySet holds the public keys of a JSON Web Key Set read from a file or an
+// http(s) URL. URLs are fetched again every refresh interval and when a
+// token names a key that is not known yet, which picks up key rotation
+type KeySet struct {
+	source  string
+	refresh time.Duration
+	client  *http.Client
+
+	mu      sync.RWMutex
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+}
+
+// NewKeySet loads the key set at source, a file path or an http(s) URL
+func NewKeySet(source string, refresh time.Duration) (*KeySet, error) {
+	ks := &KeySet{
+		source:  source,
+		refresh: refresh,
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}
+	if err := ks.load(context.Background()); err != nil {
+		return nil, err
+	}
+	return ks, nil
+}
+
+// Key returns the key with the given id. An empty id matches the only key
+// of a single key set
+func (ks *KeySet) Key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	key, found, age := ks.lookup(kid)
+	stale := (found && age >= ks.refresh) || (!found && age >= minJWKSRefresh)
+	if ks.remote() && stale {
+		if err := ks.load(ctx); err != nil {
+			// Keep verifying with the previous keys while the provider is down
+			slog.WarnContext(ctx, "failed to refresh JWKS", "source", ks.source, "error", err)
+		}
+		key, found, _ = ks.lookup(kid)
+	}
+	if !found {
+		return nil, ErrUnknownKey
+	}
+	return key, nil
+}
+
+func (ks *KeySet) lookup(kid string) (crypto.PublicKey, bool, time.Duration) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	age := time.Since(ks.fetched)
+	if kid == "" && len(ks.keys) == 1 {
+		for _, key := range ks.keys {
+			return key, true, age
+		}
+	}
+	key, ok := ks.keys[kid]
+	return key, ok, age
+}
+
+func (ks *KeySet) remote() bool {
+	return strings.HasPrefix(ks.source, "http://") || strings.HasPrefix(ks.source, "https://")
+}
+
+func (ks *KeySet) load(ctx context.Context) error {
+	var (
+		data []byte
+		err  error
+	)
+	if ks.remote() {
+		data, err = ks.fetch(ctx)
+	} else {
+		data, err = os.ReadFile(ks.source)
+	}
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	ks.fetched = time.Now()
+	if err != nil {
+		return fmt.Errorf("failed to read JWKS %s: %w", ks.source, err)
+	}
+
+	keys, err := ParseJWKS(data)
+	if err != nil {
+		return err
+	}
+	ks.keys = keys
+	return nil
+}
+
+func (ks *KeySet) fetch(ctx context.Context) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ks.source, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := ks.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxJWKSSize))
+}
+
+// ParseJWKS returns the signature keys of a JSON Web Key Set by key id.
+// Encryption keys and unsupported key types are skipped
+func ParseJWKS(data []byte) (map[string]crypto.PublicKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("failed to parse JWKS: %w", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse JWK %q: %w", k.Kid, err)
+		}
+		if key != nil {
+			keys[k.Kid] = key
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("JWKS has no signature keys")
+	}
+	return keys, nil
+}
+
+// publicKey decodes the key, nil for key types that are not supported
+func (k *jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if n.BitLen() < 2048 || !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+			return nil, errors.New("unsupported RSA key size or exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		return k.ecdsaKey()
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, nil
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, nil
+	}
+}
+
+func (k *jwk) ecdsaKey() (crypto.PublicKey, error) {
+	var (
+		curve elliptic.Curve
+		check ecdh.Curve
+	)
+	switch k.Crv {
+	case "P-256":
+		curve, check = elliptic.P256(), ecdh.P256()
+	case "P-384":
+		curve, check = elliptic.P384(), ecdh.P384()
+	case "P-521":
+		curve, check = elliptic.P521(), ecdh.P521()
+	default:
+		return nil, nil
+	}
+
+	size := (curve.Params().BitSize + 7) / 8
+	x, errX := base64.RawURLEncoding.DecodeString(k.X)
+	y, errY := base64.RawURLEncoding.DecodeString(k.Y)
+	if errX != nil || errY != nil || len(x) != size || len(y) != size {
+		return nil, errors.New("invalid EC coordinates")
+	}
+	// ecdh rejects points that are not on the curve
+	point := append(append([]byte{4}, x...), y...)
+	if _, err := check.NewPublicKey(point); err != nil {
+		return nil, fmt.Errorf("invalid EC point: %w", err)
+	}
+	return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+}
+
+func decodeBigInt(value string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || len(data) == 0 {
+		return nil, errors.New("invalid base64url integer")
+	}
+	return new(big.Int).SetBytes(data), nil
+}
@@ -0,0 +1,113 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"img-resizer/internal/config"
+	"img-resizer/internal/models"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// ErrInvalidToken is returned for bearer tokens that fail verification
+var ErrInvalidToken = errors.New("invalid bearer token")
+
+// signingMethods are the asymmetric algorithms accepted from the identity
+// provider. HMAC is excluded so a public key can never act as a secret
+var signingMethods = []string{
+	"RS256", "RS384", "RS512",
+	"PS256", "PS384", "PS512",
+	"ES256", "ES384", "ES512",
+	"EdDSA",
+}
+
+// TokenVerifier validates JWTs against a key set and maps their claims to
+// a tenant and scopes
+type TokenVerifier struct {
+	cfg    config.JWTConfig
+	keys   *KeySet
+	parser *jwt.Parser
+}
+
+func NewTokenVerifier(cfg config.JWTConfig, keys *KeySet) *TokenVerifier {
+	options := []jwt.ParserOption{
+		jwt.WithValidMethods(signingMethods),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(cfg.Leeway),
+	}
+	if cfg.Issuer != "" {
+		options = append(options, jwt.WithIssuer(cfg.Issuer))
+	}
+	if cfg.Audience != "" {
+		options = append(options, jwt.WithAudience(cfg.Audience))
+	}
+
+	return &TokenVerifier{
+		cfg:    cfg,
+		keys:   keys,
+		parser: jwt.NewParser(options...),
+	}
+}
+
+// Verify checks a token and returns its principal, described like an API key
+// of the tenant named by the tenant claim. The subject becomes the ID
+func (v *TokenVerifier) Verify(ctx context.Context, token string) (*models.APIKey, error) {
+	claims := jwt.MapClaims{}
+	_, err := v.parser.ParseWithClaims(token, claims, func(t *jwt.Token) (any, error) {
+		kid, _ := t.Header["kid"].(string)
+		return v.keys.Key(ctx, kid)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidToken, err)
+	}
+
+	tenant, _ := claims[v.cfg.TenantClaim].(string)
+	if !models.ValidTenantID(tenant) {
+		return nil, fmt.Errorf("%w: missing or invalid %q claim", ErrInvalidToken, v.cfg.TenantClaim)
+	}
+	subject, _ := claims.GetSubject()
+
+	return &models.APIKey{
+		ID:       subject,
+		Name:     subject,
+		Scopes:   v.scopes(claims[v.cfg.ScopeClaim]),
+		TenantID: tenant,
+	}, nil
+}
+
+// scopes reads a space separated string, as in OAuth 2.0, or an array of
+// strings. Names outside the configured prefix and unknown scopes are ignored
+func (v *TokenVerifier) scopes(claim any) []models.Scope {
+	var names []string
+	switch value := claim.(type) {
+	case string:
+		names = strings.Fields(value)
+	case []any:
+		for _, item := range value {
+			if name, ok := item.(string); ok {
+				names = append(names, name)
+			}
+		}
+	}
+
+	var scopes []models.Scope
+	for _, name := range names {
+		name, ok := strings.CutPrefix(name, v.cfg.ScopePrefix)
+		if !ok {
+			continue
+		}
+		for _, known := range models.Scopes {
+			if models.Scope(name) == known {
+				scopes = append(scopes, known)
+			}
+		}
+	}
+	return scopes
+}
+
+// looksLikeJWT tells tokens apart from API keys, which never contain dots
+func looksLikeJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
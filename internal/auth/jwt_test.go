@@ -0,0 +1,240 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"img-resizer/internal/config"
+	"img-resizer/internal/models"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// testProvider serves a JWKS like an identity provider. Keys can be added
+// to it to simulate a rotation
+type testProvider struct {
+	server  *httptest.Server
+	fetches atomic.Int32
+
+	mu   sync.Mutex
+	keys map[string]*rsa.PrivateKey
+}
+
+func newTestProvider(t *testing.T) *testProvider {
+	t.Helper()
+	p := &testProvider{keys: make(map[string]*rsa.PrivateKey)}
+	p.server = httptest.NewServer(http.HandlerFunc(p.serveJWKS))
+	t.Cleanup(p.server.Close)
+	return p
+}
+
+// addKey generates a key named kid and publishes it
+func (p *testProvider) addKey(t *testing.T, kid string) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.mu.Lock()
+	p.keys[kid] = key
+	p.mu.Unlock()
+	return key
+}
+
+func (p *testProvider) serveJWKS(w http.ResponseWriter, _ *http.Request) {
+	p.fetches.Add(1)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	for kid, key := range p.keys {
+		set.Keys = append(set.Keys, jwk{
+			Kty: "RSA",
+			Kid: kid,
+			Use: "sig",
+			N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(set)
+}
+
+// newTestVerifier verifies tokens against the key set of p
+func newTestVerifier(t *testing.T, p *testProvider) (*TokenVerifier, *KeySet) {
+	t.Helper()
+	keys, err := NewKeySet(p.server.URL, time.Hour)
+	if err != nil {
+		t.Fatalf("NewKeySet: %v", err)
+	}
+	cfg := config.JWTConfig{
+		JWKS:        p.server.URL,
+		Issuer:      "https://idp.example",
+		Audience:    "img-resizer",
+		TenantClaim: "tenant",
+		ScopeClaim:  "scope",
+		ScopePrefix: "images:",
+	}
+	return NewTokenVerifier(cfg, keys), keys
+}
+
+// validClaims returns claims the test verifier accepts
+func validClaims() jwt.MapClaims {
+	return jwt.MapClaims{
+		"iss":    "https://idp.example",
+		"aud":    "img-resizer",
+		"sub":    "user-1",
+		"exp":    time.Now().Add(time.Hour).Unix(),
+		"tenant": "acme",
+		"scope":  "images:read images:upload openid",
+	}
+}
+
+func sign(t *testing.T, method jwt.SigningMethod, kid string, claims jwt.MapClaims, key any) string {
+	t.Helper()
+	token := jwt.NewWithClaims(method, claims)
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatalf("failed to sign token: %v", err)
+	}
+	return signed
+}
+
+func TestVerifyValidToken(t *testing.T) {
+	provider := newTestProvider(t)
+	key := provider.addKey(t, "k1")
+	verifier, _ := newTestVerifier(t, provider)
+
+	principal, err := verifier.Verify(context.Background(), sign(t, jwt.SigningMethodRS256, "k1", validClaims(), key))
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if principal.ID != "user-1" || principal.TenantID != "acme" {
+		t.Errorf("principal is %q of tenant %q, want user-1 of acme", principal.ID, principal.TenantID)
+	}
+	if want := []models.Scope{models.ScopeRead, models.ScopeUpload}; !slices.Equal(principal.Scopes, want) {
+		t.Errorf("scopes are %v, want %v", principal.Scopes, want)
+	}
+}
+
+func TestVerifyMapsScopesAndTenant(t *testing.T) {
+	provider := newTestProvider(t)
+	key := provider.addKey(t, "k1")
+	verifier, _ := newTestVerifier(t, provider)
+
+	tests := []struct {
+		name   string
+		claims jwt.MapClaims
+		scopes []models.Scope
+		err    bool
+	}{
+		{name: "scope array", claims: jwt.MapClaims{"scope": []any{"images:read", "images:delete"}}, scopes: []models.Scope{models.ScopeRead, models.ScopeDelete}},
+		{name: "unprefixed and unknown scopes", claims: jwt.MapClaims{"scope": "read images:admin images:nothing"}, scopes: []models.Scope{models.ScopeAdmin}},
+		{name: "no scope", claims: jwt.MapClaims{"scope": nil}},
+		{name: "missing tenant", claims: jwt.MapClaims{"tenant": nil}, err: true},
+		{name: "invalid tenant", claims: jwt.MapClaims{"tenant": "../other"}, err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := validClaims()
+			for name, value := range tt.claims {
+				if value == nil {
+					delete(claims, name)
+				} else {
+					claims[name] = value
+				}
+			}
+
+			principal, err := verifier.Verify(context.Background(), sign(t, jwt.SigningMethodRS256, "k1", claims, key))
+			if tt.err {
+				if !errors.Is(err, ErrInvalidToken) {
+					t.Fatalf("got %v, want ErrInvalidToken", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Verify: %v", err)
+			}
+			if !slices.Equal(principal.Scopes, tt.scopes) {
+				t.Errorf("scopes are %v, want %v", principal.Scopes, tt.scopes)
+			}
+		})
+	}
+}
+
+func TestVerifyRejectsExpiredToken(t *testing.T) {
+	provider := newTestProvider(t)
+	key := provider.addKey(t, "k1")
+	verifier, _ := newTestVerifier(t, provider)
+
+	claims := validClaims()
+	claims["exp"] = time.Now().Add(-time.Minute).Unix()
+	_, err := verifier.Verify(context.Background(), sign(t, jwt.SigningMethodRS256, "k1", claims, key))
+	if !errors.Is(err, ErrInvalidToken) || !errors.Is(err, jwt.ErrTokenExpired) {
+		t.Errorf("got %v, want an expired token error", err)
+	}
+}
+
+func TestVerifyRefreshesKeysForUnknownKid(t *testing.T) {
+	provider := newTestProvider(t)
+	provider.addKey(t, "k1")
+	verifier, keys := newTestVerifier(t, provider)
+
+	// The provider rotates to a key the verifier has not fetched yet
+	rotated := provider.addKey(t, "k2")
+	token := sign(t, jwt.SigningMethodRS256, "k2", validClaims(), rotated)
+
+	// Right after a fetch unknown key ids do not reach the provider
+	if _, err := verifier.Verify(context.Background(), token); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("got %v, want ErrUnknownKey before the key set may be refreshed", err)
+	}
+	if fetches := provider.fetches.Load(); fetches != 1 {
+		t.Fatalf("key set fetched %d times, want 1", fetches)
+	}
+
+	keys.mu.Lock()
+	keys.fetched = time.Now().Add(-minJWKSRefresh)
+	keys.mu.Unlock()
+
+	if _, err := verifier.Verify(context.Background(), token); err != nil {
+		t.Fatalf("Verify after the rotation: %v", err)
+	}
+	if fetches := provider.fetches.Load(); fetches != 2 {
+		t.Errorf("key set fetched %d times, want 2", fetches)
+	}
+}
+
+func TestVerifyRejectsHMACSignedWithPublicKey(t *testing.T) {
+	provider := newTestProvider(t)
+	key := provider.addKey(t, "k1")
+	verifier, _ := newTestVerifier(t, provider)
+
+	// An attacker knowing the public key signs with it as an HMAC secret
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	for _, secret := range [][]byte{secret, der} {
+		token := sign(t, jwt.SigningMethodHS256, "k1", validClaims(), secret)
+		if _, err := verifier.Verify(context.Background(), token); !errors.Is(err, jwt.ErrTokenSignatureInvalid) {
+			t.Errorf("got %v, want the HS256 token refused", err)
+		}
+	}
+}
@@ -0,0 +1,291 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// FileEnv names the configuration file when no -config flag is given
+const FileEnv = "CONFIG_FILE"
+
+// Load builds the configuration from, in increasing precedence, the
+// defaults, the YAML or TOML file named by -config or CONFIG_FILE, the
+// environment and the flags in args, then validates it. Every problem found
+// is reported in the returned error
+func Load(args []string) (*Config, error) {
+	cfg := Default()
+	l := newLoader(cfg)
+
+	path, err := l.parseFlags(args)
+	if err != nil {
+		return nil, err
+	}
+	if path == "" {
+		path = os.Getenv(FileEnv)
+	}
+	if path != "" {
+		if err := l.loadFile(path); err != nil {
+			return nil, err
+		}
+	}
+	l.loadEnv()
+	l.applyFlags()
+
+	// Settings that failed to parse keep their previous value, so the rest
+	// is still worth validating
+	cfg.markWatermarked()
+	found := append(l.problems, cfg.validate()...)
+	if err := found.err(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// FromCommandLine loads the configuration of a binary from its arguments
+// and the environment, exiting when it is invalid. Run as
+// `NAME config print [flags]` the binary prints the configuration and exits
+func FromCommandLine() *Config {
+	args := os.Args[1:]
+	printConfig := len(args) >= 2 && args[0] == "config" && args[1] == "print"
+	if printConfig {
+		args = args[2:]
+	}
+
+	cfg, err := Load(args)
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if printConfig {
+		if err := cfg.Print(os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	return cfg
+}
+
+// loader applies the layers to a configuration and collects the problems
+// found on the way
+type loader struct {
+	cfg      *Config
+	settings []setting
+	byKey    map[string]setting
+	flags    []pendingFlag
+	problems problems
+}
+
+// pendingFlag is a flag parsed before the file and the environment were
+// read and applied after them
+type pendingFlag struct {
+	setting setting
+	value   string
+}
+
+func newLoader(cfg *Config) *loader {
+	cfg.sources = make(map[string]string)
+	l := &loader{
+		cfg:      cfg,
+		settings: settingsOf(reflect.ValueOf(cfg).Elem(), "", ""),
+		byKey:    make(map[string]setting),
+	}
+	for _, s := range l.settings {
+		l.byKey[s.key] = s
+	}
+	return l
+}
+
+// set applies a value to a setting and records where it came from
+func (l *loader) set(s setting, raw any, source string) {
+	if err := s.set(raw); err != nil {
+		l.problems.add(s.key, source, "%v", err)
+		return
+	}
+	l.cfg.sources[s.baseKey()] = source
+}
+
+// parseFlags registers a flag for every setting and returns the -config
+// path. The flag values are applied by applyFlags
+func (l *loader) parseFlags(args []string) (string, error) {
+	set := flag.NewFlagSet(filepath.Base(os.Args[0]), flag.ContinueOnError)
+	path := set.String("config", "", "YAML or TOML file with settings, also "+FileEnv)
+	for _, s := range l.settings {
+		if !s.scalar() {
+			continue
+		}
+		usage := "sets " + s.key
+		if s.fromFile {
+			usage = "reads " + s.baseKey() + " from a file"
+		}
+		if s.env != "" {
+			usage += ", also " + s.env
+		}
+		set.Var(&flagValue{l, s}, s.key, usage)
+	}
+
+	if err := set.Parse(args); err != nil {
+		return "", err
+	}
+	if set.NArg() > 0 {
+		return "", fmt.Errorf("unexpected argument %q", set.Arg(0))
+	}
+	return *path, nil
+}
+
+func (l *loader) applyFlags() {
+	for _, pending := range l.flags {
+		l.set(pending.setting, pending.value, "flag -"+pending.setting.key)
+	}
+}
+
+// flagValue defers a flag until applyFlags
+type flagValue struct {
+	l *loader
+	s setting
+}
+
+func (f *flagValue) String() string {
+	return ""
+}
+
+func (f *flagValue) Set(value string) error {
+	f.l.flags = append(f.l.flags, pendingFlag{f.s, value})
+	return nil
+}
+
+func (f *flagValue) IsBoolFlag() bool {
+	return f.s.value.Kind() == reflect.Bool
+}
+
+// loadFile applies a YAML or TOML file, chosen by its extension
+func (l *loader) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	tree := make(map[string]any)
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &tree)
+	case ".toml":
+		err = toml.Unmarshal(data, &tree)
+	default:
+		return fmt.Errorf("unsupported config file %s, want .yaml, .yml or .toml", path)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+
+	l.applyTree(tree, "", "file "+path)
+	return nil
+}
+
+// applyTree applies the settings of a decoded file section by section
+func (l *loader) applyTree(tree map[string]any, prefix, source string) {
+	names := make([]string, 0, len(tree))
+	for name := range tree {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		key := name
+		if prefix != "" {
+			key = prefix + "." + name
+		}
+		raw := tree[name]
+
+		if s, ok := l.byKey[key]; ok {
+			l.set(s, raw, source)
+			continue
+		}
+		if l.isSection(key) {
+			section, ok := raw.(map[string]any)
+			if !ok {
+				l.problems.add(key, source, "expected a section of settings, got %v", raw)
+				continue
+			}
+			l.applyTree(section, key, source)
+			continue
+		}
+		l.problems.add(key, source, "unknown setting%s", suggest(key, l.keys()))
+	}
+}
+
+func (l *loader) isSection(key string) bool {
+	for _, s := range l.settings {
+		if strings.HasPrefix(s.key, key+".") {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *loader) keys() []string {
+	keys := make([]string, 0, len(l.settings))
+	for _, s := range l.settings {
+		keys = append(keys, s.key)
+	}
+	return keys
+}
+
+// loadEnv applies the environment. An empty variable sets an empty string
+// and leaves other settings alone, as unset variables do. Presets are set
+// with PRESET_<NAME>_<FIELD>, e.g. PRESET_75_WIDTH
+func (l *loader) loadEnv() {
+	for _, s := range l.settings {
+		l.setFromEnv(s)
+	}
+	for i := range l.cfg.Presets {
+		preset := reflect.ValueOf(&l.cfg.Presets[i]).Elem()
+		prefix := fmt.Sprintf("presets[%d]", i)
+		for _, s := range settingsOf(preset, prefix, presetEnvPrefix(l.cfg.Presets[i].Name)) {
+			l.setFromEnv(s)
+		}
+	}
+}
+
+func (l *loader) setFromEnv(s setting) {
+	if s.env == "" {
+		return
+	}
+	value, ok := os.LookupEnv(s.env)
+	if !ok || (value == "" && (s.fromFile || s.value.Kind() != reflect.String)) {
+		return
+	}
+	l.set(s, value, "env "+s.env)
+}
+
+var envUnsafe = regexp.MustCompile(`[^A-Z0-9]+`)
+
+// presetEnvPrefix returns the prefix of the variables of a preset, its name
+// upper-cased with other characters than letters and digits replaced by _
+func presetEnvPrefix(name string) string {
+	return "PRESET_" + envUnsafe.ReplaceAllString(strings.ToUpper(name), "_") + "_"
+}
+
+// markWatermarked marks the presets listed in watermark.presets
+func (c *Config) markWatermarked() {
+	for i := range c.Presets {
+		for _, name := range c.Watermark.Presets {
+			if c.Presets[i].Name == name {
+				c.Presets[i].Watermark = true
+			}
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package config
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"reflect"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// redacted replaces secrets when the configuration is printed
+const redacted = "REDACTED"
+
+// Print writes the configuration as YAML, which Load accepts as a file.
+// Secrets are redacted and settings not left at their default are
+// commented with where they were set
+func (c *Config) Print(w io.Writer) error {
+	root, err := c.node(reflect.ValueOf(c).Elem(), "")
+	if err != nil {
+		return fmt.Errorf("failed to print configuration: %w", err)
+	}
+
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(root); err != nil {
+		return fmt.Errorf("failed to print configuration: %w", err)
+	}
+	return encoder.Close()
+}
+
+// node renders the config-tagged fields of a struct as a YAML mapping
+func (c *Config) node(v reflect.Value, prefix string) (*yaml.Node, error) {
+	mapping := &yaml.Node{Kind: yaml.MappingNode}
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, ok := field.Tag.Lookup("config")
+		if !ok {
+			continue
+		}
+		key := name
+		if prefix != "" {
+			key = prefix + "." + name
+		}
+
+		value, err := c.valueNode(v.Field(i), field, key)
+		if err != nil {
+			return nil, err
+		}
+		keyNode := &yaml.Node{Kind: yaml.ScalarNode, Value: name}
+		if source, ok := c.sources[key]; ok {
+			// Presets span lines, their comment goes on the key
+			if value.Kind == yaml.SequenceNode && value.Style != yaml.FlowStyle {
+				keyNode.LineComment = source
+			} else {
+				value.LineComment = source
+			}
+		}
+		mapping.Content = append(mapping.Content, keyNode, value)
+	}
+	return mapping, nil
+}
+
+func (c *Config) valueNode(v reflect.Value, field reflect.StructField, key string) (*yaml.Node, error) {
+	switch {
+	case v.Type() == durationType:
+		return &yaml.Node{Kind: yaml.ScalarNode, Value: time.Duration(v.Int()).String()}, nil
+	case v.Kind() == reflect.Struct:
+		return c.node(v, key)
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Struct:
+		sequence := &yaml.Node{Kind: yaml.SequenceNode}
+		for i := 0; i < v.Len(); i++ {
+			item, err := c.node(v.Index(i), fmt.Sprintf("%s[%d]", key, i))
+			if err != nil {
+				return nil, err
+			}
+			sequence.Content = append(sequence.Content, item)
+		}
+		return sequence, nil
+	case field.Tag.Get("secret") == "true":
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: redact(v.String())}, nil
+	}
+
+	value := &yaml.Node{}
+	if err := value.Encode(v.Interface()); err != nil {
+		return nil, err
+	}
+	if value.Kind == yaml.SequenceNode {
+		value.Style = yaml.FlowStyle
+	}
+	return value, nil
+}
+
+// redact hides a secret. Only the password of a URL is hidden, so the
+// host it points to stays visible
+func redact(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	if u, err := url.Parse(secret); err == nil && u.Scheme != "" && u.Host != "" {
+		return u.Redacted()
+	}
+	return redacted
+}
@@ -0,0 +1,354 @@
+package config
+
+import (
+	"fmt"
+	"img-resizer/internal/models"
+	"math"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// setting is a field of a configuration that can be set from a file, the
+// environment or a flag
+type setting struct {
+	key   string // dotted path in files, also the flag name
+	env   string
+	field reflect.StructField
+	value reflect.Value // settable
+
+	// fromFile settings are the <key>_file companions of secrets, their
+	// value is the path of a file holding the secret
+	fromFile bool
+}
+
+// settingsOf lists the settings of the config-tagged fields of v, sections
+// included. Env tags are prefixed with envPrefix
+func settingsOf(v reflect.Value, prefix, envPrefix string) []setting {
+	var settings []setting
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, ok := field.Tag.Lookup("config")
+		if !ok {
+			continue
+		}
+		key := name
+		if prefix != "" {
+			key = prefix + "." + name
+		}
+
+		if field.Type.Kind() == reflect.Struct && field.Type != durationType {
+			settings = append(settings, settingsOf(v.Field(i), key, envPrefix)...)
+			continue
+		}
+
+		s := setting{key: key, field: field, value: v.Field(i)}
+		if env := field.Tag.Get("env"); env != "" {
+			s.env = envPrefix + env
+		}
+		settings = append(settings, s)
+
+		if s.secret() {
+			companion := s
+			companion.key += "_file"
+			if companion.env != "" {
+				companion.env += "_FILE"
+			}
+			companion.fromFile = true
+			settings = append(settings, companion)
+		}
+	}
+	return settings
+}
+
+// baseKey is the key of the setting a _file companion sets
+func (s setting) baseKey() string {
+	if s.fromFile {
+		return strings.TrimSuffix(s.key, "_file")
+	}
+	return s.key
+}
+
+func (s setting) secret() bool {
+	return s.field.Tag.Get("secret") == "true"
+}
+
+// scalar reports whether the setting can be given as a single string, as
+// flags are. Presets can only be listed in a file
+func (s setting) scalar() bool {
+	return s.value.Kind() != reflect.Slice || s.value.Type().Elem().Kind() == reflect.String
+}
+
+// set assigns raw, a string from the environment or a flag or a value
+// decoded from a file
+func (s setting) set(raw any) error {
+	if s.fromFile {
+		path, ok := raw.(string)
+		if !ok || path == "" {
+			return fmt.Errorf("expected the path of a file, got %v", raw)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read secret: %w", err)
+		}
+		raw = strings.TrimRight(string(data), "\r\n")
+	}
+	return setValue(s.value, raw)
+}
+
+func setValue(v reflect.Value, raw any) error {
+	switch {
+	case v.Type() == durationType:
+		d, err := parseDuration(raw)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+	case v.Kind() == reflect.String:
+		switch r := raw.(type) {
+		case string:
+			v.SetString(r)
+		case int, int64, uint64, float64, bool:
+			v.SetString(fmt.Sprint(r))
+		default:
+			return fmt.Errorf("expected a string, got %v", raw)
+		}
+	case v.Kind() == reflect.Bool:
+		switch r := raw.(type) {
+		case bool:
+			v.SetBool(r)
+		case string:
+			b, err := strconv.ParseBool(r)
+			if err != nil {
+				return fmt.Errorf("invalid boolean %q, want true or false", r)
+			}
+			v.SetBool(b)
+		default:
+			return fmt.Errorf("expected true or false, got %v", raw)
+		}
+	case v.Kind() == reflect.Int || v.Kind() == reflect.Int64:
+		n, err := parseInt(raw)
+		if err != nil {
+			return err
+		}
+		if v.OverflowInt(n) {
+			return fmt.Errorf("%d is out of range", n)
+		}
+		v.SetInt(n)
+	case v.Kind() == reflect.Float64:
+		f, err := parseFloat(raw)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.String:
+		list, err := parseList(raw)
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(list))
+	case v.Type() == reflect.TypeOf([]models.Preset(nil)):
+		presets, err := parsePresets(raw)
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(presets))
+	default:
+		return fmt.Errorf("unsupported setting of type %s", v.Type())
+	}
+	return nil
+}
+
+// parseDuration accepts Go durations such as "1m30s". Bare numbers are
+// seconds, as in the *_SECONDS environment variables
+func parseDuration(raw any) (time.Duration, error) {
+	if s, ok := raw.(string); ok {
+		if _, err := strconv.ParseFloat(s, 64); err != nil {
+			d, err := time.ParseDuration(s)
+			if err != nil {
+				return 0, fmt.Errorf("invalid duration %q, want e.g. 30s or 1m", s)
+			}
+			return d, nil
+		}
+	}
+	seconds, err := parseFloat(raw)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %v, want e.g. 30s or 1m", raw)
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+func parseInt(raw any) (int64, error) {
+	switch r := raw.(type) {
+	case int:
+		return int64(r), nil
+	case int64:
+		return r, nil
+	case uint64:
+		if r > math.MaxInt64 {
+			return 0, fmt.Errorf("%d is out of range", r)
+		}
+		return int64(r), nil
+	case float64:
+		if r != math.Trunc(r) {
+			return 0, fmt.Errorf("expected a whole number, got %v", r)
+		}
+		return int64(r), nil
+	case string:
+		n, err := strconv.ParseInt(r, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid integer %q", r)
+		}
+		return n, nil
+	}
+	return 0, fmt.Errorf("expected an integer, got %v", raw)
+}
+
+func parseFloat(raw any) (float64, error) {
+	switch r := raw.(type) {
+	case int:
+		return float64(r), nil
+	case int64:
+		return float64(r), nil
+	case uint64:
+		return float64(r), nil
+	case float64:
+		return r, nil
+	case string:
+		f, err := strconv.ParseFloat(r, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid number %q", r)
+		}
+		return f, nil
+	}
+	return 0, fmt.Errorf("expected a number, got %v", raw)
+}
+
+// parseList accepts a list of strings or a comma separated string
+func parseList(raw any) ([]string, error) {
+	var items []string
+	switch r := raw.(type) {
+	case string:
+		items = strings.Split(r, ",")
+	case []any:
+		for _, item := range r {
+			s, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("expected a list of strings, got %v", item)
+			}
+			items = append(items, s)
+		}
+	default:
+		return nil, fmt.Errorf("expected a list of strings, got %v", raw)
+	}
+
+	var list []string
+	for _, item := range items {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list, nil
+}
+
+// parsePresets decodes a list of presets from a file. It replaces the
+// default presets, whose family and format are defaulted
+func parsePresets(raw any) ([]models.Preset, error) {
+	items, ok := raw.([]any)
+	if !ok {
+		return nil, fmt.Errorf("expected a list of presets, got %v", raw)
+	}
+
+	presets := make([]models.Preset, len(items))
+	for i, item := range items {
+		fields, ok := item.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("preset %d: expected a section of settings, got %v", i+1, item)
+		}
+
+		settings := settingsOf(reflect.ValueOf(&presets[i]).Elem(), "", "")
+		byKey := make(map[string]setting, len(settings))
+		keys := make([]string, 0, len(settings))
+		for _, s := range settings {
+			byKey[s.key] = s
+			keys = append(keys, s.key)
+		}
+
+		names := make([]string, 0, len(fields))
+		for name := range fields {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			s, ok := byKey[name]
+			if !ok {
+				return nil, fmt.Errorf("preset %d: unknown setting %s%s", i+1, name, suggest(name, keys))
+			}
+			if err := s.set(fields[name]); err != nil {
+				return nil, fmt.Errorf("preset %d: %s: %w", i+1, name, err)
+			}
+		}
+		presets[i].ApplyDefaults()
+	}
+	return presets, nil
+}
+
+// problems collects what is wrong with a configuration, one line each
+type problems []string
+
+func (p *problems) add(key, source, format string, args ...any) {
+	line := key
+	if source != "" {
+		line += " (" + source + ")"
+	}
+	*p = append(*p, line+": "+fmt.Sprintf(format, args...))
+}
+
+func (p problems) err() error {
+	if len(p) == 0 {
+		return nil
+	}
+	return fmt.Errorf("invalid configuration:\n  %s", strings.Join(p, "\n  "))
+}
+
+// suggest returns a hint naming the candidate closest to a mistyped value,
+// or nothing when none is close
+func suggest(value string, candidates []string) string {
+	best, bestDistance := "", len(value)/3+1
+	for _, candidate := range candidates {
+		if distance := editDistance(value, candidate); distance < bestDistance {
+			best, bestDistance = candidate, distance
+		}
+	}
+	if best == "" {
+		return ""
+	}
+	return fmt.Sprintf(", did you mean %s?", best)
+}
+
+// editDistance is the Levenshtein distance between a and b
+func editDistance(a, b string) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(b)]
+}
@@ -0,0 +1,158 @@
+package config
+
+import (
+	"fmt"
+	"img-resizer/internal/models"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// presetNamePattern keeps preset names usable in storage keys and URLs
+var presetNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,31}$`)
+
+// Validate checks every setting against its required, oneof, min and max
+// tags and the settings against each other. All problems are reported
+func (c *Config) Validate() error {
+	return c.validate().err()
+}
+
+func (c *Config) validate() problems {
+	var p problems
+	for _, s := range settingsOf(reflect.ValueOf(c).Elem(), "", "") {
+		if !s.fromFile {
+			c.check(&p, s)
+		}
+	}
+
+	if len(c.Presets) == 0 {
+		p.add("presets", c.sources["presets"], "at least one preset is required")
+	} else if err := ValidatePresets(c.Presets); err != nil {
+		p.add("presets", c.sources["presets"], "%v", err)
+	}
+	names := make([]string, 0, len(c.Presets))
+	for _, preset := range c.Presets {
+		names = append(names, preset.Name)
+	}
+	for _, name := range c.Watermark.Presets {
+		if !slices.Contains(names, name) {
+			p.add("watermark.presets", c.sources["watermark.presets"], "unknown preset %q%s", name, suggest(name, names))
+		}
+	}
+
+	if cache := c.Storage.Cache; cache.Enabled {
+		if cache.MemoryItemBytes > cache.MemoryBytes {
+			p.add("storage.cache.memory_item_bytes", c.sources["storage.cache.memory_item_bytes"],
+				"%d is larger than storage.cache.memory_bytes (%d)", cache.MemoryItemBytes, cache.MemoryBytes)
+		}
+		if cache.DiskBytes > 0 && cache.DiskPath == "" {
+			p.add("storage.cache.disk_path", c.sources["storage.cache.disk_path"], "is required when storage.cache.disk_bytes is set")
+		}
+	}
+	// Without them, tokens the provider issued for any other application
+	// would be accepted
+	if jwt := c.Auth.JWT; jwt.JWKS != "" && jwt.Issuer == "" && jwt.Audience == "" {
+		p.add("auth.jwt.jwks", c.sources["auth.jwt.jwks"], "requires auth.jwt.issuer or auth.jwt.audience")
+	}
+	if c.RateLimit.Enabled && c.RateLimit.Backend == "redis" && c.RateLimit.RedisURL == "" {
+		p.add("rate_limit.redis_url", c.sources["rate_limit.redis_url"], "is required with the redis backend")
+	}
+	return p
+}
+
+// check validates a setting against its tags
+func (c *Config) check(p *problems, s setting) {
+	source := c.sources[s.key]
+	tag := s.field.Tag
+
+	if tag.Get("required") == "true" && s.value.IsZero() {
+		p.add(s.key, source, "is required")
+		return
+	}
+
+	if oneof := tag.Get("oneof"); oneof != "" {
+		allowed := strings.Fields(oneof)
+		if value := s.value.String(); !slices.Contains(allowed, value) {
+			p.add(s.key, source, "unsupported value %q, want one of %s%s", value, strings.Join(allowed, ", "), suggest(value, allowed))
+		}
+	}
+
+	if bound := tag.Get("min"); bound != "" && compare(s.value, bound) < 0 {
+		p.add(s.key, source, "%s is below the minimum of %s", format(s.value), bound)
+	}
+	if bound := tag.Get("max"); bound != "" && compare(s.value, bound) > 0 {
+		p.add(s.key, source, "%s is above the maximum of %s", format(s.value), bound)
+	}
+}
+
+// compare compares a numeric or duration setting to a bound from a tag
+func compare(v reflect.Value, bound string) int {
+	switch {
+	case v.Type() == durationType:
+		limit, err := time.ParseDuration(bound)
+		if err != nil {
+			panic(fmt.Sprintf("invalid duration bound %q", bound))
+		}
+		return cmpOrdered(time.Duration(v.Int()), limit)
+	case v.Kind() == reflect.Int || v.Kind() == reflect.Int64:
+		limit, err := strconv.ParseInt(bound, 10, 64)
+		if err != nil {
+			panic(fmt.Sprintf("invalid integer bound %q", bound))
+		}
+		return cmpOrdered(v.Int(), limit)
+	case v.Kind() == reflect.Float64:
+		limit, err := strconv.ParseFloat(bound, 64)
+		if err != nil {
+			panic(fmt.Sprintf("invalid number bound %q", bound))
+		}
+		return cmpOrdered(v.Float(), limit)
+	}
+	panic(fmt.Sprintf("bound on setting of type %s", v.Type()))
+}
+
+func cmpOrdered[T int64 | float64 | time.Duration](a, b T) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func format(v reflect.Value) string {
+	if v.Type() == durationType {
+		return time.Duration(v.Int()).String()
+	}
+	return fmt.Sprint(v.Interface())
+}
+
+// ValidatePresets checks the names and qualities of presets. Their formats
+// depend on the linked libvips and are checked by processor.PresetsFromConfig
+func ValidatePresets(presets []models.Preset) error {
+	seen := make(map[string]bool)
+	for _, preset := range presets {
+		// The original quality is the uploaded image
+		if !presetNamePattern.MatchString(preset.Name) || preset.Name == string(models.QualityOriginal) {
+			return fmt.Errorf("invalid preset name: %q", preset.Name)
+		}
+		if seen[preset.Name] {
+			return fmt.Errorf("duplicate preset name: %q", preset.Name)
+		}
+		seen[preset.Name] = true
+
+		if preset.TargetSSIM == 0 && (preset.Quality < 1 || preset.Quality > 100) {
+			return fmt.Errorf("preset %s: quality must be between 1 and 100", preset.Name)
+		}
+		if preset.TargetSSIM < 0 || preset.TargetSSIM > 1 {
+			return fmt.Errorf("preset %s: target SSIM must be between 0 and 1", preset.Name)
+		}
+		if preset.Width < 0 || preset.MaxBytes < 0 {
+			return fmt.Errorf("preset %s: width and max bytes cannot be negative", preset.Name)
+		}
+	}
+	return nil
+}
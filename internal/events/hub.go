@@ -0,0 +1,73 @@
+package events
+
+import (
+	"img-resizer/internal/models"
+	"sync"
+)
+
+// subscriberBuffer is how many events a slow client may lag behind before
+// events are dropped for it
+const subscriberBuffer = 16
+
+// Hub relays progress events to the clients watching an image
+type Hub struct {
+	mu          sync.Mutex
+	subscribers map[string]map[chan *models.ProgressEvent]struct{}
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func NewHub() *Hub {
+	return &Hub{
+		subscribers: make(map[string]map[chan *models.ProgressEvent]struct{}),
+		done:        make(chan struct{}),
+	}
+}
+
+// Close tells the clients streaming events to stop, so that open streams
+// don't hold up the shutdown of the server
+func (h *Hub) Close() {
+	h.closeOnce.Do(func() { close(h.done) })
+}
+
+// Done is closed once the hub is closed
+func (h *Hub) Done() <-chan struct{} {
+	return h.done
+}
+
+// Subscribe returns the events of an image and a function to stop receiving
+// them, which must be called once the client is gone
+func (h *Hub) Subscribe(imageID string) (<-chan *models.ProgressEvent, func()) {
+	ch := make(chan *models.ProgressEvent, subscriberBuffer)
+
+	h.mu.Lock()
+	if h.subscribers[imageID] == nil {
+		h.subscribers[imageID] = make(map[chan *models.ProgressEvent]struct{})
+	}
+	h.subscribers[imageID][ch] = struct{}{}
+	h.mu.Unlock()
+
+	return ch, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		delete(h.subscribers[imageID], ch)
+		if len(h.subscribers[imageID]) == 0 {
+			delete(h.subscribers, imageID)
+		}
+	}
+}
+
+// Publish hands an event to the subscribers of its image without blocking.
+// A subscriber whose buffer is full misses the event
+func (h *Hub) Publish(event *models.ProgressEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for ch := range h.subscribers[event.ImageID] {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
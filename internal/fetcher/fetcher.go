@@ -0,0 +1,212 @@
+package fetcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"img-resizer/internal/config"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var (
+	// ErrBlockedAddress is returned when the source resolves to a private,
+	// loopback or otherwise internal address
+	ErrBlockedAddress = errors.New("address is not allowed")
+	// ErrTooLarge is returned when the source is larger than the size limit
+	ErrTooLarge = errors.New("source exceeds the maximum size")
+	// ErrNotImage is returned when the source does not declare an image type
+	ErrNotImage = errors.New("source is not an image")
+)
+
+// blockedPrefixes are the non-public ranges not covered by the netip helpers
+// (see RFC 6890)
+var blockedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("192.0.2.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("198.51.100.0/24"),
+	netip.MustParsePrefix("203.0.113.0/24"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+	netip.MustParsePrefix("64:ff9b:1::/48"),
+	netip.MustParsePrefix("2001:db8::/32"),
+	// 6to4 and Teredo embed IPv4 addresses, which could be internal ones
+	netip.MustParsePrefix("2002::/16"),
+	netip.MustParsePrefix("2001::/32"),
+}
+
+// Fetcher downloads images from remote origins. Addresses are checked when
+// connecting, after DNS resolution, so names resolving to internal hosts and
+// redirects to them are refused as well
+type Fetcher struct {
+	client  *http.Client
+	maxSize int64
+}
+
+// NewFetcher creates a fetcher limited to maxSize bytes per download
+func NewFetcher(cfg config.FetchConfig, maxSize int64) *Fetcher {
+	return &Fetcher{
+		client: &http.Client{
+			Transport: NewTransport(cfg.Timeout, cfg.AllowPrivate),
+			Timeout:   cfg.Timeout,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				if len(via) > cfg.MaxRedirects {
+					return fmt.Errorf("stopped after %d redirects", cfg.MaxRedirects)
+				}
+				return ValidateURL(req.URL.String())
+			},
+		},
+		maxSize: maxSize,
+	}
+}
+
+// NewTransport returns an HTTP transport refusing to connect to internal
+// addresses unless allowPrivate is set
+func NewTransport(timeout time.Duration, allowPrivate bool) *http.Transport {
+	dialer := &net.Dialer{
+		Timeout: timeout,
+	}
+	if !allowPrivate {
+		dialer.Control = checkAddress
+	}
+
+	return &http.Transport{
+		// A proxy would make the dialer check the proxy instead of the origin
+		Proxy:                 nil,
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   timeout,
+		ResponseHeaderTimeout: timeout,
+		MaxIdleConns:          10,
+		IdleConnTimeout:       90 * time.Second,
+	}
+}
+
+// ValidateURL checks that a source URL is an absolute http(s) URL
+func ValidateURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid url: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("unsupported url scheme: %q", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return errors.New("url has no host")
+	}
+	if u.User != nil {
+		return errors.New("url must not contain credentials")
+	}
+	return nil
+}
+
+// Fetch starts downloading rawURL. The returned body fails with ErrTooLarge
+// once more than the size limit has been read, the caller must close it
+func (f *Fetcher) Fetch(ctx context.Context, rawURL string) (io.ReadCloser, error) {
+	if err := ValidateURL(rawURL); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Accept", "image/*")
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch %s: %w", rawURL, err)
+	}
+
+	if err := f.checkResponse(resp); err != nil {
+		if cerr := resp.Body.Close(); cerr != nil {
+			err = errors.Join(err, cerr)
+		}
+		return nil, err
+	}
+
+	return &limitedBody{body: resp.Body, remaining: f.maxSize}, nil
+}
+
+func (f *Fetcher) checkResponse(resp *http.Response) error {
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	if resp.ContentLength > f.maxSize {
+		return ErrTooLarge
+	}
+
+	// The content is sniffed again when stored, this only turns away pages
+	// and other documents early
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || !(strings.HasPrefix(mediaType, "image/") || mediaType == "application/octet-stream") {
+		return ErrNotImage
+	}
+	return nil
+}
+
+// checkAddress is a net.Dialer control function refusing internal addresses
+func checkAddress(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return err
+	}
+	if !IsPublic(addr) {
+		return fmt.Errorf("%w: %s", ErrBlockedAddress, addr)
+	}
+	return nil
+}
+
+// IsPublic reports whether addr is a globally routable unicast address
+func IsPublic(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if !addr.IsGlobalUnicast() || addr.IsPrivate() {
+		return false
+	}
+	for _, prefix := range blockedPrefixes {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// limitedBody reads at most remaining bytes and fails past them instead of
+// silently truncating the image
+type limitedBody struct {
+	body      io.ReadCloser
+	remaining int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining < 0 {
+		return 0, ErrTooLarge
+	}
+	// Read one byte more than allowed to detect oversized bodies
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.body.Read(p)
+	b.remaining -= int64(n)
+	if b.remaining < 0 {
+		return n, ErrTooLarge
+	}
+	return n, err
+}
+
+func (b *limitedBody) Close() error {
+	return b.body.Close()
+}
@@ -0,0 +1,154 @@
+package fetcher
+
+import (
+	"context"
+	"errors"
+	"img-resizer/internal/config"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestFetcher returns a fetcher allowed to reach httptest servers
+func newTestFetcher(maxRedirects int, maxSize int64) *Fetcher {
+	return NewFetcher(config.FetchConfig{
+		Timeout:      5 * time.Second,
+		MaxRedirects: maxRedirects,
+		AllowPrivate: true,
+	}, maxSize)
+}
+
+// fetchAll downloads rawURL and reads the whole body
+func fetchAll(f *Fetcher, rawURL string) ([]byte, error) {
+	body, err := f.Fetch(context.Background(), rawURL)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return io.ReadAll(body)
+}
+
+func TestFetchFollowsRedirectsUpToTheLimit(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/image", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		io.WriteString(w, "png")
+	})
+	// /hop/n redirects n times before reaching the image
+	mux.HandleFunc("/hop/{n}", func(w http.ResponseWriter, r *http.Request) {
+		n, _ := strconv.Atoi(r.PathValue("n"))
+		if n == 0 {
+			http.Redirect(w, r, "/image", http.StatusFound)
+			return
+		}
+		http.Redirect(w, r, "/hop/"+strconv.Itoa(n-1), http.StatusFound)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	f := newTestFetcher(2, 1024)
+	if data, err := fetchAll(f, server.URL+"/hop/1"); err != nil || string(data) != "png" {
+		t.Errorf("2 redirects: got %q, %v", data, err)
+	}
+	if _, err := fetchAll(f, server.URL+"/hop/2"); err == nil || !strings.Contains(err.Error(), "stopped after 2 redirects") {
+		t.Errorf("3 redirects: got %v, want the redirect limit", err)
+	}
+}
+
+func TestFetchEnforcesTheSizeLimit(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/jpeg")
+		// Chunked responses announce no length, the body is cut while read
+		if r.URL.Query().Has("chunked") {
+			w.(http.Flusher).Flush()
+		}
+		io.WriteString(w, strings.Repeat("x", 100))
+	}))
+	defer server.Close()
+
+	if _, err := fetchAll(newTestFetcher(0, 100), server.URL); err != nil {
+		t.Errorf("body at the limit: %v", err)
+	}
+	for _, rawURL := range []string{server.URL, server.URL + "?chunked"} {
+		if _, err := fetchAll(newTestFetcher(0, 99), rawURL); !errors.Is(err, ErrTooLarge) {
+			t.Errorf("%s over the limit: got %v, want ErrTooLarge", rawURL, err)
+		}
+	}
+}
+
+func TestFetchRejectsOtherContentTypes(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", r.URL.Query().Get("type"))
+		io.WriteString(w, "content")
+	}))
+	defer server.Close()
+
+	f := newTestFetcher(0, 1024)
+	for contentType, allowed := range map[string]bool{
+		"image/webp":               true,
+		"image/png; charset=x":     true,
+		"application/octet-stream": true,
+		"text/html; charset=utf-8": false,
+		"application/json":         false,
+		"":                         false,
+	} {
+		_, err := fetchAll(f, server.URL+"?type="+url.QueryEscape(contentType))
+		if allowed && err != nil {
+			t.Errorf("%q: %v", contentType, err)
+		}
+		if !allowed && !errors.Is(err, ErrNotImage) {
+			t.Errorf("%q: got %v, want ErrNotImage", contentType, err)
+		}
+	}
+}
+
+func TestFetchRefusesInternalTargets(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		io.WriteString(w, "png")
+	}))
+	defer server.Close()
+
+	f := NewFetcher(config.FetchConfig{Timeout: 5 * time.Second}, 1024)
+	if _, err := fetchAll(f, server.URL); !errors.Is(err, ErrBlockedAddress) {
+		t.Errorf("loopback server: got %v, want ErrBlockedAddress", err)
+	}
+	// Only the resolved address counts, whatever the host is called
+	localhost := strings.Replace(server.URL, "127.0.0.1", "localhost", 1)
+	if _, err := fetchAll(f, localhost); !errors.Is(err, ErrBlockedAddress) {
+		t.Errorf("localhost: got %v, want ErrBlockedAddress", err)
+	}
+}
+
+func TestIsPublic(t *testing.T) {
+	for addr, public := range map[string]bool{
+		"8.8.8.8":              true,
+		"2606:4700:4700::1111": true,
+		"127.0.0.1":            false,
+		"10.1.2.3":             false,
+		"172.16.0.1":           false,
+		"192.168.1.1":          false,
+		"169.254.169.254":      false,
+		"100.64.0.1":           false,
+		"0.0.0.0":              false,
+		"::1":                  false,
+		"::ffff:127.0.0.1":     false,
+		"fc00::1":              false,
+		"fe80::1":              false,
+		"64:ff9b::a00:1":       false,
+		"2002:a00:1::1":        false, // 6to4 of 10.0.0.1
+		"2001:0:4136:e378::1":  false, // Teredo
+		"2001:db8::1":          false,
+		"ff02::1":              false,
+	} {
+		if got := IsPublic(netip.MustParseAddr(addr)); got != public {
+			t.Errorf("IsPublic(%s) = %v, want %v", addr, got, public)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package filelock
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// Lock takes an exclusive lock on the file at path, creating it and its
+// directory if needed, and returns the function releasing it. Locks are held
+// by open files, so goroutines of one process exclude each other too. A
+// holder may remove the file before releasing it, processes waiting then
+// lock the file created in its place
+func Lock(path string) (func(), error) {
+	unlock, _, err := lock(path, syscall.LOCK_EX)
+	return unlock, err
+}
+
+// TryLock is like Lock but does not wait, it reports false when the lock is
+// held elsewhere
+func TryLock(path string) (func(), bool, error) {
+	return lock(path, syscall.LOCK_EX|syscall.LOCK_NB)
+}
+
+func lock(path string, how int) (func(), bool, error) {
+	for {
+		file, ok, err := lockFile(path, how)
+		if err != nil || !ok {
+			return nil, ok, err
+		}
+
+		// The lock is on the file opened, which the previous holder may
+		// have removed meanwhile. Only the file still at path counts
+		current, err := os.Stat(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			closeLock(file, path)
+			return nil, false, fmt.Errorf("failed to check lock: %w", err)
+		}
+		locked, ferr := file.Stat()
+		if ferr != nil {
+			closeLock(file, path)
+			return nil, false, fmt.Errorf("failed to check lock: %w", ferr)
+		}
+		if err != nil || !os.SameFile(current, locked) {
+			closeLock(file, path)
+			continue
+		}
+
+		// Closing the file releases the lock
+		return func() { closeLock(file, path) }, true, nil
+	}
+}
+
+// lockFile opens path and locks it, reporting false when it is held elsewhere
+func lockFile(path string, how int) (*os.File, bool, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, false, fmt.Errorf("failed to create lock directory: %w", err)
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to open lock: %w", err)
+	}
+	if err := syscall.Flock(int(file.Fd()), how); err != nil {
+		closeLock(file, path)
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, false, nil
+		}
+		return nil, false, fmt.Errorf("failed to take lock: %w", err)
+	}
+	return file, true, nil
+}
+
+func closeLock(file *os.File, path string) {
+	if err := file.Close(); err != nil {
+		slog.Warn("failed to close lock", "path", path, "error", err)
+	}
+}
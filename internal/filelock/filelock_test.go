@@ -0,0 +1,59 @@
+package filelock
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLockFileRemovedByHolder(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "claim.lock")
+	release, err := Lock(path)
+	if err != nil {
+		t.Fatalf("Lock: %v", err)
+	}
+
+	locked := make(chan func())
+	go func() {
+		unlock, err := Lock(path)
+		if err != nil {
+			t.Errorf("Lock: %v", err)
+			unlock = func() {}
+		}
+		locked <- unlock
+	}()
+
+	// Let the waiter open the file before the holder removes it
+	time.Sleep(50 * time.Millisecond)
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	release()
+
+	unlock := <-locked
+	defer unlock()
+
+	// The waiter must hold the lock on the file now at path
+	if _, ok, err := TryLock(path); err != nil || ok {
+		t.Fatalf("TryLock got %v, %v while the waiter holds the lock", ok, err)
+	}
+}
+
+func TestTryLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "locks", "a")
+	unlock, ok, err := TryLock(path)
+	if err != nil || !ok {
+		t.Fatalf("TryLock got %v, %v, want the lock", ok, err)
+	}
+	if _, ok, err := TryLock(path); err != nil || ok {
+		t.Fatalf("second TryLock got %v, %v, want it refused", ok, err)
+	}
+	unlock()
+
+	unlock, ok, err = TryLock(path)
+	if err != nil || !ok {
+		t.Fatalf("TryLock after release got %v, %v, want the lock", ok, err)
+	}
+	unlock()
+}
@@ -0,0 +1,153 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Check reports whether a dependency works, nil means healthy
+type Check func(ctx context.Context) error
+
+// Report is the outcome of running the checks of a Checker. Checks maps
+// every check to "ok" or the error it returned
+type Report struct {
+	Status  string            `json:"status"` // "ok" or "unavailable"
+	Checks  map[string]string `json:"checks,omitempty"`
+	Details map[string]any    `json:"details,omitempty"`
+}
+
+// Healthy reports whether every check passed
+func (r *Report) Healthy() bool {
+	return r.Status == "ok"
+}
+
+type namedCheck struct {
+	name  string
+	check Check
+}
+
+type namedDetail struct {
+	name  string
+	value func() any
+}
+
+// Checker runs named checks, each bounded by a timeout, and serves their
+// report to probes
+type Checker struct {
+	timeout time.Duration
+
+	mu      sync.Mutex
+	checks  []namedCheck
+	details []namedDetail
+}
+
+// NewChecker creates a checker without checks, which is always healthy
+func NewChecker(timeout time.Duration) *Checker {
+	return &Checker{timeout: timeout}
+}
+
+// Add registers a check that fails the report when it returns an error
+func (c *Checker) Add(name string, check Check) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checks = append(c.checks, namedCheck{name, check})
+}
+
+// Detail registers informational state added to every report, which does
+// not affect its status
+func (c *Checker) Detail(name string, value func() any) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.details = append(c.details, namedDetail{name, value})
+}
+
+// Run runs the checks concurrently and collects their outcome
+func (c *Checker) Run(ctx context.Context) *Report {
+	c.mu.Lock()
+	checks := append([]namedCheck(nil), c.checks...)
+	details := append([]namedDetail(nil), c.details...)
+	c.mu.Unlock()
+
+	results := make([]error, len(checks))
+	var wg sync.WaitGroup
+	for i, check := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = c.run(ctx, check.check)
+		}()
+	}
+	wg.Wait()
+
+	report := &Report{Status: "ok"}
+	if len(checks) > 0 {
+		report.Checks = make(map[string]string, len(checks))
+	}
+	for i, check := range checks {
+		if results[i] != nil {
+			report.Status = "unavailable"
+			report.Checks[check.name] = results[i].Error()
+			slog.WarnContext(ctx, "health check failed", "check", check.name, "error", results[i])
+			continue
+		}
+		report.Checks[check.name] = "ok"
+	}
+	if len(details) > 0 {
+		report.Details = make(map[string]any, len(details))
+		for _, detail := range details {
+			report.Details[detail.name] = detail.value()
+		}
+	}
+	return report
+}
+
+// run bounds a check by the timeout, also when the check ignores its context
+func (c *Checker) run(ctx context.Context, check Check) error {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- check(ctx)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Handler serves the report, with 503 Service Unavailable when a check
+// failed
+func (c *Checker) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report := c.Run(r.Context())
+		status := http.StatusOK
+		if !report.Healthy() {
+			status = http.StatusServiceUnavailable
+		}
+		writeReport(w, status, report)
+	})
+}
+
+// Live answers every probe with 200 OK, for liveness probes that should
+// only restart a process which stopped serving
+func Live() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeReport(w, http.StatusOK, &Report{Status: "ok"})
+	})
+}
+
+func writeReport(w http.ResponseWriter, status int, report *Report) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		slog.Warn("failed to write health report", "error", err)
+	}
+}
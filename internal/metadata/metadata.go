@@ -0,0 +1,803 @@
+package metadata
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"img-resizer/internal/config"
+	"img-resizer/internal/filelock"
+	"img-resizer/internal/models"
+	"log/slog"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrNotFound is returned when an image has no stored metadata
+var ErrNotFound = errors.New("metadata not found")
+
+// ErrQuotaExceeded is returned by AddUsage when a tenant would exceed its quota
+var ErrQuotaExceeded = errors.New("tenant quota exceeded")
+
+// ErrDeliveryClaimed is returned by ClaimDelivery for webhook deliveries
+// another process is sending
+var ErrDeliveryClaimed = errors.New("webhook delivery is claimed")
+
+// Store defines the interface for image metadata storage
+type Store interface {
+	Save(meta *models.ImageMetadata) error
+	// Update is like Save but fails with ErrNotFound when the image has
+	// been deleted, so late writers don't bring it back
+	Update(meta *models.ImageMetadata) error
+	Get(id string) (*models.ImageMetadata, error)
+	Delete(id string) error
+	// FindBySHA256 returns the id of the image with the given content hash
+	// uploaded by the tenant or, for images without a tenant, by the owner
+	FindBySHA256(tenantID, ownerID, sum string) (string, error)
+	// FindSimilar returns images of the tenant or, for images without a
+	// tenant, of the owner whose perceptual hash differs from hash in at
+	// most maxDistance bits, closest first
+	FindSimilar(tenantID, ownerID, hash string, maxDistance int) ([]Match, error)
+
+	SaveBatch(batch *models.Batch) error
+	GetBatch(id string) (*models.Batch, error)
+
+	SaveDelivery(delivery *models.WebhookDelivery) error
+	GetDelivery(imageID, id string) (*models.WebhookDelivery, error)
+	// ListDeliveries returns the webhook deliveries of an image, oldest first
+	ListDeliveries(imageID string) ([]models.WebhookDelivery, error)
+	// ListPendingDeliveries returns the pending webhook deliveries of every
+	// image
+	ListPendingDeliveries() ([]models.WebhookDelivery, error)
+	// ClaimDelivery keeps other processes from sending a webhook delivery
+	// until the returned function is called. It fails with
+	// ErrDeliveryClaimed while another process holds the claim
+	ClaimDelivery(imageID, id string) (func(), error)
+
+	// LockUpload serializes the requests for a resumable upload across
+	// processes until the returned function is called
+	LockUpload(id string) (func(), error)
+
+	SaveAPIKey(key *models.APIKey) error
+	GetAPIKey(id string) (*models.APIKey, error)
+	ListAPIKeys() ([]models.APIKey, error)
+
+	SaveTenant(tenant *models.Tenant) error
+	GetTenant(id string) (*models.Tenant, error)
+	ListTenants() ([]models.Tenant, error)
+	// GetUsage returns the usage of a tenant, zero when nothing is recorded
+	GetUsage(tenantID string) (*models.TenantUsage, error)
+	// AddUsage adds to the usage of a tenant, negative values release it.
+	// With a quota, growth past it fails with ErrQuotaExceeded and nothing
+	// is recorded
+	AddUsage(tenantID string, bytes int64, images int, quota *models.Quota) (*models.TenantUsage, error)
+}
+
+// Match is an image found by perceptual hash
+type Match struct {
+	ID       string `json:"id"`
+	Distance int    `json:"distance"`
+}
+
+// LocalStore keeps one JSON document per image on the local filesystem.
+// Hashes are indexed with one small file per image under index/ so lookups
+// don't have to read every document. Processes sharing the directory
+// coordinate with lock files
+type LocalStore struct {
+	basePath string
+}
+
+// NewStore creates a new metadata store based on configuration
+func NewStore(cfg *config.Config) (Store, error) {
+	switch cfg.Metadata.Type {
+	case "local":
+		return NewLocalStore(cfg.Metadata.LocalPath)
+	default:
+		return nil, fmt.Errorf("unsupported metadata type: %s", cfg.Metadata.Type)
+	}
+}
+
+func NewLocalStore(basePath string) (*LocalStore, error) {
+	// Create base directory if it doesn't exist
+	if err := os.MkdirAll(basePath, 0755); err != nil {
+		return nil, err
+	}
+
+	return &LocalStore{
+		basePath: basePath,
+	}, nil
+}
+
+// indexDir returns the directory of an index. Entries are kept apart per
+// tenant, or per owner for images without a tenant, so uploads are never
+// deduplicated against or found similar to those of somebody else
+func (s *LocalStore) indexDir(index, tenantID, ownerID string) string {
+	dir := filepath.Join(s.basePath, "index", index)
+	switch {
+	case tenantID != "":
+		dir = filepath.Join(dir, "tenants", tenantID)
+	case ownerID != "":
+		dir = filepath.Join(dir, "owners", base64.RawURLEncoding.EncodeToString([]byte(ownerID)))
+	}
+	return dir
+}
+
+// sha256Path returns the index entry of a content hash
+func (s *LocalStore) sha256Path(tenantID, ownerID, sum string) string {
+	return filepath.Join(s.indexDir("sha256", tenantID, ownerID), sum)
+}
+
+// dhashPath returns the index entry of the perceptual hash of an image
+func (s *LocalStore) dhashPath(meta *models.ImageMetadata) string {
+	return filepath.Join(s.indexDir("dhash", meta.TenantID, meta.OwnerID), meta.PerceptualHash+"_"+meta.ID)
+}
+
+func (s *LocalStore) getPath(id string) (string, error) {
+	if len(id) < 2 || filepath.Base(id) != id {
+		return "", fmt.Errorf("invalid image id: %q", id)
+	}
+	return filepath.Join(s.basePath, id[:2], id+".json"), nil
+}
+
+// Save writes the metadata atomically so readers never see a partial document
+func (s *LocalStore) Save(meta *models.ImageMetadata) error {
+	return s.save(meta, false)
+}
+
+func (s *LocalStore) Update(meta *models.ImageMetadata) error {
+	return s.save(meta, true)
+}
+
+func (s *LocalStore) save(meta *models.ImageMetadata, mustExist bool) error {
+	path, err := s.getPath(meta.ID)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return fmt.Errorf("failed to marshal metadata: %w", err)
+	}
+
+	unlock, err := s.lockImage(meta.ID)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if mustExist {
+		if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+			return ErrNotFound
+		} else if err != nil {
+			return fmt.Errorf("failed to read metadata: %w", err)
+		}
+	}
+
+	if err := writeFile(path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write metadata: %w", err)
+	}
+
+	return s.index(meta)
+}
+
+// lockImage holds a lock file shared by the images whose ids start alike.
+// Image metadata is written by the API, the workers and the admin tools,
+// the lock keeps an update from bringing back an image being deleted
+func (s *LocalStore) lockImage(id string) (func(), error) {
+	unlock, err := filelock.Lock(filepath.Join(s.basePath, "locks", id[:2]))
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock metadata: %w", err)
+	}
+	return unlock, nil
+}
+
+// index records the hashes of an image
+func (s *LocalStore) index(meta *models.ImageMetadata) error {
+	if meta.SHA256 != "" {
+		path := s.sha256Path(meta.TenantID, meta.OwnerID, meta.SHA256)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return fmt.Errorf("failed to create index directory: %w", err)
+		}
+		// The first image with given content stays the canonical one of
+		// its tenant or owner, only one writer creates the entry
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			_, err = file.WriteString(meta.ID)
+			if cerr := file.Close(); err == nil {
+				err = cerr
+			}
+		}
+		if err != nil && !errors.Is(err, os.ErrExist) {
+			return fmt.Errorf("failed to index sha256: %w", err)
+		}
+	}
+
+	if meta.PerceptualHash != "" {
+		path := s.dhashPath(meta)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return fmt.Errorf("failed to create index directory: %w", err)
+		}
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			return fmt.Errorf("failed to index perceptual hash: %w", err)
+		}
+	}
+	return nil
+}
+
+// unindex removes the hashes of an image
+func (s *LocalStore) unindex(meta *models.ImageMetadata) error {
+	if meta.SHA256 != "" {
+		path := s.sha256Path(meta.TenantID, meta.OwnerID, meta.SHA256)
+		// Only drop the entry if it still points at this image
+		if id, err := os.ReadFile(path); err == nil && string(id) == meta.ID {
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+		}
+	}
+
+	if meta.PerceptualHash != "" {
+		// Entries indexed before the index was kept per tenant and owner
+		// are all in the top directory
+		legacy := filepath.Join(s.basePath, "index", "dhash", meta.PerceptualHash+"_"+meta.ID)
+		for _, path := range []string{s.dhashPath(meta), legacy} {
+			if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *LocalStore) Get(id string) (*models.ImageMetadata, error) {
+	path, err := s.getPath(id)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read metadata: %w", err)
+	}
+
+	var meta models.ImageMetadata
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal metadata: %w", err)
+	}
+	return &meta, nil
+}
+
+func (s *LocalStore) Delete(id string) error {
+	path, err := s.getPath(id)
+	if err != nil {
+		return err
+	}
+
+	unlock, err := s.lockImage(id)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	meta, err := s.Get(id)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := s.unindex(meta); err != nil {
+		return fmt.Errorf("failed to remove index entries: %w", err)
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (s *LocalStore) FindBySHA256(tenantID, ownerID, sum string) (string, error) {
+	if filepath.Base(sum) != sum || (tenantID != "" && !models.ValidTenantID(tenantID)) {
+		return "", ErrNotFound
+	}
+
+	id, err := os.ReadFile(s.sha256Path(tenantID, ownerID, sum))
+	if errors.Is(err, os.ErrNotExist) {
+		return "", ErrNotFound
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read index: %w", err)
+	}
+	return string(id), nil
+}
+
+func (s *LocalStore) FindSimilar(tenantID, ownerID, hash string, maxDistance int) ([]Match, error) {
+	target, err := strconv.ParseUint(hash, 16, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid perceptual hash %q: %w", hash, err)
+	}
+	if tenantID != "" && !models.ValidTenantID(tenantID) {
+		return nil, nil
+	}
+
+	entries, err := os.ReadDir(s.indexDir("dhash", tenantID, ownerID))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read index: %w", err)
+	}
+
+	var matches []Match
+	for _, entry := range entries {
+		value, id, ok := strings.Cut(entry.Name(), "_")
+		if !ok || entry.IsDir() {
+			continue
+		}
+		candidate, err := strconv.ParseUint(value, 16, 64)
+		if err != nil {
+			continue
+		}
+		if distance := bits.OnesCount64(target ^ candidate); distance <= maxDistance {
+			matches = append(matches, Match{ID: id, Distance: distance})
+		}
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].Distance != matches[j].Distance {
+			return matches[i].Distance < matches[j].Distance
+		}
+		return matches[i].ID < matches[j].ID
+	})
+	return matches, nil
+}
+
+func (s *LocalStore) batchPath(id string) (string, error) {
+	if id == "" || filepath.Base(id) != id {
+		return "", fmt.Errorf("invalid batch id: %q", id)
+	}
+	return filepath.Join(s.basePath, "batches", id+".json"), nil
+}
+
+func (s *LocalStore) SaveBatch(batch *models.Batch) error {
+	path, err := s.batchPath(batch.ID)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(batch)
+	if err != nil {
+		return fmt.Errorf("failed to marshal batch: %w", err)
+	}
+
+	if err := writeFile(path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write batch: %w", err)
+	}
+	return nil
+}
+
+func (s *LocalStore) GetBatch(id string) (*models.Batch, error) {
+	path, err := s.batchPath(id)
+	if err != nil {
+		return nil, ErrNotFound
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read batch: %w", err)
+	}
+
+	var batch models.Batch
+	if err := json.Unmarshal(data, &batch); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal batch: %w", err)
+	}
+	return &batch, nil
+}
+
+func (s *LocalStore) deliveryPath(imageID, id string) (string, error) {
+	if imageID == "" || filepath.Base(imageID) != imageID {
+		return "", fmt.Errorf("invalid image id: %q", imageID)
+	}
+	if id == "" || filepath.Base(id) != id {
+		return "", fmt.Errorf("invalid delivery id: %q", id)
+	}
+	return filepath.Join(s.basePath, "deliveries", imageID, id+".json"), nil
+}
+
+func (s *LocalStore) SaveDelivery(delivery *models.WebhookDelivery) error {
+	path, err := s.deliveryPath(delivery.ImageID, delivery.ID)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(delivery)
+	if err != nil {
+		return fmt.Errorf("failed to marshal delivery: %w", err)
+	}
+
+	if err := writeFile(path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write delivery: %w", err)
+	}
+	return nil
+}
+
+func (s *LocalStore) GetDelivery(imageID, id string) (*models.WebhookDelivery, error) {
+	path, err := s.deliveryPath(imageID, id)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read delivery: %w", err)
+	}
+
+	var delivery models.WebhookDelivery
+	if err := json.Unmarshal(data, &delivery); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal delivery: %w", err)
+	}
+	return &delivery, nil
+}
+
+func (s *LocalStore) ListPendingDeliveries() ([]models.WebhookDelivery, error) {
+	entries, err := os.ReadDir(filepath.Join(s.basePath, "deliveries"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read deliveries: %w", err)
+	}
+
+	var pending []models.WebhookDelivery
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		deliveries, err := s.ListDeliveries(entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		for _, delivery := range deliveries {
+			if delivery.Status == models.DeliveryPending {
+				pending = append(pending, delivery)
+			}
+		}
+	}
+	return pending, nil
+}
+
+// ClaimDelivery holds a lock file next to the delivery. The file is removed
+// on release, before it is unlocked, so a process that opened it meanwhile
+// locks a new file instead. It must read the delivery again to see whether
+// it is still pending
+func (s *LocalStore) ClaimDelivery(imageID, id string) (func(), error) {
+	path, err := s.deliveryPath(imageID, id)
+	if err != nil {
+		return nil, err
+	}
+	path = strings.TrimSuffix(path, ".json") + ".lock"
+
+	unlock, ok, err := filelock.TryLock(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim delivery: %w", err)
+	}
+	if !ok {
+		return nil, ErrDeliveryClaimed
+	}
+	return func() {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.Warn("failed to remove delivery claim", "path", path, "error", err)
+		}
+		unlock()
+	}, nil
+}
+
+// LockUpload holds a lock file per upload, removed on release like the
+// claims of deliveries
+func (s *LocalStore) LockUpload(id string) (func(), error) {
+	if id == "" || filepath.Base(id) != id {
+		return nil, fmt.Errorf("invalid upload id: %q", id)
+	}
+	path := filepath.Join(s.basePath, "uploads", id+".lock")
+
+	unlock, err := filelock.Lock(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock upload: %w", err)
+	}
+	return func() {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.Warn("failed to remove upload lock", "path", path, "error", err)
+		}
+		unlock()
+	}, nil
+}
+
+func (s *LocalStore) ListDeliveries(imageID string) ([]models.WebhookDelivery, error) {
+	if imageID == "" || filepath.Base(imageID) != imageID {
+		return nil, nil
+	}
+
+	dir := filepath.Join(s.basePath, "deliveries", imageID)
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read deliveries: %w", err)
+	}
+
+	var deliveries []models.WebhookDelivery
+	for _, entry := range entries {
+		if filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read delivery: %w", err)
+		}
+		var delivery models.WebhookDelivery
+		if err := json.Unmarshal(data, &delivery); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal delivery: %w", err)
+		}
+		deliveries = append(deliveries, delivery)
+	}
+
+	sort.Slice(deliveries, func(i, j int) bool {
+		return deliveries[i].CreatedAt.Before(deliveries[j].CreatedAt)
+	})
+	return deliveries, nil
+}
+
+func (s *LocalStore) apiKeyPath(id string) (string, error) {
+	if id == "" || filepath.Base(id) != id {
+		return "", fmt.Errorf("invalid api key id: %q", id)
+	}
+	return filepath.Join(s.basePath, "keys", id+".json"), nil
+}
+
+func (s *LocalStore) SaveAPIKey(key *models.APIKey) error {
+	path, err := s.apiKeyPath(key.ID)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(key)
+	if err != nil {
+		return fmt.Errorf("failed to marshal api key: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	if err := writeFile(path, data, 0600); err != nil {
+		return fmt.Errorf("failed to write api key: %w", err)
+	}
+	return nil
+}
+
+func (s *LocalStore) GetAPIKey(id string) (*models.APIKey, error) {
+	path, err := s.apiKeyPath(id)
+	if err != nil {
+		return nil, ErrNotFound
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read api key: %w", err)
+	}
+
+	var key models.APIKey
+	if err := json.Unmarshal(data, &key); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal api key: %w", err)
+	}
+	return &key, nil
+}
+
+func (s *LocalStore) ListAPIKeys() ([]models.APIKey, error) {
+	entries, err := os.ReadDir(filepath.Join(s.basePath, "keys"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read api keys: %w", err)
+	}
+
+	var keys []models.APIKey
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok {
+			continue
+		}
+		key, err := s.GetAPIKey(id)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, *key)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+	})
+	return keys, nil
+}
+
+func (s *LocalStore) tenantPath(dir, id string) (string, error) {
+	if !models.ValidTenantID(id) {
+		return "", fmt.Errorf("invalid tenant id: %q", id)
+	}
+	return filepath.Join(s.basePath, dir, id+".json"), nil
+}
+
+func (s *LocalStore) SaveTenant(tenant *models.Tenant) error {
+	path, err := s.tenantPath("tenants", tenant.ID)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(tenant)
+	if err != nil {
+		return fmt.Errorf("failed to marshal tenant: %w", err)
+	}
+
+	// Tenants hold the secret signing their webhooks
+	if err := writeFile(path, data, 0600); err != nil {
+		return fmt.Errorf("failed to write tenant: %w", err)
+	}
+	return nil
+}
+
+func (s *LocalStore) GetTenant(id string) (*models.Tenant, error) {
+	path, err := s.tenantPath("tenants", id)
+	if err != nil {
+		return nil, ErrNotFound
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tenant: %w", err)
+	}
+
+	var tenant models.Tenant
+	if err := json.Unmarshal(data, &tenant); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal tenant: %w", err)
+	}
+	return &tenant, nil
+}
+
+func (s *LocalStore) ListTenants() ([]models.Tenant, error) {
+	entries, err := os.ReadDir(filepath.Join(s.basePath, "tenants"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tenants: %w", err)
+	}
+
+	var tenants []models.Tenant
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok {
+			continue
+		}
+		tenant, err := s.GetTenant(id)
+		if err != nil {
+			return nil, err
+		}
+		tenants = append(tenants, *tenant)
+	}
+
+	sort.Slice(tenants, func(i, j int) bool {
+		return tenants[i].ID < tenants[j].ID
+	})
+	return tenants, nil
+}
+
+func (s *LocalStore) GetUsage(tenantID string) (*models.TenantUsage, error) {
+	return s.readUsage(tenantID)
+}
+
+// AddUsage holds a lock file while it updates the usage, as the API, the
+// workers and the admin tools all record usage
+func (s *LocalStore) AddUsage(tenantID string, bytes int64, images int, quota *models.Quota) (*models.TenantUsage, error) {
+	path, err := s.tenantPath("usage", tenantID)
+	if err != nil {
+		return nil, err
+	}
+	unlock, err := filelock.Lock(path + ".lock")
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock usage: %w", err)
+	}
+	defer unlock()
+
+	usage, err := s.readUsage(tenantID)
+	if err != nil {
+		return nil, err
+	}
+
+	usage.Bytes = max(usage.Bytes+bytes, 0)
+	usage.Images = max(usage.Images+images, 0)
+	growing := bytes > 0 || images > 0
+	if quota != nil && growing && !quota.Allows(*usage) {
+		return nil, ErrQuotaExceeded
+	}
+	usage.UpdatedAt = time.Now()
+
+	data, err := json.Marshal(usage)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal usage: %w", err)
+	}
+	if err := writeFile(path, data, 0644); err != nil {
+		return nil, fmt.Errorf("failed to write usage: %w", err)
+	}
+	return usage, nil
+}
+
+// readUsage reads the usage file, which is replaced atomically
+func (s *LocalStore) readUsage(tenantID string) (*models.TenantUsage, error) {
+	path, err := s.tenantPath("usage", tenantID)
+	if err != nil {
+		return nil, err
+	}
+
+	usage := &models.TenantUsage{TenantID: tenantID}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return usage, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read usage: %w", err)
+	}
+	if err := json.Unmarshal(data, usage); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal usage: %w", err)
+	}
+	return usage, nil
+}
+
+// writeFile replaces path atomically, creating its directory. Every writer
+// gets its own temporary file, so processes writing the same file at once
+// don't mix their contents
+func writeFile(path string, data []byte, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Chmod(perm)
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		if rerr := os.Remove(tmp.Name()); rerr != nil && !errors.Is(rerr, os.ErrNotExist) {
+			slog.Warn("failed to remove temporary file", "path", tmp.Name(), "error", rerr)
+		}
+	}
+	return err
+}
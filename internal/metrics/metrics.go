@@ -0,0 +1,125 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// namespace prefixes every metric of the service
+const namespace = "img_resizer"
+
+var (
+	// HTTPRequestDuration is observed by Middleware for every API request
+	HTTPRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Time to serve API requests by method, route and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+
+	// UploadBytes counts the bytes of accepted originals, whichever endpoint
+	// they were uploaded through
+	UploadBytes = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upload_bytes_total",
+		Help:      "Bytes of uploaded original images.",
+	})
+
+	// QueuePublishFailures counts messages that could not be published, by
+	// kind "task" or "event"
+	QueuePublishFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "queue_publish_failures_total",
+		Help:      "Messages that failed to publish to RabbitMQ by kind.",
+	}, []string{"kind"})
+
+	// Tasks counts the tasks the worker handled by type and result, which is
+	// "processed", "retried" for tasks requeued after an error or "failed"
+	// for tasks given up
+	Tasks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "worker_tasks_total",
+		Help:      "Tasks handled by the worker by type and result.",
+	}, []string{"type", "result"})
+
+	// VariantDuration is the time the worker spent producing one variant
+	VariantDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "worker_variant_duration_seconds",
+		Help:      "Time to produce a variant by preset and output format.",
+		Buckets:   []float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+	}, []string{"preset", "format"})
+
+	// StorageDuration is the time storage operations took. For reads it is
+	// the time to open the object, not to stream it
+	StorageDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "storage_operation_duration_seconds",
+		Help:      "Time of storage operations by operation and result.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"operation", "result"})
+)
+
+// Handler serves the metrics of the process in the Prometheus format
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// Middleware records the duration of every request. Routes are labelled by
+// their pattern so image ids do not create a series each
+func Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		HTTPRequestDuration.WithLabelValues(c.Request.Method, route, strconv.Itoa(c.Writer.Status())).
+			Observe(time.Since(start).Seconds())
+	}
+}
+
+// RegisterVipsMemory exports the memory libvips reports through read. Only
+// the worker processes images, so only it registers these
+func RegisterVipsMemory(read func() (memory, highwater, allocations int64)) {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "vips_memory_bytes",
+		Help:      "Memory currently allocated by libvips.",
+	}, func() float64 {
+		memory, _, _ := read()
+		return float64(memory)
+	})
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "vips_memory_highwater_bytes",
+		Help:      "Highest memory allocated by libvips since start.",
+	}, func() float64 {
+		_, highwater, _ := read()
+		return float64(highwater)
+	})
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "vips_allocations",
+		Help:      "Allocations currently held by libvips.",
+	}, func() float64 {
+		_, _, allocations := read()
+		return float64(allocations)
+	})
+}
+
+// Result labels the outcome of an operation
+func Result(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "ok"
+}
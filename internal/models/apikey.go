@@ -0,0 +1,61 @@
+package models
+
+import "time"
+
+// Scope is a permission granted to an API key
+type Scope string
+
+const (
+	// ScopeUpload allows uploading and importing images
+	ScopeUpload Scope = "upload"
+	// ScopeRead allows reading metadata, status and events of owned images
+	ScopeRead Scope = "read"
+	// ScopeDelete allows deleting owned images
+	ScopeDelete Scope = "delete"
+	// ScopeAdmin grants every scope on every image
+	ScopeAdmin Scope = "admin"
+)
+
+// Scopes lists every scope in the order they are documented
+var Scopes = []Scope{ScopeUpload, ScopeRead, ScopeDelete, ScopeAdmin}
+
+// APIKey is a credential of an API client. Only a hash of the secret is stored
+type APIKey struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Hash       string     `json:"hash"` // SHA-256 of the full key, hex
+	Scopes     []Scope    `json:"scopes"`
+	WebhookURL string     `json:"webhookUrl,omitempty"` // default webhook for uploads with this key
+	TenantID   string     `json:"tenantId,omitempty"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	RevokedAt  *time.Time `json:"revokedAt,omitempty"`
+
+	// WebhookSecret signs the webhooks of images uploaded with the key.
+	// Keys of a tenant use the secret of the tenant instead
+	WebhookSecret string `json:"webhookSecret,omitempty"`
+}
+
+// HasScope reports whether the key grants scope. Admin keys grant every scope
+func (k *APIKey) HasScope(scope Scope) bool {
+	for _, s := range k.Scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// Owns reports whether the key may access a resource of tenantID created
+// by ownerID. Keys of a tenant share its resources, admin scope included,
+// while keys without a tenant own what they create. Admin keys without a
+// tenant can access everything
+func (k *APIKey) Owns(tenantID, ownerID string) bool {
+	switch {
+	case k.TenantID != "":
+		return k.TenantID == tenantID
+	case k.HasScope(ScopeAdmin):
+		return true
+	default:
+		return tenantID == "" && k.ID == ownerID
+	}
+}
@@ -0,0 +1,20 @@
+package models
+
+import "time"
+
+// Batch groups the images created by one batch upload
+type Batch struct {
+	ID        string      `json:"id"`
+	CreatedAt time.Time   `json:"createdAt"`
+	OwnerID   string      `json:"ownerId,omitempty"`
+	TenantID  string      `json:"tenantId,omitempty"`
+	Items     []BatchItem `json:"items"`
+}
+
+// BatchItem is one file of a batch upload. Either ImageID or Error is set
+type BatchItem struct {
+	Name      string `json:"name"`
+	ImageID   string `json:"imageId,omitempty"`
+	Duplicate bool   `json:"duplicate,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
@@ -0,0 +1,36 @@
+package models
+
+import "time"
+
+// EventType is a state transition of an image
+type EventType string
+
+const (
+	// EventUploaded means the original is stored
+	EventUploaded EventType = "uploaded"
+	// EventQueued means the image waits for a worker
+	EventQueued EventType = "queued"
+	// EventProcessing means a worker started on the image
+	EventProcessing EventType = "processing"
+	// EventVariant means one variant is stored, see ProgressEvent.Quality
+	EventVariant EventType = "variant"
+	// EventDone means every variant is available
+	EventDone EventType = "done"
+	// EventFailed means processing failed, see ProgressEvent.Error
+	EventFailed EventType = "failed"
+)
+
+// ProgressEvent is broadcast by the API and workers as an image moves
+// through processing
+type ProgressEvent struct {
+	ImageID string       `json:"imageId"`
+	Type    EventType    `json:"type"`
+	Quality ImageQuality `json:"quality,omitempty"`
+	Error   string       `json:"error,omitempty"`
+	At      time.Time    `json:"at"`
+}
+
+// Final reports whether no further events follow for the image
+func (e *ProgressEvent) Final() bool {
+	return e.Type == EventDone || e.Type == EventFailed
+}
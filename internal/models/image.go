@@ -16,20 +16,122 @@ const (
 	QualityLow ImageQuality = "25"
 )
 
+// ImageStatus represents the processing state of an image
+type ImageStatus string
+
+const (
+	// StatusQueued means the image is uploaded and waiting for a worker
+	StatusQueued ImageStatus = "queued"
+	// StatusProcessing means a worker is producing the variants
+	StatusProcessing ImageStatus = "processing"
+	// StatusDone means every variant is available
+	StatusDone ImageStatus = "done"
+	// StatusFailed means the last processing attempt failed
+	StatusFailed ImageStatus = "failed"
+)
+
 // ImageMetadata represents metadata for an image
 type ImageMetadata struct {
-	ID          string       `json:"id"`
-	OriginalName string      `json:"originalName"`
-	MimeType    string       `json:"mimeType"`
-	Size        int64        `json:"size"`
-	Width       int          `json:"width"`
-	Height      int          `json:"height"`
-	CreatedAt   time.Time    `json:"createdAt"`
-	Qualities   []ImageQuality `json:"qualities"`
+	ID             string            `json:"id"`
+	OriginalName   string            `json:"originalName"`
+	MimeType       string            `json:"mimeType"`
+	Size           int64             `json:"size"`
+	Width          int               `json:"width"`
+	Height         int               `json:"height"`
+	CreatedAt      time.Time         `json:"createdAt"`
+	SHA256         string            `json:"sha256,omitempty"`
+	PerceptualHash string            `json:"perceptualHash,omitempty"` // 64-bit dHash as hex
+	Status         ImageStatus       `json:"status"`
+	Error          string            `json:"error,omitempty"`
+	Qualities      []ImageQuality    `json:"qualities"`
+	Variants       []VariantMetadata `json:"variants,omitempty"`
+	Placeholders   *Placeholders     `json:"placeholders,omitempty"`
+	SourceURL      string            `json:"sourceUrl,omitempty"`  // set for images imported by URL
+	WebhookURL     string            `json:"webhookUrl,omitempty"` // notified when processing ends
+	OwnerID        string            `json:"ownerId,omitempty"`    // API key or token subject that uploaded the image
+	TenantID       string            `json:"tenantId,omitempty"`
+}
+
+// StoredSize is the storage an image takes, original and variants included
+func (m *ImageMetadata) StoredSize() int64 {
+	total := m.Size
+	for _, variant := range m.Variants {
+		total += variant.Size
+	}
+	return total
 }
 
+// HoldsUsage reports whether the image counts against the quota of its
+// tenant. An import whose download failed gave its reservation back
+func (m *ImageMetadata) HoldsUsage() bool {
+	return m.SourceURL == "" || m.Status != StatusFailed || len(m.Qualities) > 0
+}
+
+// ContentHash returns the SHA-256 of the stored bytes of a quality, empty
+// when it was not recorded
+func (m *ImageMetadata) ContentHash(quality ImageQuality) string {
+	if quality == QualityOriginal {
+		return m.SHA256
+	}
+	for _, variant := range m.Variants {
+		if variant.Quality == quality {
+			return variant.SHA256
+		}
+	}
+	return ""
+}
+
+// ModTime returns when the stored bytes of a quality last changed. Variants
+// processed before the time was recorded fall back to the upload time
+func (m *ImageMetadata) ModTime(quality ImageQuality) time.Time {
+	for _, variant := range m.Variants {
+		if variant.Quality == quality && !variant.ProcessedAt.IsZero() {
+			return variant.ProcessedAt
+		}
+	}
+	return m.CreatedAt
+}
+
+// Placeholders represents the low-quality previews shown while an image loads
+type Placeholders struct {
+	BlurHash      string `json:"blurHash"`
+	ThumbHash     string `json:"thumbHash"` // base64
+	DominantColor string `json:"dominantColor"`
+	LQIP          string `json:"lqip"` // data URI of a tiny JPEG
+}
+
+// VariantMetadata represents metadata for a processed variant of an image
+type VariantMetadata struct {
+	Quality        ImageQuality `json:"quality"`
+	MimeType       string       `json:"mimeType"`
+	Size           int64        `json:"size"`
+	Width          int          `json:"width"`
+	Height         int          `json:"height"`
+	EncoderQuality int          `json:"encoderQuality"`
+	SSIM           float64      `json:"ssim,omitempty"`
+	SHA256         string       `json:"sha256,omitempty"`
+	// OverMaxBytes marks a variant larger than the size cap of its preset,
+	// which even the lowest searched quality exceeded
+	OverMaxBytes bool `json:"overMaxBytes,omitempty"`
+	// ProcessedAt is when the current content of the variant was stored
+	ProcessedAt time.Time `json:"processedAt,omitzero"`
+}
+
+// TaskType tells the worker what to do with a task
+type TaskType string
+
+const (
+	// TaskProcess produces the variants of a stored original
+	TaskProcess TaskType = "process"
+	// TaskImport downloads the original from SourceURL, then processes it
+	TaskImport TaskType = "import"
+)
+
 // ImageProcessingTask represents a task for processing an image
 type ImageProcessingTask struct {
-	ID        string `json:"id"`
-	FilePath  string `json:"filePath"`
-}
\ No newline at end of file
+	ID        string   `json:"id"`
+	Type      TaskType `json:"type,omitempty"` // empty means TaskProcess
+	FilePath  string   `json:"filePath"`
+	SourceURL string   `json:"sourceUrl,omitempty"`
+	TenantID  string   `json:"tenantId,omitempty"`
+}
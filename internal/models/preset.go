@@ -0,0 +1,28 @@
+package models
+
+// Preset describes a single variant produced by the worker. Presets are
+// configured for the deployment and can be replaced per tenant. The env
+// tags are suffixes, PRESET_<NAME>_WIDTH sets the width of preset NAME
+type Preset struct {
+	Name      string `json:"name" config:"name"`                  // quality name used in storage and URLs, e.g. "75"
+	Family    string `json:"family" config:"family" env:"FAMILY"` // presets of one family are alternatives in a srcset
+	Quality   int    `json:"quality" config:"quality" env:"QUALITY"`
+	Width     int    `json:"width,omitempty" config:"width" env:"WIDTH"` // maximum output width, 0 keeps the original size
+	Format    string `json:"format" config:"format" env:"FORMAT"`        // output format: "jpeg", "png", "webp" or "avif"
+	Watermark bool   `json:"watermark,omitempty" config:"watermark"`
+
+	// TargetSSIM, when set, replaces Quality with the lowest encoder quality
+	// whose output reaches this similarity to the resized reference
+	TargetSSIM float64 `json:"targetSsim,omitempty" config:"target_ssim" env:"TARGET_SSIM"`
+	MaxBytes   int     `json:"maxBytes,omitempty" config:"max_bytes" env:"MAX_BYTES"` // caps the output size when searching for TargetSSIM and of animations
+}
+
+// ApplyDefaults fills in the family and format of a preset left empty
+func (p *Preset) ApplyDefaults() {
+	if p.Family == "" {
+		p.Family = "default"
+	}
+	if p.Format == "" {
+		p.Format = "jpeg"
+	}
+}
@@ -0,0 +1,47 @@
+package models
+
+import (
+	"regexp"
+	"time"
+)
+
+// Tenant is a team sharing the deployment. Its images are stored under its
+// own prefix and only its API keys and tokens can see them
+type Tenant struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Presets   []Preset  `json:"presets,omitempty"` // replaces the configured presets when set
+	Quota     Quota     `json:"quota"`
+	CreatedAt time.Time `json:"createdAt"`
+
+	// WebhookSecret signs the webhooks of the images of the tenant
+	WebhookSecret string `json:"webhookSecret,omitempty"`
+}
+
+// Quota limits the storage of a tenant. Zero means unlimited
+type Quota struct {
+	MaxBytes  int64 `json:"maxBytes,omitempty"`
+	MaxImages int   `json:"maxImages,omitempty"`
+}
+
+// Allows reports whether usage stays within the quota
+func (q Quota) Allows(usage TenantUsage) bool {
+	return (q.MaxBytes == 0 || usage.Bytes <= q.MaxBytes) &&
+		(q.MaxImages == 0 || usage.Images <= q.MaxImages)
+}
+
+// TenantUsage is the storage a tenant uses, originals and variants included
+type TenantUsage struct {
+	TenantID  string    `json:"tenantId"`
+	Bytes     int64     `json:"bytes"`
+	Images    int       `json:"images"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// tenantIDPattern keeps tenant ids usable as storage prefixes and file names
+var tenantIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+
+// ValidTenantID reports whether id is a well-formed tenant id
+func ValidTenantID(id string) bool {
+	return tenantIDPattern.MatchString(id)
+}
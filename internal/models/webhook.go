@@ -0,0 +1,53 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// WebhookEvent is the kind of notification sent to a webhook
+type WebhookEvent string
+
+const (
+	// EventImageProcessed is sent when every variant of an image is available
+	EventImageProcessed WebhookEvent = "image.processed"
+	// EventImageFailed is sent when processing an image failed
+	EventImageFailed WebhookEvent = "image.failed"
+)
+
+// DeliveryStatus represents the state of a webhook delivery
+type DeliveryStatus string
+
+const (
+	// DeliveryPending means the delivery has not succeeded yet and will be retried
+	DeliveryPending DeliveryStatus = "pending"
+	// DeliverySucceeded means the webhook answered with a 2xx status
+	DeliverySucceeded DeliveryStatus = "succeeded"
+	// DeliveryFailed means every attempt failed
+	DeliveryFailed DeliveryStatus = "failed"
+)
+
+// WebhookDelivery records one notification and its delivery attempts
+type WebhookDelivery struct {
+	ID        string           `json:"id"`
+	ImageID   string           `json:"imageId"`
+	Event     WebhookEvent     `json:"event"`
+	URL       string           `json:"url"`
+	Status    DeliveryStatus   `json:"status"`
+	CreatedAt time.Time        `json:"createdAt"`
+	Attempts  []WebhookAttempt `json:"attempts"`
+	// TenantID and OwnerID pick the secret signing the delivery
+	TenantID string `json:"tenantId,omitempty"`
+	OwnerID  string `json:"ownerId,omitempty"`
+	// NextAttemptAt is when a pending delivery is attempted again
+	NextAttemptAt time.Time `json:"nextAttemptAt,omitzero"`
+	// Payload is the body posted, kept to send it again after a restart
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// WebhookAttempt is one HTTP request of a delivery
+type WebhookAttempt struct {
+	At         time.Time `json:"at"`
+	StatusCode int       `json:"statusCode,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
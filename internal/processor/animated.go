@@ -0,0 +1,141 @@
+package processor
+
+import (
+	"fmt"
+	"img-resizer/internal/models"
+	"time"
+
+	"github.com/h2non/bimg"
+)
+
+// defaultMaxFrames is the frame limit used when none is configured
+const defaultMaxFrames = 300
+
+// isAnimated reports whether data is a GIF or WebP with more than one frame.
+// Animations above the frame limit are rejected
+func (p *Processor) isAnimated(data []byte, format Format) (bool, error) {
+	switch format {
+	case FormatGIF, FormatWebP:
+	default:
+		return false, nil
+	}
+
+	frames, err := vipsFrameCount(data)
+	if err != nil {
+		return false, fmt.Errorf("failed to count frames: %w", err)
+	}
+	if p.maxFrames > 0 && frames > p.maxFrames {
+		return false, fmt.Errorf("animation has %d frames, the limit is %d", frames, p.maxFrames)
+	}
+
+	return frames > 1, nil
+}
+
+// processAnimated resizes every frame of an animated image for each preset,
+// keeping the frame timing and loop count. Stages such as the watermark draw
+// on a single image, so presets with a watermark get the first frame as a
+// still image encoded like any other input. Target quality searches are not
+// applied to animations, the size cap is
+func (p *Processor) processAnimated(original []byte, format Format) (map[models.ImageQuality]*Variant, error) {
+	// The size of an animation is the size of a single frame
+	size, err := bimg.NewImage(original).Size()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read image size: %w", err)
+	}
+
+	variants := make(map[models.ImageQuality]*Variant)
+	variants[models.QualityOriginal] = &Variant{
+		Data:   original,
+		Format: format,
+		Width:  size.Width,
+		Height: size.Height,
+	}
+
+	// GIF has no encoder quality, presets of the same width share one
+	// encoding instead of storing identical copies
+	gifs := make(map[int][]byte)
+
+	for _, preset := range p.presets {
+		if preset.Watermark && len(p.stages) > 0 {
+			variant, err := p.processPreset(original, size, preset)
+			if err != nil {
+				return nil, err
+			}
+			variants[preset.Name] = variant
+			continue
+		}
+
+		start := time.Now()
+		width := size.Width
+		if preset.Width > 0 && preset.Width < width {
+			width = preset.Width
+		}
+
+		// libvips encodes GIF from 8.12 on, older versions convert to WebP
+		outFormat := animatedFormat(format, preset, p.animatedToWebP)
+		if outFormat == FormatGIF && !CanSave(FormatGIF) {
+			outFormat = FormatWebP
+		}
+		if !CanSave(outFormat) {
+			return nil, fmt.Errorf("libvips %s cannot encode animated %s", bimg.VipsVersion, outFormat)
+		}
+
+		encode := func(quality int) (*encoding, error) {
+			if outFormat == FormatGIF {
+				quality = 0
+				if data, ok := gifs[width]; ok {
+					return &encoding{data: data}, nil
+				}
+			}
+			data, err := vipsResizeAnimated(original, width, formatTypes[outFormat], quality)
+			if err != nil {
+				return nil, fmt.Errorf("failed to process animation with quality %s: %w", preset.Name, err)
+			}
+			if outFormat == FormatGIF {
+				gifs[width] = data
+			}
+			return &encoding{data: data, quality: quality}, nil
+		}
+
+		result, err := encode(preset.Quality)
+		if err != nil {
+			return nil, err
+		}
+		if preset.MaxBytes > 0 && len(result.data) > preset.MaxBytes {
+			// Only WebP has a quality to lower, other formats are marked
+			if outFormat == FormatWebP && result.quality > minSearchQuality {
+				result, err = fitMaxBytes(minSearchQuality, result.quality-1, preset.MaxBytes, encode)
+				if err != nil {
+					return nil, err
+				}
+			} else {
+				over := *result
+				over.overMaxBytes = true
+				result = &over
+			}
+		}
+
+		variants[preset.Name] = &Variant{
+			Data:         result.data,
+			Format:       outFormat,
+			Width:        width,
+			Height:       size.Height * width / size.Width,
+			Quality:      result.quality,
+			OverMaxBytes: result.overMaxBytes,
+
+			Duration: time.Since(start),
+		}
+	}
+
+	return variants, nil
+}
+
+// animatedFormat returns the format an animation is encoded to for a
+// preset. WebP presets get WebP, other preset formats cannot hold frames
+// and keep the input format, GIF becoming WebP when toWebP is set
+func animatedFormat(input Format, preset Preset, toWebP bool) Format {
+	if preset.Format == FormatWebP || (input == FormatGIF && toWebP) {
+		return FormatWebP
+	}
+	return input
+}
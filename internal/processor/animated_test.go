@@ -0,0 +1,126 @@
+package processor
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"img-resizer/internal/models"
+	"testing"
+
+	"github.com/h2non/bimg"
+)
+
+// recordingStage records the presets it was applied to
+type recordingStage struct {
+	applied []models.ImageQuality
+}
+
+func (s *recordingStage) Apply(_ *bimg.Options, _ bimg.ImageSize, preset Preset) error {
+	s.applied = append(s.applied, preset.Name)
+	return nil
+}
+
+// testAnimation encodes a two-frame GIF
+func testAnimation(t *testing.T) []byte {
+	t.Helper()
+	palette := color.Palette{color.Black, color.White}
+	anim := &gif.GIF{}
+	for i := range 2 {
+		frame := image.NewPaletted(image.Rect(0, 0, 64, 48), palette)
+		for y := range 48 {
+			for x := range 64 {
+				frame.SetColorIndex(x, y, uint8((x/8+y/8+i)%2))
+			}
+		}
+		anim.Image = append(anim.Image, frame)
+		anim.Delay = append(anim.Delay, 10)
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, anim); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestProcessAnimatedWatermarkAndSizeCap(t *testing.T) {
+	if err := CheckVips(); err != nil {
+		t.Skipf("libvips is not available: %v", err)
+	}
+
+	stage := &recordingStage{}
+	p := NewProcessor(WithStage(stage), WithPresets([]Preset{
+		{Name: "watermarked", Quality: 75, Format: FormatJPEG, Watermark: true},
+		{Name: "gif", Quality: 75, Format: FormatJPEG, MaxBytes: 1},
+		{Name: "webp", Quality: 80, Format: FormatWebP, MaxBytes: 1},
+	}))
+
+	variants, err := p.ProcessImage(testAnimation(t))
+	if err != nil {
+		t.Fatalf("ProcessImage: %v", err)
+	}
+
+	if len(stage.applied) != 1 || stage.applied[0] != "watermarked" {
+		t.Errorf("stages applied to %v, want only the watermarked preset", stage.applied)
+	}
+	if got := variants["watermarked"]; got.Format != FormatJPEG || DetectFormat(got.Data) != FormatJPEG {
+		t.Errorf("watermarked variant is %s, want a JPEG of the first frame", got.Format)
+	}
+
+	if got := variants["gif"]; (got.Format != FormatGIF && got.Format != FormatWebP) || !got.OverMaxBytes {
+		t.Errorf("gif variant is %s with OverMaxBytes %v, want an animation marked over the cap", got.Format, got.OverMaxBytes)
+	}
+	if got := variants["webp"]; got.Format != FormatWebP || !got.OverMaxBytes || got.Quality != minSearchQuality {
+		t.Errorf("webp variant is %s at quality %d with OverMaxBytes %v, want WebP at quality %d over the cap",
+			got.Format, got.Quality, got.OverMaxBytes, minSearchQuality)
+	}
+}
+
+func TestFitMaxBytes(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxBytes int
+		quality  int
+		over     bool
+	}{
+		{name: "highest quality that fits", maxBytes: 555, quality: 55},
+		{name: "fits exactly", maxBytes: 800, quality: 80},
+		{name: "lowest quality fits", maxBytes: 200, quality: 20},
+		{name: "nothing fits", maxBytes: 199, quality: 20, over: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The size is ten bytes per quality step
+			encode := func(quality int) (*encoding, error) {
+				return &encoding{data: make([]byte, quality*10), quality: quality}, nil
+			}
+			result, err := fitMaxBytes(minSearchQuality, 80, tt.maxBytes, encode)
+			if err != nil {
+				t.Fatalf("fitMaxBytes: %v", err)
+			}
+			if result.quality != tt.quality || result.overMaxBytes != tt.over {
+				t.Errorf("got quality %d over %v, want %d over %v", result.quality, result.overMaxBytes, tt.quality, tt.over)
+			}
+		})
+	}
+}
+
+func TestAnimatedFormat(t *testing.T) {
+	tests := []struct {
+		input  Format
+		preset Format
+		toWebP bool
+		want   Format
+	}{
+		{input: FormatGIF, preset: FormatJPEG, want: FormatGIF},
+		{input: FormatGIF, preset: FormatJPEG, toWebP: true, want: FormatWebP},
+		{input: FormatGIF, preset: FormatWebP, want: FormatWebP},
+		{input: FormatWebP, preset: FormatAVIF, want: FormatWebP},
+		{input: FormatWebP, preset: FormatPNG, toWebP: true, want: FormatWebP},
+	}
+	for _, tt := range tests {
+		if got := animatedFormat(tt.input, Preset{Format: tt.preset}, tt.toWebP); got != tt.want {
+			t.Errorf("animatedFormat(%s, %s, %v) = %s, want %s", tt.input, tt.preset, tt.toWebP, got, tt.want)
+		}
+	}
+}
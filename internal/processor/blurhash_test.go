@@ -0,0 +1,66 @@
+package processor
+
+import (
+	"image"
+	"testing"
+)
+
+// testPixels fills a buffer with patterns that vary with both coordinates,
+// so that no coefficient of the hashes lands on a rounding tie. The
+// expected hashes were computed for the same buffer with JavaScript
+// transcriptions of the reference encoders, thumbhash.js of evanw/thumbhash
+// and the C encoder of woltapp/blurhash
+func testPixels(width, height int, transparent bool) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := range height {
+		for x := range width {
+			p := img.PixOffset(x, y)
+			img.Pix[p] = uint8((x*255/(width-1) + x*y) % 256)
+			img.Pix[p+1] = uint8((y*255/(height-1) + x*x) % 256)
+			img.Pix[p+2] = uint8((x*y*3 + 40) % 256)
+			img.Pix[p+3] = 255
+			if transparent {
+				img.Pix[p+3] = uint8((x*255/(width-1) + y*96/(height-1) + x*y) % 256)
+			}
+		}
+	}
+	return img
+}
+
+// testSubImage copies the test pixels into a sub-image, which shares the
+// buffer of its parent with other bounds
+func testSubImage(width, height int) (sub, src *image.NRGBA) {
+	parent := image.NewNRGBA(image.Rect(0, 0, width+8, height+6))
+	sub = parent.SubImage(image.Rect(5, 3, width+5, height+3)).(*image.NRGBA)
+	src = testPixels(width, height, false)
+	for y := range height {
+		copy(sub.Pix[y*sub.Stride:y*sub.Stride+width*4], src.Pix[y*src.Stride:])
+	}
+	return sub, src
+}
+
+func TestBlurHash(t *testing.T) {
+	tests := []struct {
+		width, height int
+		xComponents   int
+		yComponents   int
+		want          string
+	}{
+		{width: 32, height: 24, xComponents: 4, yComponents: 3, want: "LFGb|+7D1rG7idH[H^qzQ-MzV{-P"},
+		{width: 24, height: 32, xComponents: 4, yComponents: 3, want: "LGGSfO7W28G8h*HvHwmoVYR7TH-~"},
+		{width: 32, height: 24, xComponents: 1, yComponents: 1, want: "00Gb|+"},
+	}
+	for _, tt := range tests {
+		if got := blurHash(testPixels(tt.width, tt.height, false), tt.xComponents, tt.yComponents); got != tt.want {
+			t.Errorf("blurHash of %dx%d with %dx%d components = %s, want %s",
+				tt.width, tt.height, tt.xComponents, tt.yComponents, got, tt.want)
+		}
+	}
+}
+
+func TestBlurHashOfSubImage(t *testing.T) {
+	sub, src := testSubImage(32, 24)
+	if got, want := blurHash(sub, 4, 3), blurHash(src, 4, 3); got != want {
+		t.Errorf("blurHash of sub-image = %s, want %s", got, want)
+	}
+}
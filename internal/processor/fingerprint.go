@@ -0,0 +1,79 @@
+package processor
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image/png"
+
+	"github.com/h2non/bimg"
+)
+
+// dHash samples the image on a grid one pixel wider than it is high so that
+// every row yields 8 horizontal gradients
+const (
+	dHashWidth  = 9
+	dHashHeight = 8
+)
+
+// Fingerprint identifies an image exactly (SHA256) and perceptually (DHash)
+type Fingerprint struct {
+	SHA256 string
+	// DHash is 16 hex digits, empty when the linked libvips cannot decode the image
+	DHash string
+}
+
+// Fingerprint hashes the image bytes and, when the image can be decoded,
+// computes its difference hash
+func (p *Processor) Fingerprint(data []byte) (*Fingerprint, error) {
+	sum := sha256.Sum256(data)
+	fingerprint := &Fingerprint{SHA256: hex.EncodeToString(sum[:])}
+
+	if !CanLoad(DetectFormat(data)) {
+		return fingerprint, nil
+	}
+
+	hash, err := dHash(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute perceptual hash: %w", err)
+	}
+	fingerprint.DHash = fmt.Sprintf("%016x", hash)
+	return fingerprint, nil
+}
+
+// dHash computes a 64-bit difference hash: the image is shrunk to 9x8
+// grayscale pixels and each bit records whether a pixel is brighter than its
+// right neighbour. Similar images differ in few bits
+func dHash(data []byte) (uint64, error) {
+	small, err := bimg.NewImage(data).Process(bimg.Options{
+		Width:          dHashWidth,
+		Height:         dHashHeight,
+		Force:          true,
+		Interpretation: bimg.InterpretationBW,
+		Type:           bimg.PNG,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	img, err := png.Decode(bytes.NewReader(small))
+	if err != nil {
+		return 0, err
+	}
+	plane := newLumaPlane(img)
+	if plane.width != dHashWidth || plane.height != dHashHeight {
+		return 0, fmt.Errorf("unexpected thumbnail size %dx%d", plane.width, plane.height)
+	}
+
+	var hash uint64
+	for y := 0; y < dHashHeight; y++ {
+		for x := 0; x < dHashWidth-1; x++ {
+			hash <<= 1
+			if plane.pix[y*dHashWidth+x] > plane.pix[y*dHashWidth+x+1] {
+				hash |= 1
+			}
+		}
+	}
+	return hash, nil
+}
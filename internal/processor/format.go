@@ -0,0 +1,184 @@
+package processor
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/h2non/bimg"
+)
+
+// Format is an image container format detected from content
+type Format string
+
+const (
+	FormatUnknown Format = ""
+	FormatJPEG    Format = "jpeg"
+	FormatPNG     Format = "png"
+	FormatGIF     Format = "gif"
+	FormatWebP    Format = "webp"
+	FormatHEIF    Format = "heif"
+	FormatAVIF    Format = "avif"
+)
+
+// SniffLen is the number of leading bytes DetectFormat needs
+const SniffLen = 512
+
+// formatTypes maps formats to the bimg types used to decode and encode them
+var formatTypes = map[Format]bimg.ImageType{
+	FormatJPEG: bimg.JPEG,
+	FormatPNG:  bimg.PNG,
+	FormatGIF:  bimg.GIF,
+	FormatWebP: bimg.WEBP,
+	FormatHEIF: bimg.HEIF,
+	FormatAVIF: bimg.AVIF,
+}
+
+// outputFormats are the web-friendly formats presets can be encoded to
+var outputFormats = []Format{FormatJPEG, FormatPNG, FormatWebP, FormatAVIF}
+
+// heifBrands are the ISO BMFF brands identifying HEIC/HEIF images
+var heifBrands = []string{"heic", "heix", "hevc", "hevx", "heim", "heis", "mif1", "msf1"}
+
+// DetectFormat identifies the image format from its leading bytes. Unlike
+// bimg.DetermineImageType it does not depend on the codecs linked into
+// libvips, so the API can recognise formats only the worker decodes
+func DetectFormat(head []byte) Format {
+	switch {
+	case bytes.HasPrefix(head, []byte{0xFF, 0xD8, 0xFF}):
+		return FormatJPEG
+	case bytes.HasPrefix(head, []byte("\x89PNG\r\n\x1a\n")):
+		return FormatPNG
+	case bytes.HasPrefix(head, []byte("GIF87a")), bytes.HasPrefix(head, []byte("GIF89a")):
+		return FormatGIF
+	case len(head) >= 12 && string(head[:4]) == "RIFF" && string(head[8:12]) == "WEBP":
+		return FormatWebP
+	}
+	return detectISOBMFF(head)
+}
+
+// detectISOBMFF inspects the ftyp box shared by HEIF and AVIF files. The
+// compatible brands are checked too since many encoders use "mif1" as the
+// major brand for AVIF
+func detectISOBMFF(head []byte) Format {
+	if len(head) < 16 || string(head[4:8]) != "ftyp" {
+		return FormatUnknown
+	}
+
+	size := int(binary.BigEndian.Uint32(head[:4]))
+	if size < 16 || size > len(head) {
+		size = len(head)
+	}
+
+	brands := []string{string(head[8:12])}
+	for i := 16; i+4 <= size; i += 4 {
+		brands = append(brands, string(head[i:i+4]))
+	}
+
+	for _, brand := range brands {
+		if brand == "avif" || brand == "avis" {
+			return FormatAVIF
+		}
+	}
+	for _, brand := range brands {
+		for _, heif := range heifBrands {
+			if brand == heif {
+				return FormatHEIF
+			}
+		}
+	}
+	return FormatUnknown
+}
+
+// MimeType returns the MIME type of the format
+func (f Format) MimeType() string {
+	if f == FormatUnknown {
+		return "application/octet-stream"
+	}
+	return "image/" + string(f)
+}
+
+// ParseOutputFormat validates a configured output format name
+func ParseOutputFormat(name string) (Format, error) {
+	format := Format(strings.ToLower(name))
+	if format == "jpg" {
+		format = FormatJPEG
+	}
+	for _, output := range outputFormats {
+		if format == output {
+			return format, nil
+		}
+	}
+	return FormatUnknown, fmt.Errorf("unsupported output format: %s", name)
+}
+
+// Capability reports whether the linked libvips can decode and encode a format
+type Capability struct {
+	Format Format
+	Load   bool
+	Save   bool
+}
+
+// Capabilities reports the codecs available in the linked libvips
+func Capabilities() []Capability {
+	formats := []Format{FormatJPEG, FormatPNG, FormatGIF, FormatWebP, FormatHEIF, FormatAVIF}
+	capabilities := make([]Capability, 0, len(formats))
+	for _, format := range formats {
+		supported := bimg.IsImageTypeSupportedByVips(formatTypes[format])
+		capabilities = append(capabilities, Capability{
+			Format: format,
+			Load:   supported.Load,
+			Save:   supported.Save,
+		})
+	}
+	return capabilities
+}
+
+// CapabilityReport describes the available codecs in a single log line
+func CapabilityReport() string {
+	parts := make([]string, 0, len(formatTypes))
+	for _, capability := range Capabilities() {
+		var modes []string
+		if capability.Load {
+			modes = append(modes, "load")
+		}
+		if capability.Save {
+			modes = append(modes, "save")
+		}
+		if len(modes) == 0 {
+			modes = append(modes, "unavailable")
+		}
+		parts = append(parts, fmt.Sprintf("%s=%s", capability.Format, strings.Join(modes, "+")))
+	}
+	return fmt.Sprintf("libvips %s codecs: %s", bimg.VipsVersion, strings.Join(parts, " "))
+}
+
+// CanLoad reports whether the linked libvips can decode the format
+func CanLoad(format Format) bool {
+	imageType, ok := formatTypes[format]
+	return ok && bimg.IsImageTypeSupportedByVips(imageType).Load
+}
+
+// CanSave reports whether the linked libvips can encode the format
+func CanSave(format Format) bool {
+	imageType, ok := formatTypes[format]
+	return ok && bimg.IsImageTypeSupportedByVips(imageType).Save
+}
+
+// probeImage is a 1x1 grayscale PNG
+var probeImage = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDR\x00\x00\x00\x01\x00\x00\x00\x01\x08\x00\x00\x00\x00\x3a\x7e\x9b\x55" +
+	"\x00\x00\x00\x0aIDAT\x78\x9c\x63\x60\x00\x00\x00\x02\x00\x01\x48\xaf\xa4\x71\x00\x00\x00\x00IEND\xae\x42\x60\x82")
+
+// CheckVips makes sure the linked libvips still decodes images
+func CheckVips() error {
+	if _, err := bimg.NewImage(probeImage).Size(); err != nil {
+		return fmt.Errorf("failed to decode probe image: %w", err)
+	}
+	return nil
+}
+
+// VipsVersion returns the version of the linked libvips
+func VipsVersion() string {
+	return bimg.VipsVersion
+}
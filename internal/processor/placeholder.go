@@ -0,0 +1,128 @@
+package processor
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/png"
+	"img-resizer/internal/models"
+
+	"github.com/h2non/bimg"
+)
+
+// Placeholder sizes
+const (
+	blurHashXComponents = 4
+	blurHashYComponents = 3
+	lqipSize            = 16
+	lqipQuality         = 40
+)
+
+// GeneratePlaceholders computes the low-quality placeholders shown while the
+// real image loads. Animations use their first frame
+func (p *Processor) GeneratePlaceholders(original []byte) (*models.Placeholders, error) {
+	size, err := orientedSize(original)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read image size: %w", err)
+	}
+
+	// A thumbnail that fits ThumbHash's 100x100 limit is enough for every hash
+	thumb, err := bimg.NewImage(original).Process(fitOptions(size, thumbHashMaxSize, bimg.Options{Type: bimg.PNG}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create thumbnail: %w", err)
+	}
+	decoded, err := png.Decode(bytes.NewReader(thumb))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode thumbnail: %w", err)
+	}
+	pixels := toNRGBA(decoded)
+
+	hash, err := thumbHash(pixels)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute thumbhash: %w", err)
+	}
+
+	lqip, err := bimg.NewImage(original).Process(fitOptions(size, lqipSize, bimg.Options{
+		Type:          bimg.JPEG,
+		Quality:       lqipQuality,
+		StripMetadata: true,
+	}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create lqip: %w", err)
+	}
+
+	return &models.Placeholders{
+		BlurHash:      blurHash(pixels, blurHashXComponents, blurHashYComponents),
+		ThumbHash:     base64.StdEncoding.EncodeToString(hash),
+		DominantColor: dominantColor(pixels),
+		LQIP:          "data:image/jpeg;base64," + base64.StdEncoding.EncodeToString(lqip),
+	}, nil
+}
+
+// fitOptions scales the longest side of an image of the given size down to
+// limit. Images that already fit keep their size
+func fitOptions(size bimg.ImageSize, limit int, options bimg.Options) bimg.Options {
+	if size.Width <= limit && size.Height <= limit {
+		return options
+	}
+	if size.Width >= size.Height {
+		options.Width = limit
+	} else {
+		options.Height = limit
+	}
+	return options
+}
+
+// toNRGBA converts any image to non-premultiplied RGBA
+func toNRGBA(img image.Image) *image.NRGBA {
+	if nrgba, ok := img.(*image.NRGBA); ok {
+		return nrgba
+	}
+	bounds := img.Bounds()
+	nrgba := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(nrgba, nrgba.Rect, img, bounds.Min, draw.Src)
+	return nrgba
+}
+
+// dominantColor returns the average color of the most common color bucket
+// as a CSS hex color. Transparent pixels are ignored
+func dominantColor(img *image.NRGBA) string {
+	type bucket struct {
+		count   int
+		r, g, b int
+	}
+	buckets := make(map[int]*bucket)
+	var best *bucket
+
+	for y := img.Rect.Min.Y; y < img.Rect.Max.Y; y++ {
+		for x := img.Rect.Min.X; x < img.Rect.Max.X; x++ {
+			p := img.PixOffset(x, y)
+			r, g, b, a := int(img.Pix[p]), int(img.Pix[p+1]), int(img.Pix[p+2]), img.Pix[p+3]
+			if a < 128 {
+				continue
+			}
+
+			// 4 bits per channel groups similar shades together
+			key := (r>>4)<<8 | (g>>4)<<4 | b>>4
+			bk, ok := buckets[key]
+			if !ok {
+				bk = &bucket{}
+				buckets[key] = bk
+			}
+			bk.count++
+			bk.r += r
+			bk.g += g
+			bk.b += b
+			if best == nil || bk.count > best.count {
+				best = bk
+			}
+		}
+	}
+
+	if best == nil {
+		return "#000000"
+	}
+	return fmt.Sprintf("#%02x%02x%02x", best.r/best.count, best.g/best.count, best.b/best.count)
+}
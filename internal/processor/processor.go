@@ -2,71 +2,271 @@ package processor
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"img-resizer/internal/models"
 	"io"
+	"os"
+	"time"
 
 	"github.com/h2non/bimg"
 )
 
+// ErrInputTooLarge is returned by ReadAll for inputs over the configured size
+var ErrInputTooLarge = errors.New("input exceeds the maximum size")
+
+// Preset describes how a single variant is produced
+type Preset struct {
+	Name      models.ImageQuality
+	Quality   int
+	Width     int
+	Format    Format
+	Watermark bool
+
+	TargetSSIM float64
+	MaxBytes   int
+}
+
+// Variant is a processed image together with how it was encoded
+type Variant struct {
+	Data    []byte
+	Format  Format
+	Width   int
+	Height  int
+	Quality int     // encoder quality, 0 for the original and GIF animations
+	SSIM    float64 // similarity to the reference, 0 when not measured
+	// OverMaxBytes is set when no searched quality fit the MaxBytes of the
+	// preset and Data is larger
+	OverMaxBytes bool
+
+	Duration time.Duration // time spent producing the variant
+}
+
+// Stage is an optional processing step applied to every preset before the
+// variant is encoded. Stages adjust the encoding options in place so that
+// each variant is still encoded only once
+type Stage interface {
+	Apply(options *bimg.Options, size bimg.ImageSize, preset Preset) error
+}
+
+// Option configures a Processor
+type Option func(*Processor)
+
+// WithPresets replaces the default presets
+func WithPresets(presets []Preset) Option {
+	return func(p *Processor) {
+		p.presets = presets
+	}
+}
+
+// WithStage appends a processing stage
+func WithStage(stage Stage) Option {
+	return func(p *Processor) {
+		p.stages = append(p.stages, stage)
+	}
+}
+
+// WithAnimation sets the frame limit for animated inputs and whether
+// animated GIFs are converted to animated WebP
+func WithAnimation(maxFrames int, toWebP bool) Option {
+	return func(p *Processor) {
+		p.maxFrames = maxFrames
+		p.animatedToWebP = toWebP
+	}
+}
+
+// WithMaxInputSize limits how many bytes ReadAll accepts
+func WithMaxInputSize(n int64) Option {
+	return func(p *Processor) {
+		p.maxInputSize = n
+	}
+}
+
 // Processor handles image processing
-type Processor struct{}
+type Processor struct {
+	presets        []Preset
+	stages         []Stage
+	maxFrames      int
+	animatedToWebP bool
+	maxInputSize   int64
+}
 
 // NewProcessor creates a new image processor
-func NewProcessor() *Processor {
-	return &Processor{}
+func NewProcessor(opts ...Option) *Processor {
+	p := &Processor{
+		presets:   DefaultPresets(),
+		maxFrames: defaultMaxFrames,
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
+}
+
+// With returns a copy of the processor with opts applied, such as the
+// presets of a tenant
+func (p *Processor) With(opts ...Option) *Processor {
+	clone := *p
+	clone.stages = append([]Stage(nil), p.stages...)
+	for _, opt := range opts {
+		opt(&clone)
+	}
+	return &clone
+}
+
+// DefaultPresets returns the built-in quality presets
+func DefaultPresets() []Preset {
+	return []Preset{
+		{Name: models.QualityHigh, Quality: 75, Format: FormatJPEG},
+		{Name: models.QualityMedium, Quality: 50, Format: FormatJPEG},
+		{Name: models.QualityLow, Quality: 25, Format: FormatJPEG},
+	}
+}
+
+// PresetsFromConfig converts configured presets to processor presets
+func PresetsFromConfig(presets []models.Preset) ([]Preset, error) {
+	result := make([]Preset, 0, len(presets))
+	for _, preset := range presets {
+		format, err := ParseOutputFormat(preset.Format)
+		if err != nil {
+			return nil, fmt.Errorf("preset %s: %w", preset.Name, err)
+		}
+		result = append(result, Preset{
+			Name:      models.ImageQuality(preset.Name),
+			Quality:   preset.Quality,
+			Width:     preset.Width,
+			Format:    format,
+			Watermark: preset.Watermark,
+
+			TargetSSIM: preset.TargetSSIM,
+			MaxBytes:   preset.MaxBytes,
+		})
+	}
+	return result, nil
+}
+
+// Presets returns the presets the processor produces
+func (p *Processor) Presets() []Preset {
+	return p.presets
 }
 
 // ProcessImage processes an image and returns different quality variants
-func (p *Processor) ProcessImage(original []byte) (map[models.ImageQuality][]byte, error) {
-	// Check if the image is valid
-	if !bimg.IsTypeSupported(bimg.DetermineImageType(original)) {
+func (p *Processor) ProcessImage(original []byte) (map[models.ImageQuality]*Variant, error) {
+	// Check if the image is valid and the linked libvips can decode it
+	format := DetectFormat(original)
+	if format == FormatUnknown {
 		return nil, fmt.Errorf("unsupported image type")
 	}
+	if !CanLoad(format) {
+		return nil, fmt.Errorf("unsupported image type: libvips was built without %s support", format)
+	}
+
+	// Animated images keep all of their frames
+	animated, err := p.isAnimated(original, format)
+	if err != nil {
+		return nil, err
+	}
+	if animated {
+		return p.processAnimated(original, format)
+	}
+
+	size, err := orientedSize(original)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read image size: %w", err)
+	}
 
 	// Create a map to store different quality variants
-	variants := make(map[models.ImageQuality][]byte)
+	variants := make(map[models.ImageQuality]*Variant)
 
 	// Store the original image
-	variants[models.QualityOriginal] = original
-
-	// Process image with different quality levels
-	qualities := []models.ImageQuality{
-		models.QualityHigh,
-		models.QualityMedium,
-		models.QualityLow,
-	}
-
-	for _, quality := range qualities {
-		// Convert quality string to int
-		var qualityInt int
-		switch quality {
-		case models.QualityHigh:
-			qualityInt = 75
-		case models.QualityMedium:
-			qualityInt = 50
-		case models.QualityLow:
-			qualityInt = 25
-		default:
-			continue
+	variants[models.QualityOriginal] = &Variant{
+		Data:   original,
+		Format: format,
+		Width:  size.Width,
+		Height: size.Height,
+	}
+
+	// Process image with every preset
+	for _, preset := range p.presets {
+		variant, err := p.processPreset(original, size, preset)
+		if err != nil {
+			return nil, err
 		}
+		variants[preset.Name] = variant
+	}
+
+	return variants, nil
+}
+
+// processPreset encodes a still image of the given size for one preset,
+// applying the stages, the target quality search and the size cap
+func (p *Processor) processPreset(original []byte, size bimg.ImageSize, preset Preset) (*Variant, error) {
+	start := time.Now()
+
+	// Create options for processing
+	options := bimg.Options{
+		Quality: preset.Quality,
+		Type:    formatTypes[preset.Format],
+	}
+
+	outSize := size
+	if preset.Width > 0 && preset.Width < size.Width {
+		options.Width = preset.Width
+		outSize = bimg.ImageSize{
+			Width:  preset.Width,
+			Height: size.Height * preset.Width / size.Width,
+		}
+	}
 
-		// Create options for processing
-		options := bimg.Options{
-			Quality: qualityInt,
-			Type:    bimg.JPEG,
+	for _, stage := range p.stages {
+		if err := stage.Apply(&options, outSize, preset); err != nil {
+			return nil, fmt.Errorf("failed to apply stage to quality %s: %w", preset.Name, err)
 		}
+	}
+
+	variant := &Variant{
+		Format:  preset.Format,
+		Width:   outSize.Width,
+		Height:  outSize.Height,
+		Quality: preset.Quality,
+	}
 
-		// Process image
+	// Process image, searching for the encoder quality if a target is set
+	if preset.TargetSSIM > 0 {
+		result, err := encodeToTarget(original, options, preset)
+		if err != nil {
+			return nil, fmt.Errorf("failed to reach target quality %s: %w", preset.Name, err)
+		}
+		variant.Data = result.data
+		variant.Quality = result.quality
+		variant.SSIM = result.ssim
+		variant.OverMaxBytes = result.overMaxBytes
+	} else {
 		processed, err := bimg.NewImage(original).Process(options)
 		if err != nil {
-			return nil, fmt.Errorf("failed to process image with quality %s: %w", quality, err)
+			return nil, fmt.Errorf("failed to process image with quality %s: %w", preset.Name, err)
 		}
+		variant.Data = processed
+	}
+	variant.Duration = time.Since(start)
+
+	return variant, nil
+}
 
-		variants[quality] = processed
+// orientedSize returns the image size after EXIF auto-rotation, which is
+// the size bimg produces by default
+func orientedSize(data []byte) (bimg.ImageSize, error) {
+	metadata, err := bimg.NewImage(data).Metadata()
+	if err != nil {
+		return bimg.ImageSize{}, err
 	}
 
-	return variants, nil
+	size := metadata.Size
+	// Orientations 5-8 are rotated by 90 degrees
+	if metadata.Orientation >= 5 {
+		size.Width, size.Height = size.Height, size.Width
+	}
+	return size, nil
 }
 
 // GetImageInfo returns information about an image
@@ -74,9 +274,36 @@ func (p *Processor) GetImageInfo(data []byte) (bimg.ImageSize, error) {
 	return bimg.NewImage(data).Size()
 }
 
-// ReadAll reads all data from a reader
+// VipsMemory returns the bytes libvips has allocated, their high-water mark
+// and the number of allocations
+func VipsMemory() (memory, highwater, allocations int64) {
+	info := bimg.VipsMemory()
+	return info.Memory, info.MemoryHighwater, info.Allocations
+}
+
+// ReadAll reads all data from a reader, at most the configured input size.
+// When the reader knows its size the buffer is allocated once
 func (p *Processor) ReadAll(reader io.Reader) ([]byte, error) {
-	return io.ReadAll(reader)
+	if p.maxInputSize <= 0 {
+		return io.ReadAll(reader)
+	}
+
+	var buf bytes.Buffer
+	if stat, ok := reader.(interface{ Stat() (os.FileInfo, error) }); ok {
+		if info, err := stat.Stat(); err == nil && info.Size() <= p.maxInputSize {
+			buf.Grow(int(info.Size()) + bytes.MinRead)
+		}
+	}
+
+	// Read one byte past the limit to tell a full-size input from a larger one
+	n, err := buf.ReadFrom(io.LimitReader(reader, p.maxInputSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if n > p.maxInputSize {
+		return nil, ErrInputTooLarge
+	}
+	return buf.Bytes(), nil
 }
 
 // CreateReader creates a reader from a byte slice
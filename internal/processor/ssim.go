@@ -0,0 +1,112 @@
+package processor
+
+import (
+	"fmt"
+	"image"
+	"math"
+)
+
+// ssimWindow and ssimStride define the sliding window SSIM is averaged over
+const (
+	ssimWindow = 8
+	ssimStride = 4
+)
+
+// SSIM stabilisation constants for 8-bit values
+var (
+	ssimC1 = math.Pow(0.01*255, 2)
+	ssimC2 = math.Pow(0.03*255, 2)
+)
+
+// lumaPlane is a grayscale copy of an image used for similarity scoring
+type lumaPlane struct {
+	width  int
+	height int
+	pix    []float64
+}
+
+// newLumaPlane converts an image to BT.601 luma in the 0..255 range
+func newLumaPlane(img image.Image) *lumaPlane {
+	bounds := img.Bounds()
+	plane := &lumaPlane{
+		width:  bounds.Dx(),
+		height: bounds.Dy(),
+		pix:    make([]float64, bounds.Dx()*bounds.Dy()),
+	}
+
+	i := 0
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			var r, g, b uint32
+			switch src := img.(type) {
+			case *image.NRGBA:
+				p := src.PixOffset(x, y)
+				r, g, b = uint32(src.Pix[p])*0x101, uint32(src.Pix[p+1])*0x101, uint32(src.Pix[p+2])*0x101
+			case *image.RGBA:
+				p := src.PixOffset(x, y)
+				r, g, b = uint32(src.Pix[p])*0x101, uint32(src.Pix[p+1])*0x101, uint32(src.Pix[p+2])*0x101
+			case *image.Gray:
+				v := uint32(src.Pix[src.PixOffset(x, y)]) * 0x101
+				r, g, b = v, v, v
+			default:
+				r, g, b, _ = img.At(x, y).RGBA()
+			}
+			plane.pix[i] = (0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)) / 257
+			i++
+		}
+	}
+	return plane
+}
+
+// ssim returns the mean structural similarity of two equally sized planes
+func ssim(a, b *lumaPlane) (float64, error) {
+	if a.width != b.width || a.height != b.height {
+		return 0, fmt.Errorf("cannot compare %dx%d to %dx%d", a.width, a.height, b.width, b.height)
+	}
+
+	window := ssimWindow
+	if a.width < window || a.height < window {
+		window = min(a.width, a.height)
+	}
+	if window == 0 {
+		return 1, nil
+	}
+
+	var total float64
+	var count int
+	for y := 0; y+window <= a.height; y += ssimStride {
+		for x := 0; x+window <= a.width; x += ssimStride {
+			total += windowSSIM(a, b, x, y, window)
+			count++
+		}
+	}
+	if count == 0 {
+		return windowSSIM(a, b, 0, 0, window), nil
+	}
+	return total / float64(count), nil
+}
+
+// windowSSIM computes SSIM over a single square window
+func windowSSIM(a, b *lumaPlane, x0, y0, window int) float64 {
+	var sumA, sumB, sumAA, sumBB, sumAB float64
+	for y := y0; y < y0+window; y++ {
+		row := y * a.width
+		for x := x0; x < x0+window; x++ {
+			va, vb := a.pix[row+x], b.pix[row+x]
+			sumA += va
+			sumB += vb
+			sumAA += va * va
+			sumBB += vb * vb
+			sumAB += va * vb
+		}
+	}
+
+	n := float64(window * window)
+	meanA, meanB := sumA/n, sumB/n
+	varA := sumAA/n - meanA*meanA
+	varB := sumBB/n - meanB*meanB
+	cov := sumAB/n - meanA*meanB
+
+	return ((2*meanA*meanB + ssimC1) * (2*cov + ssimC2)) /
+		((meanA*meanA + meanB*meanB + ssimC1) * (varA + varB + ssimC2))
+}
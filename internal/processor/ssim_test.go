@@ -0,0 +1,121 @@
+package processor
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// grayImage builds a grayscale image from a function of the coordinates
+func grayImage(width, height int, value func(x, y int) uint8) *image.Gray {
+	img := image.NewGray(image.Rect(0, 0, width, height))
+	for y := range height {
+		for x := range width {
+			img.SetGray(x, y, color.Gray{Y: value(x, y)})
+		}
+	}
+	return img
+}
+
+// gradient is a smooth test pattern with some structure in every window
+func gradient(x, y int) uint8 {
+	return uint8((x*7 + y*3 + (x*y)%13) % 256)
+}
+
+// noisy adds uniform noise of up to amplitude to the gradient
+func noisy(amplitude int) func(x, y int) uint8 {
+	rng := rand.New(rand.NewSource(1))
+	return func(x, y int) uint8 {
+		v := int(gradient(x, y)) + rng.Intn(2*amplitude+1) - amplitude
+		return uint8(max(0, min(255, v)))
+	}
+}
+
+func checkerboard(x, y int) uint8 {
+	if (x+y)%2 == 0 {
+		return 255
+	}
+	return 0
+}
+
+func TestSSIM(t *testing.T) {
+	uniform := func(v uint8) func(x, y int) uint8 {
+		return func(int, int) uint8 { return v }
+	}
+
+	tests := []struct {
+		name   string
+		width  int
+		height int
+		a, b   func(x, y int) uint8
+		want   float64
+	}{
+		{name: "identical", width: 64, height: 48, a: gradient, b: gradient, want: 1},
+		{name: "identical smaller than the window", width: 5, height: 3, a: gradient, b: gradient, want: 1},
+		// Without variance only the luminance term remains:
+		// (2*100*110 + C1) / (100² + 110² + C1)
+		{name: "brightened", width: 32, height: 32, a: uniform(100), b: uniform(110), want: (22000 + ssimC1) / (22100 + ssimC1)},
+		// Equal means and variances with the covariance negated:
+		// (C2 - 2*127.5²) / (C2 + 2*127.5²)
+		{name: "inverted", width: 32, height: 32, a: checkerboard, b: func(x, y int) uint8 { return 255 - checkerboard(x, y) },
+			want: (ssimC2 - 2*127.5*127.5) / (ssimC2 + 2*127.5*127.5)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newLumaPlane(grayImage(tt.width, tt.height, tt.a))
+			b := newLumaPlane(grayImage(tt.width, tt.height, tt.b))
+			got, err := ssim(a, b)
+			if err != nil {
+				t.Fatalf("ssim: %v", err)
+			}
+			if math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("ssim = %.12f, want %.12f", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSSIMDegradation(t *testing.T) {
+	reference := newLumaPlane(grayImage(64, 64, gradient))
+
+	previous := 1.0
+	for _, amplitude := range []int{2, 8, 32, 96} {
+		score, err := ssim(reference, newLumaPlane(grayImage(64, 64, noisy(amplitude))))
+		if err != nil {
+			t.Fatalf("ssim: %v", err)
+		}
+		if score >= previous {
+			t.Errorf("ssim with noise of ±%d is %.4f, want below %.4f", amplitude, score, previous)
+		}
+		previous = score
+	}
+}
+
+func TestSSIMDimensionMismatch(t *testing.T) {
+	a := newLumaPlane(grayImage(64, 48, gradient))
+	for _, size := range []image.Point{{64, 47}, {63, 48}, {48, 64}} {
+		b := newLumaPlane(grayImage(size.X, size.Y, gradient))
+		if _, err := ssim(a, b); err == nil {
+			t.Errorf("ssim compared 64x48 to %dx%d", size.X, size.Y)
+		}
+	}
+}
+
+func TestLumaPlaneColorModels(t *testing.T) {
+	c := color.NRGBA{R: 200, G: 100, B: 50, A: 255}
+	want := 0.299*200 + 0.587*100 + 0.114*50
+
+	rgba := image.NewRGBA(image.Rect(0, 0, 1, 1))
+	rgba.Set(0, 0, c)
+	nrgba := image.NewNRGBA(image.Rect(0, 0, 1, 1))
+	nrgba.Set(0, 0, c)
+	paletted := image.NewPaletted(image.Rect(0, 0, 1, 1), color.Palette{c})
+
+	for _, img := range []image.Image{rgba, nrgba, paletted} {
+		if got := newLumaPlane(img).pix[0]; math.Abs(got-want) > 1e-9 {
+			t.Errorf("luma of %T is %f, want %f", img, got, want)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package processor
+
+import (
+	"bytes"
+	"fmt"
+	"image/png"
+
+	"github.com/h2non/bimg"
+)
+
+// The encoder quality range searched for a target SSIM
+const (
+	minSearchQuality = 20
+	maxSearchQuality = 95
+)
+
+// encoding is a candidate output produced while searching for a target
+type encoding struct {
+	data    []byte
+	quality int
+	ssim    float64
+	// overMaxBytes is set when even the lowest searched quality is larger
+	// than the size cap
+	overMaxBytes bool
+}
+
+// encodeToTarget binary-searches the encoder quality for the smallest output
+// whose SSIM against the lossless reference reaches preset.TargetSSIM. When
+// that output is larger than preset.MaxBytes, the highest quality that fits
+// the cap is used instead, or the lowest searched quality, marked as over
+// the cap, when none fits
+func encodeToTarget(original []byte, options bimg.Options, preset Preset) (*encoding, error) {
+	// The reference is the resized (and watermarked) image without lossy encoding
+	refOptions := options
+	refOptions.Type = bimg.PNG
+	refOptions.Quality = 0
+	refData, err := bimg.NewImage(original).Process(refOptions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create reference: %w", err)
+	}
+	reference, err := decodeLuma(refData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode reference: %w", err)
+	}
+
+	candidates := make(map[int]*encoding)
+	encode := func(quality int) (*encoding, error) {
+		if candidate, ok := candidates[quality]; ok {
+			return candidate, nil
+		}
+
+		candidateOptions := options
+		candidateOptions.Quality = quality
+		data, err := bimg.NewImage(original).Process(candidateOptions)
+		if err != nil {
+			return nil, err
+		}
+
+		decoded, err := bimg.NewImage(data).Process(bimg.Options{Type: bimg.PNG, NoAutoRotate: true})
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode candidate: %w", err)
+		}
+		plane, err := decodeLuma(decoded)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode candidate: %w", err)
+		}
+		score, err := ssim(reference, plane)
+		if err != nil {
+			return nil, fmt.Errorf("failed to score candidate: %w", err)
+		}
+
+		candidate := &encoding{data: data, quality: quality, ssim: score}
+		candidates[quality] = candidate
+		return candidate, nil
+	}
+
+	// Lowest quality reaching the target
+	best, err := encode(maxSearchQuality)
+	if err != nil {
+		return nil, err
+	}
+	lo, hi := minSearchQuality, maxSearchQuality-1
+	for lo <= hi {
+		mid := (lo + hi) / 2
+		candidate, err := encode(mid)
+		if err != nil {
+			return nil, err
+		}
+		if candidate.ssim >= preset.TargetSSIM {
+			best = candidate
+			hi = mid - 1
+		} else {
+			lo = mid + 1
+		}
+	}
+
+	if preset.MaxBytes <= 0 || len(best.data) <= preset.MaxBytes {
+		return best, nil
+	}
+
+	// Highest quality below the target that fits the size cap
+	return fitMaxBytes(minSearchQuality, best.quality-1, preset.MaxBytes, encode)
+}
+
+// fitMaxBytes returns the encoding with the highest quality from lo to hi
+// that fits maxBytes, assuming the size grows with the quality. When even
+// lo is larger, its encoding is returned marked as over the cap
+func fitMaxBytes(lo, hi, maxBytes int, encode func(quality int) (*encoding, error)) (*encoding, error) {
+	fit, err := encode(lo)
+	if err != nil {
+		return nil, err
+	}
+	if len(fit.data) > maxBytes {
+		over := *fit
+		over.overMaxBytes = true
+		return &over, nil
+	}
+	for lo++; lo <= hi; {
+		mid := (lo + hi) / 2
+		candidate, err := encode(mid)
+		if err != nil {
+			return nil, err
+		}
+		if len(candidate.data) <= maxBytes {
+			fit = candidate
+			lo = mid + 1
+		} else {
+			hi = mid - 1
+		}
+	}
+	return fit, nil
+}
+
+// decodeLuma decodes a PNG produced by libvips into a luma plane
+func decodeLuma(data []byte) (*lumaPlane, error) {
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return newLumaPlane(img), nil
+}
@@ -0,0 +1,172 @@
+package processor
+
+import (
+	"fmt"
+	"image"
+	"math"
+)
+
+// thumbHashMaxSize is the largest image dimension ThumbHash accepts
+const thumbHashMaxSize = 100
+
+// thumbHash encodes img (at most 100x100) as a ThumbHash.
+// Port of rgbaToThumbHash from https://github.com/evanw/thumbhash
+func thumbHash(img *image.NRGBA) ([]byte, error) {
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+	if w > thumbHashMaxSize || h > thumbHashMaxSize {
+		return nil, fmt.Errorf("%dx%d doesn't fit in %dx%d", w, h, thumbHashMaxSize, thumbHashMaxSize)
+	}
+	if w == 0 || h == 0 {
+		return nil, fmt.Errorf("empty image")
+	}
+
+	pixel := func(i int) (r, g, b, a float64) {
+		p := img.PixOffset(img.Rect.Min.X+i%w, img.Rect.Min.Y+i/w)
+		return float64(img.Pix[p]), float64(img.Pix[p+1]), float64(img.Pix[p+2]), float64(img.Pix[p+3])
+	}
+
+	// Determine the average color
+	var avgR, avgG, avgB, avgA float64
+	for i := 0; i < w*h; i++ {
+		r, g, b, a := pixel(i)
+		alpha := a / 255
+		avgR += alpha / 255 * r
+		avgG += alpha / 255 * g
+		avgB += alpha / 255 * b
+		avgA += alpha
+	}
+	if avgA > 0 {
+		avgR /= avgA
+		avgG /= avgA
+		avgB /= avgA
+	}
+
+	hasAlpha := avgA < float64(w*h)
+	lLimit := 7.0
+	if hasAlpha {
+		// Use fewer luminance bits if there's alpha
+		lLimit = 5
+	}
+	longest := float64(max(w, h))
+	lx := max(1, int(jsRound(lLimit*float64(w)/longest)))
+	ly := max(1, int(jsRound(lLimit*float64(h)/longest)))
+
+	// Convert the image from RGBA to LPQA (composite atop the average color)
+	l := make([]float64, w*h) // luminance
+	p := make([]float64, w*h) // yellow - blue
+	q := make([]float64, w*h) // red - green
+	a := make([]float64, w*h) // alpha
+	for i := 0; i < w*h; i++ {
+		pr, pg, pb, pa := pixel(i)
+		alpha := pa / 255
+		r := avgR*(1-alpha) + alpha/255*pr
+		g := avgG*(1-alpha) + alpha/255*pg
+		b := avgB*(1-alpha) + alpha/255*pb
+		l[i] = (r + g + b) / 3
+		p[i] = (r+g)/2 - b
+		q[i] = r - g
+		a[i] = alpha
+	}
+
+	// Encode using the DCT into DC (constant) and normalized AC (varying) terms
+	encodeChannel := func(channel []float64, nx, ny int) (dc float64, ac []float64, scale float64) {
+		fx := make([]float64, w)
+		for cy := 0; cy < ny; cy++ {
+			for cx := 0; cx*ny < nx*(ny-cy); cx++ {
+				f := 0.0
+				for x := 0; x < w; x++ {
+					fx[x] = math.Cos(math.Pi / float64(w) * float64(cx) * (float64(x) + 0.5))
+				}
+				for y := 0; y < h; y++ {
+					fy := math.Cos(math.Pi / float64(h) * float64(cy) * (float64(y) + 0.5))
+					for x := 0; x < w; x++ {
+						f += channel[x+y*w] * fx[x] * fy
+					}
+				}
+				f /= float64(w * h)
+				if cx > 0 || cy > 0 {
+					ac = append(ac, f)
+					scale = math.Max(scale, math.Abs(f))
+				} else {
+					dc = f
+				}
+			}
+		}
+		if scale > 0 {
+			for i := range ac {
+				ac[i] = 0.5 + 0.5/scale*ac[i]
+			}
+		}
+		return dc, ac, scale
+	}
+
+	lDC, lAC, lScale := encodeChannel(l, max(3, lx), max(3, ly))
+	pDC, pAC, pScale := encodeChannel(p, 3, 3)
+	qDC, qAC, qScale := encodeChannel(q, 3, 3)
+	var aDC, aScale float64
+	var aAC []float64
+	if hasAlpha {
+		aDC, aAC, aScale = encodeChannel(a, 5, 5)
+	}
+
+	// Write the constants
+	isLandscape := w > h
+	header24 := int(jsRound(63*lDC)) |
+		int(jsRound(31.5+31.5*pDC))<<6 |
+		int(jsRound(31.5+31.5*qDC))<<12 |
+		int(jsRound(31*lScale))<<18 |
+		boolToInt(hasAlpha)<<23
+	header16 := int(jsRound(63*pScale))<<3 |
+		int(jsRound(63*qScale))<<9 |
+		boolToInt(isLandscape)<<15
+	if isLandscape {
+		header16 |= ly
+	} else {
+		header16 |= lx
+	}
+
+	channels := [][]float64{lAC, pAC, qAC}
+	acStart := 5
+	if hasAlpha {
+		channels = append(channels, aAC)
+		acStart = 6
+	}
+	acCount := 0
+	for _, ac := range channels {
+		acCount += len(ac)
+	}
+
+	hash := make([]byte, acStart+(acCount+1)/2)
+	hash[0] = byte(header24)
+	hash[1] = byte(header24 >> 8)
+	hash[2] = byte(header24 >> 16)
+	hash[3] = byte(header16)
+	hash[4] = byte(header16 >> 8)
+	if hasAlpha {
+		hash[5] = byte(int(jsRound(15*aDC)) | int(jsRound(15*aScale))<<4)
+	}
+
+	// Write the varying factors
+	acIndex := 0
+	for _, ac := range channels {
+		for _, f := range ac {
+			hash[acStart+acIndex>>1] |= byte(int(jsRound(15*f)) << ((acIndex & 1) << 2))
+			acIndex++
+		}
+	}
+
+	return hash, nil
+}
+
+// jsRound rounds half up like JavaScript's Math.round, which the reference
+// implementation relies on
+func jsRound(v float64) float64 {
+	return math.Floor(v + 0.5)
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
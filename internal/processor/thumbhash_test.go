@@ -0,0 +1,53 @@
+package processor
+
+import (
+	"bytes"
+	"encoding/hex"
+	"image"
+	"testing"
+)
+
+func TestThumbHash(t *testing.T) {
+	tests := []struct {
+		width, height int
+		transparent   bool
+		want          string
+	}{
+		{width: 32, height: 24, want: "1ee8050d8600316522539743967c8766012a1d90a9"},
+		{width: 24, height: 32, want: "1ee8050d08003221524a746b8766777723041bb0aa"},
+		{width: 32, height: 24, transparent: true, want: "60e8810c840702131c5413887af372407e1b30321174445708"},
+		{width: 24, height: 32, transparent: true, want: "5ff8810c040753a7048883a467c7c0127f2820431365556708"},
+	}
+	for _, tt := range tests {
+		hash, err := thumbHash(testPixels(tt.width, tt.height, tt.transparent))
+		if err != nil {
+			t.Fatalf("thumbHash: %v", err)
+		}
+		if got := hex.EncodeToString(hash); got != tt.want {
+			t.Errorf("thumbHash of %dx%d (transparent %v) = %s, want %s", tt.width, tt.height, tt.transparent, got, tt.want)
+		}
+	}
+}
+
+func TestThumbHashOfSubImage(t *testing.T) {
+	sub, src := testSubImage(32, 24)
+	got, err := thumbHash(sub)
+	if err != nil {
+		t.Fatalf("thumbHash: %v", err)
+	}
+	want, err := thumbHash(src)
+	if err != nil {
+		t.Fatalf("thumbHash: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("thumbHash of sub-image = %x, want %x", got, want)
+	}
+}
+
+func TestThumbHashRejectsLargeImages(t *testing.T) {
+	for _, size := range []image.Point{{101, 10}, {10, 101}, {0, 10}} {
+		if _, err := thumbHash(image.NewNRGBA(image.Rect(0, 0, size.X, size.Y))); err == nil {
+			t.Errorf("thumbHash accepted %dx%d", size.X, size.Y)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package processor
+
+/*
+#cgo pkg-config: vips
+#include <stdlib.h>
+#include <vips/vips.h>
+
+// Variadic libvips calls cannot be made from Go directly
+
+static int frame_count(void *buf, size_t len, int *frames) {
+	VipsImage *image = vips_image_new_from_buffer(buf, len, "", "access", VIPS_ACCESS_SEQUENTIAL, NULL);
+	if (image == NULL) {
+		return -1;
+	}
+	*frames = vips_image_get_n_pages(image);
+	g_object_unref(image);
+	return 0;
+}
+
+// resize_animated shrinks every frame of an animation and encodes it as GIF
+// or WebP. The thumbnail is lazy and reads buf until it is saved, so both
+// happen within this call
+static int resize_animated(void *buf, size_t len, int width, int gif, int quality, void **out, size_t *out_len) {
+	VipsImage *image;
+	if (vips_thumbnail_buffer(buf, len, &image, width,
+		"height", VIPS_MAX_COORD,
+		"size", VIPS_SIZE_DOWN,
+		"option_string", "n=-1",
+		NULL) != 0) {
+		return -1;
+	}
+
+	int status;
+	if (gif) {
+#if (VIPS_MAJOR_VERSION > 8 || (VIPS_MAJOR_VERSION == 8 && VIPS_MINOR_VERSION >= 12))
+		status = vips_gifsave_buffer(image, out, out_len, NULL);
+#else
+		vips_error("resize_animated", "saving GIF needs libvips 8.12 or later");
+		status = -1;
+#endif
+	} else {
+		status = vips_webpsave_buffer(image, out, out_len, "Q", quality, NULL);
+	}
+	g_object_unref(image);
+	return status;
+}
+
+// render_text renders text in white on a transparent background and encodes
+// it as PNG. The text is escaped, libvips reads Pango markup
+static int render_text(const char *text, void **out, size_t *out_len) {
+	VipsImage *base = vips_image_new();
+	VipsImage **t = (VipsImage **) vips_object_local_array(VIPS_OBJECT(base), 4);
+	double white[] = {255, 255, 255};
+	char *escaped = g_markup_escape_text(text, -1);
+
+	int status = -1;
+	if (vips_text(&t[0], escaped, "font", "sans bold 64", NULL) == 0 &&
+		(t[1] = vips_image_new_from_image(t[0], white, 3)) != NULL &&
+		vips_bandjoin2(t[1], t[0], &t[2], NULL) == 0 &&
+		vips_copy(t[2], &t[3], "interpretation", VIPS_INTERPRETATION_sRGB, NULL) == 0) {
+		status = vips_pngsave_buffer(t[3], out, out_len, NULL);
+	}
+	g_free(escaped);
+	g_object_unref(base);
+	return status;
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"strings"
+	"unsafe"
+
+	"github.com/h2non/bimg"
+)
+
+// vipsFrameCount returns the number of frames (pages) in an image
+func vipsFrameCount(buf []byte) (int, error) {
+	if len(buf) == 0 {
+		return 0, errors.New("empty image")
+	}
+	defer C.vips_thread_shutdown()
+
+	var frames C.int
+	if C.frame_count(unsafe.Pointer(&buf[0]), C.size_t(len(buf)), &frames) != 0 {
+		return 0, vipsError()
+	}
+	return int(frames), nil
+}
+
+// vipsResizeAnimated shrinks every frame of an animation to width and
+// encodes it as outType, GIF or WebP. Frame delays and the loop count are
+// carried over by libvips. Saving GIF needs libvips 8.12, see CanSave
+func vipsResizeAnimated(buf []byte, width int, outType bimg.ImageType, quality int) ([]byte, error) {
+	if len(buf) == 0 {
+		return nil, errors.New("empty image")
+	}
+	defer C.vips_thread_shutdown()
+
+	var gif C.int
+	switch outType {
+	case bimg.GIF:
+		gif = 1
+	case bimg.WEBP:
+	default:
+		return nil, fmt.Errorf("unsupported animation output type: %s", bimg.ImageTypeName(outType))
+	}
+
+	var out unsafe.Pointer
+	var length C.size_t
+	status := C.resize_animated(unsafe.Pointer(&buf[0]), C.size_t(len(buf)), C.int(width), gif, C.int(quality), &out, &length)
+	runtime.KeepAlive(buf)
+	if status != 0 {
+		return nil, vipsError()
+	}
+	defer C.g_free(C.gpointer(out))
+
+	return C.GoBytes(out, C.int(length)), nil
+}
+
+// vipsRenderText renders a text label as a PNG with an alpha channel, the
+// text taking the opaque pixels
+func vipsRenderText(text string) ([]byte, error) {
+	defer C.vips_thread_shutdown()
+
+	ctext := C.CString(text)
+	defer C.free(unsafe.Pointer(ctext))
+
+	var out unsafe.Pointer
+	var length C.size_t
+	if C.render_text(ctext, &out, &length) != 0 {
+		return nil, vipsError()
+	}
+	defer C.g_free(C.gpointer(out))
+
+	return C.GoBytes(out, C.int(length)), nil
+}
+
+// vipsError returns and clears the libvips error buffer
+func vipsError() error {
+	message := strings.TrimSpace(C.GoString(C.vips_error_buffer()))
+	C.vips_error_clear()
+	return errors.New(message)
+}
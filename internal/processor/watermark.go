@@ -0,0 +1,153 @@
+package processor
+
+import (
+	"fmt"
+	"img-resizer/internal/config"
+	"os"
+
+	"github.com/h2non/bimg"
+)
+
+// Position is the corner or center a watermark is anchored to
+type Position string
+
+const (
+	PositionTopLeft     Position = "top-left"
+	PositionTopRight    Position = "top-right"
+	PositionBottomLeft  Position = "bottom-left"
+	PositionBottomRight Position = "bottom-right"
+	PositionCenter      Position = "center"
+)
+
+// Watermark composites a PNG logo or a text label on presets that ask for it.
+// The asset is loaded once and reused for every task. A text label is
+// rendered to an image, so it is placed and scaled like a logo
+type Watermark struct {
+	logo     []byte
+	logoSize bimg.ImageSize
+	position Position
+	margin   int
+	opacity  float32
+	scale    float64
+}
+
+// LoadWatermark reads the configured watermark asset
+func LoadWatermark(cfg config.WatermarkConfig) (*Watermark, error) {
+	position := Position(cfg.Position)
+	switch position {
+	case PositionTopLeft, PositionTopRight, PositionBottomLeft, PositionBottomRight, PositionCenter:
+	default:
+		return nil, fmt.Errorf("invalid watermark position: %s", cfg.Position)
+	}
+	if cfg.Opacity <= 0 || cfg.Opacity > 1 {
+		return nil, fmt.Errorf("watermark opacity must be in (0, 1], got %v", cfg.Opacity)
+	}
+	if cfg.Scale <= 0 || cfg.Scale > 1 {
+		return nil, fmt.Errorf("watermark scale must be in (0, 1], got %v", cfg.Scale)
+	}
+	if cfg.Margin < 0 {
+		return nil, fmt.Errorf("watermark margin must not be negative, got %d", cfg.Margin)
+	}
+
+	w := &Watermark{
+		position: position,
+		margin:   cfg.Margin,
+		opacity:  float32(cfg.Opacity),
+		scale:    cfg.Scale,
+	}
+
+	var logo []byte
+	switch {
+	case cfg.ImagePath != "":
+		data, err := os.ReadFile(cfg.ImagePath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read watermark image: %w", err)
+		}
+		if bimg.DetermineImageType(data) != bimg.PNG {
+			return nil, fmt.Errorf("watermark image must be a PNG: %s", cfg.ImagePath)
+		}
+		logo = data
+	case cfg.Text != "":
+		data, err := vipsRenderText(cfg.Text)
+		if err != nil {
+			return nil, fmt.Errorf("failed to render watermark text: %w", err)
+		}
+		logo = data
+	default:
+		return w, nil
+	}
+
+	size, err := bimg.NewImage(logo).Size()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read watermark image size: %w", err)
+	}
+	w.logo = logo
+	w.logoSize = size
+	return w, nil
+}
+
+// Apply adds the watermark to the encoding options of watermarked presets
+func (w *Watermark) Apply(options *bimg.Options, size bimg.ImageSize, preset Preset) error {
+	if !preset.Watermark || w.logo == nil {
+		return nil
+	}
+
+	width := int(float64(size.Width) * w.scale)
+	if width < 1 {
+		width = 1
+	}
+
+	// Keep the logo inside the image once margins are taken into account
+	height := w.logoSize.Height * width / w.logoSize.Width
+	maxWidth := size.Width - 2*w.margin
+	maxHeight := size.Height - 2*w.margin
+	if maxWidth < 1 || maxHeight < 1 {
+		return nil
+	}
+	if width > maxWidth {
+		height = height * maxWidth / width
+		width = maxWidth
+	}
+	if height > maxHeight {
+		width = width * maxHeight / height
+		height = maxHeight
+	}
+	if width < 1 || height < 1 {
+		return nil
+	}
+
+	logo, err := bimg.NewImage(w.logo).Process(bimg.Options{
+		Width:  width,
+		Height: height,
+		Force:  true,
+		Type:   bimg.PNG,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to scale watermark: %w", err)
+	}
+
+	left, top := w.offset(size, width, height)
+	options.WatermarkImage = bimg.WatermarkImage{
+		Left:    left,
+		Top:     top,
+		Buf:     logo,
+		Opacity: w.opacity,
+	}
+	return nil
+}
+
+// offset returns the top-left corner of a watermark of the given size
+func (w *Watermark) offset(size bimg.ImageSize, width, height int) (int, int) {
+	switch w.position {
+	case PositionTopLeft:
+		return w.margin, w.margin
+	case PositionTopRight:
+		return size.Width - width - w.margin, w.margin
+	case PositionBottomLeft:
+		return w.margin, size.Height - height - w.margin
+	case PositionCenter:
+		return (size.Width - width) / 2, (size.Height - height) / 2
+	default:
+		return size.Width - width - w.margin, size.Height - height - w.margin
+	}
+}
@@ -3,28 +3,73 @@ package queue
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"img-resizer/internal/config"
+	"img-resizer/internal/logging"
+	"img-resizer/internal/metrics"
 	"img-resizer/internal/models"
-	"log"
+	"img-resizer/internal/tracing"
+	"log/slog"
+	"sync/atomic"
 	"time"
 
 	amqp "github.com/rabbitmq/amqp091-go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// Queue carries tasks from the API to the worker. The trace in the context
+// of PublishTask is continued in the context ConsumeTask hands to handler
 type Queue interface {
-	PublishTask(task *models.ImageProcessingTask) error
-	ConsumeTask(handler func(task *models.ImageProcessingTask) error) error
+	PublishTask(ctx context.Context, task *models.ImageProcessingTask) error
+	ConsumeTask(handler func(ctx context.Context, task *models.ImageProcessingTask) error) error
+	PublishEvent(event *models.ProgressEvent) error
+	SubscribeEvents(handler func(event *models.ProgressEvent)) error
+	Close() error
+}
+
+// Bounds of the wait before subscribing to progress events again
+const (
+	minEventsBackoff = time.Second
+	maxEventsBackoff = time.Minute
+)
+
+// attemptHeader counts the attempts at a task, it is set when a failed task
+// is published again
+const attemptHeader = "x-attempt"
+
+type finalAttemptKey struct{}
+
+// FinalAttempt reports whether a task failing in the handler given ctx by
+// ConsumeTask is given up rather than retried
+func FinalAttempt(ctx context.Context) bool {
+	final, ok := ctx.Value(finalAttemptKey{}).(bool)
+	return !ok || final
+}
+
+// amqpChannel is the part of *amqp.Channel the queue publishes and consumes
+// tasks with
+type amqpChannel interface {
+	PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+	Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error)
+	IsClosed() bool
 	Close() error
 }
 
 // RabbitMQ implements the Queue interface for RabbitMQ
 type RabbitMQ struct {
 	conn         *amqp.Connection
-	channel      *amqp.Channel
+	channel      amqpChannel
 	queueName    string
 	exchangeName string
 	routingKey   string
+	maxAttempts  int
+
+	eventsExchange   string
+	eventsSubscribed atomic.Bool
 }
 
 func NewRabbitMQ(cfg *config.Config) (*RabbitMQ, error) {
@@ -38,7 +83,7 @@ func NewRabbitMQ(cfg *config.Config) (*RabbitMQ, error) {
 	channel, err := conn.Channel()
 	if err != nil {
 		if cerr := conn.Close(); cerr != nil {
-			log.Printf("failed to close connection after channel error: %v", cerr)
+			slog.Warn("failed to close connection after channel error", "error", cerr)
 		}
 		return nil, fmt.Errorf("failed to open a channel: %w", err)
 	}
@@ -55,14 +100,34 @@ func NewRabbitMQ(cfg *config.Config) (*RabbitMQ, error) {
 	)
 	if err != nil {
 		if cerr := channel.Close(); cerr != nil {
-			log.Printf("failed to close channel after exchange error: %v", cerr)
+			slog.Warn("failed to close channel after exchange error", "error", cerr)
 		}
 		if cerr := conn.Close(); cerr != nil {
-			log.Printf("failed to close connection after exchange error: %v", cerr)
+			slog.Warn("failed to close connection after exchange error", "error", cerr)
 		}
 		return nil, fmt.Errorf("failed to declare an exchange: %w", err)
 	}
 
+	// Declare the fanout exchange for progress events
+	err = channel.ExchangeDeclare(
+		cfg.RabbitMQ.EventsExchange, // name
+		"fanout",                    // type
+		true,                        // durable
+		false,                       // auto-deleted
+		false,                       // internal
+		false,                       // no-wait
+		nil,                         // arguments
+	)
+	if err != nil {
+		if cerr := channel.Close(); cerr != nil {
+			slog.Warn("failed to close channel after exchange error", "error", cerr)
+		}
+		if cerr := conn.Close(); cerr != nil {
+			slog.Warn("failed to close connection after exchange error", "error", cerr)
+		}
+		return nil, fmt.Errorf("failed to declare the events exchange: %w", err)
+	}
+
 	// Declare a queue
 	_, err = channel.QueueDeclare(
 		cfg.RabbitMQ.QueueName, // name
@@ -74,10 +139,10 @@ func NewRabbitMQ(cfg *config.Config) (*RabbitMQ, error) {
 	)
 	if err != nil {
 		if cerr := channel.Close(); cerr != nil {
-			log.Printf("failed to close channel after queue declare error: %v", cerr)
+			slog.Warn("failed to close channel after queue declare error", "error", cerr)
 		}
 		if cerr := conn.Close(); cerr != nil {
-			log.Printf("failed to close connection after queue declare error: %v", cerr)
+			slog.Warn("failed to close connection after queue declare error", "error", cerr)
 		}
 		return nil, fmt.Errorf("failed to declare a queue: %w", err)
 	}
@@ -92,10 +157,10 @@ func NewRabbitMQ(cfg *config.Config) (*RabbitMQ, error) {
 	)
 	if err != nil {
 		if cerr := channel.Close(); cerr != nil {
-			log.Printf("failed to close channel after queue bind error: %v", cerr)
+			slog.Warn("failed to close channel after queue bind error", "error", cerr)
 		}
 		if cerr := conn.Close(); cerr != nil {
-			log.Printf("failed to close connection after queue bind error: %v", cerr)
+			slog.Warn("failed to close connection after queue bind error", "error", cerr)
 		}
 		return nil, fmt.Errorf("failed to bind a queue: %w", err)
 	}
@@ -106,41 +171,61 @@ func NewRabbitMQ(cfg *config.Config) (*RabbitMQ, error) {
 		queueName:    cfg.RabbitMQ.QueueName,
 		exchangeName: cfg.RabbitMQ.ExchangeName,
 		routingKey:   cfg.RabbitMQ.RoutingKey,
+		maxAttempts:  cfg.RabbitMQ.MaxAttempts,
+
+		eventsExchange: cfg.RabbitMQ.EventsExchange,
 	}, nil
 }
 
-func (r *RabbitMQ) PublishTask(task *models.ImageProcessingTask) error {
+func (r *RabbitMQ) PublishTask(ctx context.Context, task *models.ImageProcessingTask) (err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "publish "+r.exchangeName,
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(r.messagingAttributes(task)...),
+	)
+	defer func() { tracing.End(span, err) }()
+
 	// Convert task to JSON
 	body, err := json.Marshal(task)
 	if err != nil {
 		return fmt.Errorf("failed to marshal task: %w", err)
 	}
 
-	// Create a context with timeout
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	// The trace continues in the worker through the message headers
+	headers := amqp.Table{}
+	otel.GetTextMapPropagator().Inject(ctx, headerCarrier(headers))
+
+	// Create a context with timeout. A task accepted by the API is published
+	// even if its client disconnects meanwhile
+	publishCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
 	defer cancel()
 
 	// Publish the message
 	err = r.channel.PublishWithContext(
-		ctx,
+		publishCtx,
 		r.exchangeName, // exchange
 		r.routingKey,   // routing key
 		false,          // mandatory
 		false,          // immediate
 		amqp.Publishing{
+			Headers:      headers,
 			DeliveryMode: amqp.Persistent,
 			ContentType:  "application/json",
 			Body:         body,
 		},
 	)
 	if err != nil {
+		metrics.QueuePublishFailures.WithLabelValues("task").Inc()
 		return fmt.Errorf("failed to publish a message: %w", err)
 	}
 
 	return nil
 }
 
-func (r *RabbitMQ) ConsumeTask(handler func(task *models.ImageProcessingTask) error) error {
+// ConsumeTask hands every task to handler in a consumer span continuing the
+// trace of its publisher. A task the handler fails is published again until
+// it was attempted maxAttempts times, then it is rejected without requeueing,
+// which drops it or moves it to the dead letter exchange of the queue
+func (r *RabbitMQ) ConsumeTask(handler func(ctx context.Context, task *models.ImageProcessingTask) error) error {
 	// Start consuming messages
 	msgs, err := r.channel.Consume(
 		r.queueName, // queue
@@ -162,27 +247,265 @@ func (r *RabbitMQ) ConsumeTask(handler func(task *models.ImageProcessingTask) er
 		err := json.Unmarshal(msg.Body, &task)
 		if err != nil {
 			// Reject the message
+			slog.Error("failed to unmarshal task", "error", err)
 			if err := msg.Reject(true); err != nil {
-				log.Printf("failed to reject message: %v", err)
+				slog.Error("failed to reject message", "error", err)
 			}
 			continue
 		}
 
-		// Process the task
-		err = handler(&task)
+		// Process the task. Everything logged for it names the image and
+		// the attempt
+		attempt := deliveryAttempt(msg)
+		final := attempt >= r.maxAttempts
+		ctx := otel.GetTextMapPropagator().Extract(context.Background(), headerCarrier(msg.Headers))
+		ctx = context.WithValue(ctx, finalAttemptKey{}, final)
+		ctx = logging.With(ctx, slog.String("image_id", task.ID), slog.Int("attempt", attempt))
+		ctx, span := tracing.Tracer().Start(ctx, "process "+r.queueName,
+			trace.WithSpanKind(trace.SpanKindConsumer),
+			trace.WithAttributes(r.messagingAttributes(&task)...),
+			trace.WithAttributes(
+				attribute.Bool("messaging.rabbitmq.redelivered", msg.Redelivered),
+				attribute.Int("messaging.task.attempt", attempt),
+			),
+		)
+		err = handler(ctx, &task)
+		tracing.End(span, err)
 		if err != nil {
-			if err := msg.Reject(true); err != nil {
-				log.Printf("failed to reject message: %v", err)
+			if final {
+				slog.ErrorContext(ctx, "giving up on task", "max_attempts", r.maxAttempts, "error", err)
+				if err := msg.Reject(false); err != nil {
+					slog.ErrorContext(ctx, "failed to reject message", "error", err)
+				}
+				continue
+			}
+			// The task goes to the back of the queue with its attempt counted.
+			// The delivery is only dropped once the copy is queued
+			if err := r.retry(msg, attempt+1); err != nil {
+				slog.ErrorContext(ctx, "failed to requeue task, rejecting it", "error", err)
+				if err := msg.Reject(true); err != nil {
+					slog.ErrorContext(ctx, "failed to reject message", "error", err)
+				}
 			}
 			continue
 		}
 
 		// Acknowledge the message
 		if err := msg.Ack(false); err != nil {
-			log.Printf("failed to acknowledge message: %v", err)
+			slog.ErrorContext(ctx, "failed to acknowledge message", "error", err)
+		}
+	}
+
+	return nil
+}
+
+// retry publishes a failed task again as its given attempt and acknowledges
+// the failed delivery
+func (r *RabbitMQ) retry(msg amqp.Delivery, attempt int) error {
+	headers := amqp.Table{}
+	for key, value := range msg.Headers {
+		headers[key] = value
+	}
+	headers[attemptHeader] = int32(attempt)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := r.channel.PublishWithContext(
+		ctx,
+		r.exchangeName, // exchange
+		r.routingKey,   // routing key
+		false,          // mandatory
+		false,          // immediate
+		amqp.Publishing{
+			Headers:      headers,
+			DeliveryMode: amqp.Persistent,
+			ContentType:  msg.ContentType,
+			Body:         msg.Body,
+		},
+	)
+	if err != nil {
+		metrics.QueuePublishFailures.WithLabelValues("task").Inc()
+		return fmt.Errorf("failed to publish a message: %w", err)
+	}
+	return msg.Ack(false)
+}
+
+// deliveryAttempt returns the attempt a delivery is, 1 unless it was
+// published again by retry
+func deliveryAttempt(msg amqp.Delivery) int {
+	switch attempt := msg.Headers[attemptHeader].(type) {
+	case int32:
+		return int(attempt)
+	case int64:
+		return int(attempt)
+	case int:
+		return attempt
+	}
+	return 1
+}
+
+// PublishEvent broadcasts a progress event to every subscribed API instance.
+// Events are transient, nobody listening means they are dropped
+func (r *RabbitMQ) PublishEvent(event *models.ProgressEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal event: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err = r.channel.PublishWithContext(
+		ctx,
+		r.eventsExchange, // exchange
+		"",               // routing key, ignored by fanout exchanges
+		false,            // mandatory
+		false,            // immediate
+		amqp.Publishing{
+			DeliveryMode: amqp.Transient,
+			ContentType:  "application/json",
+			Body:         body,
+		},
+	)
+	if err != nil {
+		metrics.QueuePublishFailures.WithLabelValues("event").Inc()
+		return fmt.Errorf("failed to publish an event: %w", err)
+	}
+
+	return nil
+}
+
+// SubscribeEvents delivers progress events to handler until the connection
+// closes. Every subscriber gets its own exclusive queue, so each API
+// instance sees every event
+func (r *RabbitMQ) SubscribeEvents(handler func(event *models.ProgressEvent)) error {
+	// A separate channel keeps event deliveries from blocking publishing
+	channel, err := r.conn.Channel()
+	if err != nil {
+		return fmt.Errorf("failed to open a channel: %w", err)
+	}
+	defer func() {
+		if err := channel.Close(); err != nil && !errors.Is(err, amqp.ErrClosed) {
+			slog.Warn("failed to close events channel", "error", err)
 		}
+	}()
+
+	queue, err := channel.QueueDeclare(
+		"",    // name, generated by the server
+		false, // durable
+		true,  // delete when unused
+		true,  // exclusive
+		false, // no-wait
+		nil,   // arguments
+	)
+	if err != nil {
+		return fmt.Errorf("failed to declare the events queue: %w", err)
 	}
 
+	err = channel.QueueBind(
+		queue.Name,       // queue name
+		"",               // routing key
+		r.eventsExchange, // exchange
+		false,
+		nil,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to bind the events queue: %w", err)
+	}
+
+	msgs, err := channel.Consume(
+		queue.Name, // queue
+		"",         // consumer
+		true,       // auto-ack
+		true,       // exclusive
+		false,      // no-local
+		false,      // no-wait
+		nil,        // args
+	)
+	if err != nil {
+		return fmt.Errorf("failed to register an events consumer: %w", err)
+	}
+
+	r.eventsSubscribed.Store(true)
+	defer r.eventsSubscribed.Store(false)
+	for msg := range msgs {
+		var event models.ProgressEvent
+		if err := json.Unmarshal(msg.Body, &event); err != nil {
+			slog.Warn("failed to unmarshal event", "error", err)
+			continue
+		}
+		handler(&event)
+	}
+
+	return nil
+}
+
+// RelayEvents hands progress events to handler like SubscribeEvents, but
+// subscribes again with a growing backoff whenever the subscription fails
+// or ends, until the connection is closed
+func (r *RabbitMQ) RelayEvents(handler func(event *models.ProgressEvent)) {
+	backoff := minEventsBackoff
+	for !r.conn.IsClosed() {
+		started := time.Now()
+		err := r.SubscribeEvents(handler)
+		if r.conn.IsClosed() {
+			break
+		}
+		// A subscription that lasted starts over with a short backoff
+		if time.Since(started) > maxEventsBackoff {
+			backoff = minEventsBackoff
+		}
+		slog.Warn("progress events subscription ended, subscribing again", "backoff", backoff, "error", err)
+		time.Sleep(backoff)
+		backoff = min(backoff*2, maxEventsBackoff)
+	}
+	slog.Error("stopped relaying progress events, the connection to RabbitMQ is closed")
+}
+
+// EventsSubscribed reports whether progress events are being received
+func (r *RabbitMQ) EventsSubscribed() bool {
+	return r.eventsSubscribed.Load()
+}
+
+func (r *RabbitMQ) messagingAttributes(task *models.ImageProcessingTask) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		semconv.MessagingSystemRabbitmq,
+		semconv.MessagingDestinationName(r.exchangeName),
+		semconv.MessagingRabbitmqDestinationRoutingKey(r.routingKey),
+		attribute.String("image.id", task.ID),
+	}
+}
+
+// headerCarrier reads and writes trace context in AMQP message headers
+type headerCarrier amqp.Table
+
+func (c headerCarrier) Get(key string) string {
+	value, _ := c[key].(string)
+	return value
+}
+
+func (c headerCarrier) Set(key, value string) {
+	c[key] = value
+}
+
+func (c headerCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for key := range c {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// Check reports whether the connection and channel to RabbitMQ are open.
+// They are not reopened, a process whose connection closed must restart
+func (r *RabbitMQ) Check() error {
+	if r.conn.IsClosed() {
+		return errors.New("connection to RabbitMQ is closed")
+	}
+	if r.channel.IsClosed() {
+		return errors.New("channel to RabbitMQ is closed")
+	}
 	return nil
 }
 
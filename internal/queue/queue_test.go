@@ -0,0 +1,156 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"img-resizer/internal/config"
+	"img-resizer/internal/models"
+	"img-resizer/internal/tracing"
+	"slices"
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// fakeChannel delivers every published message to its consumer
+type fakeChannel struct {
+	deliveries chan amqp.Delivery
+	acked      int
+	rejected   []bool
+}
+
+func (f *fakeChannel) PublishWithContext(_ context.Context, exchange, key string, _, _ bool, msg amqp.Publishing) error {
+	f.deliveries <- amqp.Delivery{
+		Acknowledger: f,
+		Headers:      msg.Headers,
+		ContentType:  msg.ContentType,
+		Body:         msg.Body,
+		Exchange:     exchange,
+		RoutingKey:   key,
+	}
+	return nil
+}
+
+func (f *fakeChannel) Consume(string, string, bool, bool, bool, bool, amqp.Table) (<-chan amqp.Delivery, error) {
+	return f.deliveries, nil
+}
+
+func (f *fakeChannel) IsClosed() bool { return false }
+func (f *fakeChannel) Close() error   { return nil }
+
+func (f *fakeChannel) Ack(uint64, bool) error {
+	f.acked++
+	return nil
+}
+func (f *fakeChannel) Nack(uint64, bool, bool) error { return nil }
+
+// Reject records whether the message was requeued. A message rejected for
+// good ends the deliveries
+func (f *fakeChannel) Reject(_ uint64, requeue bool) error {
+	f.rejected = append(f.rejected, requeue)
+	if !requeue {
+		close(f.deliveries)
+	}
+	return nil
+}
+
+func TestTraceContinuesFromPublishToConsume(t *testing.T) {
+	if _, err := tracing.Setup(context.Background(), config.TracingConfig{}, "test"); err != nil {
+		t.Fatal(err)
+	}
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+
+	channel := &fakeChannel{deliveries: make(chan amqp.Delivery, 1)}
+	r := &RabbitMQ{channel: channel, queueName: "tasks", exchangeName: "images", routingKey: "process"}
+
+	ctx, request := tracing.Tracer().Start(context.Background(), "POST /api/images")
+	if err := r.PublishTask(ctx, &models.ImageProcessingTask{ID: "image-1"}); err != nil {
+		t.Fatalf("PublishTask: %v", err)
+	}
+	request.End()
+
+	msg := <-channel.deliveries
+	if traceparent, _ := msg.Headers["traceparent"].(string); traceparent == "" {
+		t.Fatalf("published headers %v carry no traceparent", msg.Headers)
+	}
+	channel.deliveries <- msg
+	close(channel.deliveries)
+
+	var handled trace.SpanContext
+	err := r.ConsumeTask(func(ctx context.Context, task *models.ImageProcessingTask) error {
+		handled = trace.SpanContextFromContext(ctx)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ConsumeTask: %v", err)
+	}
+	if channel.acked != 1 {
+		t.Errorf("acked %d messages, want 1", channel.acked)
+	}
+
+	spans := make(map[trace.SpanKind]tracetest.SpanStub)
+	for _, span := range exporter.GetSpans() {
+		spans[span.SpanKind] = span
+	}
+	publish, ok := spans[trace.SpanKindProducer]
+	if !ok {
+		t.Fatal("no producer span recorded")
+	}
+	process, ok := spans[trace.SpanKindConsumer]
+	if !ok {
+		t.Fatal("no consumer span recorded")
+	}
+
+	traceID := request.SpanContext().TraceID()
+	if publish.SpanContext.TraceID() != traceID || process.SpanContext.TraceID() != traceID {
+		t.Errorf("spans belong to traces %s and %s, want %s",
+			publish.SpanContext.TraceID(), process.SpanContext.TraceID(), traceID)
+	}
+	if publish.Parent.SpanID() != request.SpanContext().SpanID() {
+		t.Errorf("publish span is a child of %s, want the request span %s", publish.Parent.SpanID(), request.SpanContext().SpanID())
+	}
+	if process.Parent.SpanID() != publish.SpanContext.SpanID() {
+		t.Errorf("process span is a child of %s, want the publish span %s", process.Parent.SpanID(), publish.SpanContext.SpanID())
+	}
+	if !process.Parent.IsRemote() {
+		t.Error("process span parent was not extracted from the message headers")
+	}
+	if handled.SpanID() != process.SpanContext.SpanID() {
+		t.Errorf("handler ran in span %s, want the process span %s", handled.SpanID(), process.SpanContext.SpanID())
+	}
+}
+
+func TestFailedTaskIsRetriedUntilMaxAttempts(t *testing.T) {
+	channel := &fakeChannel{deliveries: make(chan amqp.Delivery, 1)}
+	r := &RabbitMQ{channel: channel, queueName: "tasks", exchangeName: "images", routingKey: "process", maxAttempts: 3}
+	if err := r.PublishTask(context.Background(), &models.ImageProcessingTask{ID: "image-1"}); err != nil {
+		t.Fatalf("PublishTask: %v", err)
+	}
+
+	var finals []bool
+	err := r.ConsumeTask(func(ctx context.Context, task *models.ImageProcessingTask) error {
+		finals = append(finals, FinalAttempt(ctx))
+		return errors.New("processing failed")
+	})
+	if err != nil {
+		t.Fatalf("ConsumeTask: %v", err)
+	}
+
+	if want := []bool{false, false, true}; !slices.Equal(finals, want) {
+		t.Errorf("handler saw final attempts %v, want %v", finals, want)
+	}
+	if channel.acked != 2 {
+		t.Errorf("acked %d retried deliveries, want 2", channel.acked)
+	}
+	if want := []bool{false}; !slices.Equal(channel.rejected, want) {
+		t.Errorf("rejected with requeue %v, want %v", channel.rejected, want)
+	}
+}
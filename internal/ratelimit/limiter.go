@@ -0,0 +1,50 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"img-resizer/internal/config"
+	"time"
+)
+
+// Rate is a token bucket: Burst requests at once, refilled at PerSecond
+type Rate struct {
+	PerSecond float64
+	Burst     int
+}
+
+// Result is the outcome of taking a token
+type Result struct {
+	Allowed    bool
+	Remaining  int           // whole tokens left in the bucket
+	RetryAfter time.Duration // until the next token, set when not allowed
+}
+
+// Limiter keeps one token bucket per key
+type Limiter interface {
+	// Allow takes a token from the bucket of key
+	Allow(ctx context.Context, key string) (Result, error)
+	Close() error
+}
+
+// NewLimiter creates the limiter for uploads based on configuration
+func NewLimiter(cfg config.RateLimitConfig) (Limiter, error) {
+	rate := Rate{PerSecond: cfg.UploadRate, Burst: cfg.UploadBurst}
+	if rate.PerSecond <= 0 || rate.Burst < 1 {
+		return nil, fmt.Errorf("invalid upload rate: %g per second with a burst of %d", rate.PerSecond, rate.Burst)
+	}
+
+	switch cfg.Backend {
+	case "memory":
+		return NewMemoryLimiter(rate), nil
+	case "redis":
+		return NewRedisLimiter(cfg.RedisURL, "ratelimit:upload:", rate)
+	default:
+		return nil, fmt.Errorf("unsupported rate limit backend: %s", cfg.Backend)
+	}
+}
+
+// retryAfter is how long until a bucket holding tokens has a whole token
+func retryAfter(tokens float64, rate Rate) time.Duration {
+	return time.Duration((1 - tokens) / rate.PerSecond * float64(time.Second))
+}
@@ -0,0 +1,104 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock tests move by hand
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func newTestLimiter(t *testing.T, rate Rate) (*MemoryLimiter, *fakeClock) {
+	t.Helper()
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	l := NewMemoryLimiter(rate)
+	l.now = clock.Now
+	l.lastSweep = clock.Now()
+	return l, clock
+}
+
+func allow(t *testing.T, l Limiter, key string) Result {
+	t.Helper()
+	result, err := l.Allow(context.Background(), key)
+	if err != nil {
+		t.Fatalf("Allow: %v", err)
+	}
+	return result
+}
+
+func TestMemoryLimiterBurst(t *testing.T) {
+	l, _ := newTestLimiter(t, Rate{PerSecond: 1, Burst: 3})
+
+	for want := 2; want >= 0; want-- {
+		result := allow(t, l, "a")
+		if !result.Allowed || result.Remaining != want {
+			t.Fatalf("got %+v, want allowed with %d remaining", result, want)
+		}
+	}
+	if result := allow(t, l, "a"); result.Allowed || result.RetryAfter != time.Second {
+		t.Errorf("got %+v once the burst was used, want refused for 1s", result)
+	}
+	// Every key has its own bucket
+	if result := allow(t, l, "b"); !result.Allowed || result.Remaining != 2 {
+		t.Errorf("got %+v for another key, want a full bucket", result)
+	}
+}
+
+func TestMemoryLimiterRefill(t *testing.T) {
+	l, clock := newTestLimiter(t, Rate{PerSecond: 2, Burst: 2})
+	allow(t, l, "a")
+	allow(t, l, "a")
+
+	tests := []struct {
+		name       string
+		advance    time.Duration
+		allowed    bool
+		remaining  int
+		retryAfter time.Duration
+	}{
+		{name: "empty", retryAfter: 500 * time.Millisecond},
+		{name: "part of a token", advance: 200 * time.Millisecond, retryAfter: 300 * time.Millisecond},
+		{name: "whole token", advance: 300 * time.Millisecond, allowed: true},
+		{name: "capped at the burst", advance: time.Hour, allowed: true, remaining: 1},
+		{name: "burst left after the cap", allowed: true},
+		{name: "empty again", retryAfter: 500 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		clock.Advance(tt.advance)
+		result := allow(t, l, "a")
+		want := Result{Allowed: tt.allowed, Remaining: tt.remaining, RetryAfter: tt.retryAfter}
+		if result != want {
+			t.Errorf("%s: got %+v, want %+v", tt.name, result, want)
+		}
+	}
+}
+
+func TestMemoryLimiterSweep(t *testing.T) {
+	l, clock := newTestLimiter(t, Rate{PerSecond: 1, Burst: 10})
+	allow(t, l, "refilled")
+
+	clock.Advance(sweepInterval - 2*time.Second)
+	for range 10 {
+		allow(t, l, "drained")
+	}
+
+	clock.Advance(3 * time.Second)
+	allow(t, l, "new")
+	if _, ok := l.buckets["refilled"]; ok {
+		t.Error("full bucket was not swept")
+	}
+	if _, ok := l.buckets["drained"]; !ok {
+		t.Error("bucket still refilling was swept")
+	}
+}
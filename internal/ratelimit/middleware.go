@@ -0,0 +1,80 @@
+package ratelimit
+
+import (
+	"img-resizer/internal/auth"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ClientKey identifies the client of a request by its API key or token
+// subject, falling back to its address for anonymous requests
+func ClientKey(c *gin.Context) string {
+	if key := auth.FromContext(c); key != nil {
+		return "key:" + key.TenantID + "/" + key.ID
+	}
+	return "ip:" + c.ClientIP()
+}
+
+// Limit rejects requests with 429 once their client has emptied its bucket
+func Limit(limiter Limiter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		result, err := limiter.Allow(c.Request.Context(), ClientKey(c))
+		if err != nil {
+			// An unreachable backend must not take uploads down with it
+			slog.WarnContext(c.Request.Context(), "failed to check rate limit, allowing request", "error", err)
+			c.Next()
+			return
+		}
+
+		c.Header("X-RateLimit-Remaining", strconv.Itoa(result.Remaining))
+		if !result.Allowed {
+			tooManyRequests(c, result.RetryAfter)
+			return
+		}
+		c.Next()
+	}
+}
+
+// LimitConcurrency rejects requests with 429 while their client already has
+// limit requests in flight on this instance
+func LimitConcurrency(limit int) gin.HandlerFunc {
+	var (
+		mu     sync.Mutex
+		active = make(map[string]int)
+	)
+
+	return func(c *gin.Context) {
+		key := ClientKey(c)
+
+		mu.Lock()
+		if active[key] >= limit {
+			mu.Unlock()
+			tooManyRequests(c, time.Second)
+			return
+		}
+		active[key]++
+		mu.Unlock()
+
+		defer func() {
+			mu.Lock()
+			defer mu.Unlock()
+			if active[key]--; active[key] == 0 {
+				delete(active, key)
+			}
+		}()
+		c.Next()
+	}
+}
+
+func tooManyRequests(c *gin.Context, retryAfter time.Duration) {
+	// Retry-After takes whole seconds, rounding down would invite an early retry
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	c.Header("Retry-After", strconv.Itoa(max(seconds, 1)))
+	c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "Too many requests, retry later"})
+}
@@ -0,0 +1,148 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// request serves a request from the client at addr
+func request(router http.Handler, addr string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/upload", nil)
+	req.RemoteAddr = addr
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+// failingLimiter stands for an unreachable backend
+type failingLimiter struct{}
+
+func (failingLimiter) Allow(context.Context, string) (Result, error) {
+	return Result{}, errors.New("connection refused")
+}
+
+func (failingLimiter) Close() error {
+	return nil
+}
+
+func TestLimit(t *testing.T) {
+	l, clock := newTestLimiter(t, Rate{PerSecond: 0.4, Burst: 2})
+	router := gin.New()
+	router.POST("/upload", Limit(l), func(c *gin.Context) {
+		c.Status(http.StatusCreated)
+	})
+
+	for _, remaining := range []string{"1", "0"} {
+		w := request(router, "192.0.2.1:1000")
+		if w.Code != http.StatusCreated || w.Header().Get("X-RateLimit-Remaining") != remaining {
+			t.Fatalf("got %d with %q remaining, want %d with %s", w.Code, w.Header().Get("X-RateLimit-Remaining"), http.StatusCreated, remaining)
+		}
+	}
+
+	w := request(router, "192.0.2.1:1000")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("got %d once the burst was used, want %d", w.Code, http.StatusTooManyRequests)
+	}
+	// 2.5s until the next token, rounded up
+	if got := w.Header().Get("Retry-After"); got != "3" {
+		t.Errorf("Retry-After is %q, want 3", got)
+	}
+	if !strings.Contains(w.Body.String(), `"error"`) {
+		t.Errorf("body %q is not an error", w.Body.String())
+	}
+
+	if w := request(router, "192.0.2.2:1000"); w.Code != http.StatusCreated {
+		t.Errorf("another client got %d, want %d", w.Code, http.StatusCreated)
+	}
+
+	clock.Advance(2500 * time.Millisecond)
+	if w := request(router, "192.0.2.1:1000"); w.Code != http.StatusCreated {
+		t.Errorf("got %d after the refill, want %d", w.Code, http.StatusCreated)
+	}
+}
+
+func TestLimitAllowsWhenBackendFails(t *testing.T) {
+	router := gin.New()
+	router.POST("/upload", Limit(failingLimiter{}), func(c *gin.Context) {
+		c.Status(http.StatusCreated)
+	})
+	if w := request(router, "192.0.2.1:1000"); w.Code != http.StatusCreated {
+		t.Errorf("got %d, want the request allowed", w.Code)
+	}
+}
+
+func TestLimitConcurrency(t *testing.T) {
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	router := gin.New()
+	router.POST("/upload", LimitConcurrency(1), func(c *gin.Context) {
+		if c.Query("block") != "" {
+			entered <- struct{}{}
+			<-release
+		}
+		c.Status(http.StatusCreated)
+	})
+
+	done := make(chan int)
+	go func() {
+		req := httptest.NewRequest(http.MethodPost, "/upload?block=1", nil)
+		req.RemoteAddr = "192.0.2.1:1000"
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		done <- w.Code
+	}()
+	<-entered
+
+	w := request(router, "192.0.2.1:1001")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "1" {
+		t.Errorf("got %d with Retry-After %q while the client has an upload in flight, want %d with 1",
+			w.Code, w.Header().Get("Retry-After"), http.StatusTooManyRequests)
+	}
+	if w := request(router, "192.0.2.2:1000"); w.Code != http.StatusCreated {
+		t.Errorf("another client got %d, want %d", w.Code, http.StatusCreated)
+	}
+
+	close(release)
+	if code := <-done; code != http.StatusCreated {
+		t.Errorf("blocked request got %d, want %d", code, http.StatusCreated)
+	}
+	// The finished request released its slot
+	if w := request(router, "192.0.2.1:1001"); w.Code != http.StatusCreated {
+		t.Errorf("got %d after the upload finished, want %d", w.Code, http.StatusCreated)
+	}
+}
+
+func TestRetryAfterRounding(t *testing.T) {
+	tests := []struct {
+		retryAfter time.Duration
+		want       string
+	}{
+		{retryAfter: 0, want: "1"},
+		{retryAfter: time.Millisecond, want: "1"},
+		{retryAfter: time.Second, want: "1"},
+		{retryAfter: time.Second + time.Millisecond, want: "2"},
+		{retryAfter: 2500 * time.Millisecond, want: "3"},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		tooManyRequests(c, tt.retryAfter)
+		if got := w.Header().Get("Retry-After"); got != tt.want {
+			t.Errorf("Retry-After for %s is %q, want %q", tt.retryAfter, got, tt.want)
+		}
+		if w.Code != http.StatusTooManyRequests {
+			t.Errorf("status is %d, want %d", w.Code, http.StatusTooManyRequests)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// takeToken refills and takes from a bucket atomically. The Redis clock is
+// used so instances with skewed clocks agree. Buckets expire once they
+// would be full again
+var takeToken = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local time = redis.call('TIME')
+local now = tonumber(time[1]) + tonumber(time[2]) / 1000000
+
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'last')
+local tokens = tonumber(state[1]) or burst
+local last = tonumber(state[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - last) * rate)
+
+local allowed = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+end
+
+redis.call('HSET', KEYS[1], 'tokens', tokens, 'last', now)
+redis.call('PEXPIRE', KEYS[1], math.ceil(burst / rate * 1000))
+return {allowed, tostring(tokens)}
+`)
+
+// RedisLimiter keeps the buckets in Redis so that every instance of the API
+// shares them
+type RedisLimiter struct {
+	client *redis.Client
+	prefix string
+	rate   Rate
+}
+
+// NewRedisLimiter connects to the Redis at url, e.g. redis://localhost:6379/0.
+// Bucket keys are prefixed with prefix
+func NewRedisLimiter(url, prefix string, rate Rate) (*RedisLimiter, error) {
+	options, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse redis url: %w", err)
+	}
+	client := redis.NewClient(options)
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		return nil, fmt.Errorf("failed to connect to redis: %w", err)
+	}
+
+	return &RedisLimiter{
+		client: client,
+		prefix: prefix,
+		rate:   rate,
+	}, nil
+}
+
+func (l *RedisLimiter) Allow(ctx context.Context, key string) (Result, error) {
+	values, err := takeToken.Run(ctx, l.client, []string{l.prefix + key}, l.rate.PerSecond, l.rate.Burst).Slice()
+	if err != nil {
+		return Result{}, fmt.Errorf("failed to take token: %w", err)
+	}
+	if len(values) != 2 {
+		return Result{}, fmt.Errorf("unexpected rate limit reply: %v", values)
+	}
+
+	allowed, _ := values[0].(int64)
+	text, _ := values[1].(string)
+	tokens, err := strconv.ParseFloat(text, 64)
+	if err != nil {
+		return Result{}, fmt.Errorf("unexpected rate limit reply: %v", values)
+	}
+
+	if allowed != 1 {
+		return Result{RetryAfter: retryAfter(tokens, l.rate)}, nil
+	}
+	return Result{Allowed: true, Remaining: int(tokens)}, nil
+}
+
+func (l *RedisLimiter) Close() error {
+	return l.client.Close()
+}
@@ -0,0 +1,463 @@
+package storage
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"img-resizer/internal/config"
+	"img-resizer/internal/models"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	cacheHitsDesc = prometheus.NewDesc("img_resizer_storage_cache_hits_total",
+		"Reads served by the storage cache by tier.", []string{"tier"}, nil)
+	cacheMissesDesc = prometheus.NewDesc("img_resizer_storage_cache_misses_total",
+		"Reads the storage cache passed to the storage.", nil, nil)
+	cacheEvictionsDesc = prometheus.NewDesc("img_resizer_storage_cache_evictions_total",
+		"Objects evicted from the storage cache.", nil, nil)
+	cacheBytesDesc = prometheus.NewDesc("img_resizer_storage_cache_bytes",
+		"Bytes held by the storage cache by tier.", []string{"tier"}, nil)
+)
+
+// CacheStats counts how reads of a CachedStorage were served
+type CacheStats struct {
+	MemoryHits  int64
+	DiskHits    int64
+	Misses      int64
+	Evictions   int64
+	MemoryBytes int64 // currently cached in memory
+	DiskBytes   int64 // currently cached on disk
+}
+
+// CachedStorage keeps recently read objects in front of a slower storage,
+// small ones in memory and larger ones in a directory on local disk. Both
+// tiers are bounded in bytes and evict the least recently used objects.
+// Writes and deletes through the cache invalidate the object, writes made
+// by other processes are not noticed
+type CachedStorage struct {
+	inner Storage
+	cfg   config.CacheConfig
+
+	mu     sync.Mutex
+	memory *lruIndex
+	disk   *lruIndex // nil when the disk tier is disabled
+
+	// filling holds the keys being read from the wrapped storage. Writes and
+	// deletes meanwhile bump their generation so the stale read is served
+	// once but not cached
+	filling map[string]*pendingFill
+
+	memoryHits atomic.Int64
+	diskHits   atomic.Int64
+	misses     atomic.Int64
+	evictions  atomic.Int64
+}
+
+// pendingFill is a key being read into the cache
+type pendingFill struct {
+	readers    int
+	generation uint64
+}
+
+// cacheMarker marks a directory created by the cache. Only marked
+// directories are cleared, and only of the files the cache names
+const cacheMarker = ".img-resizer-cache"
+
+// NewCachedStorage wraps inner with a cache. The files of the disk cache are
+// removed since its index is only kept in memory
+func NewCachedStorage(inner Storage, cfg config.CacheConfig) (*CachedStorage, error) {
+	s := &CachedStorage{
+		inner:   inner,
+		cfg:     cfg,
+		memory:  newLRUIndex(cfg.MemoryBytes),
+		filling: make(map[string]*pendingFill),
+	}
+
+	if cfg.DiskBytes > 0 {
+		if err := clearCacheDir(cfg.DiskPath); err != nil {
+			return nil, err
+		}
+		s.disk = newLRUIndex(cfg.DiskBytes)
+	}
+	return s, nil
+}
+
+// clearCacheDir prepares the disk cache directory. A directory holding
+// anything but an earlier cache is refused rather than cleared
+func clearCacheDir(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create cache directory: %w", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("failed to read cache directory: %w", err)
+	}
+
+	marked := false
+	for _, entry := range entries {
+		if entry.Name() == cacheMarker {
+			marked = true
+		}
+	}
+	if !marked {
+		if len(entries) > 0 {
+			return fmt.Errorf("cache directory %s is not empty and was not created by the cache", dir)
+		}
+		if err := os.WriteFile(filepath.Join(dir, cacheMarker), nil, 0644); err != nil {
+			return fmt.Errorf("failed to mark cache directory: %w", err)
+		}
+		return nil
+	}
+
+	for _, entry := range entries {
+		if name := entry.Name(); entry.Type().IsRegular() && (isBlobKey(name) || strings.HasPrefix(name, fillPrefix)) {
+			removeFile(filepath.Join(dir, name))
+		}
+	}
+	return nil
+}
+
+func cacheKey(id string, quality models.ImageQuality) string {
+	return id + "/" + string(quality)
+}
+
+// diskPath names cached files by a hash so tenant prefixes need no
+// directories
+func (s *CachedStorage) diskPath(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(s.cfg.DiskPath, hex.EncodeToString(sum[:]))
+}
+
+func (s *CachedStorage) Save(ctx context.Context, id string, quality models.ImageQuality, reader io.Reader) (string, error) {
+	path, err := s.inner.Save(ctx, id, quality, reader)
+	s.invalidate(cacheKey(id, quality))
+	return path, err
+}
+
+func (s *CachedStorage) Get(ctx context.Context, id string, quality models.ImageQuality) (io.ReadCloser, error) {
+	key := cacheKey(id, quality)
+
+	s.mu.Lock()
+	if entry, ok := s.memory.get(key); ok {
+		s.mu.Unlock()
+		s.memoryHits.Add(1)
+		return memoryReader{bytes.NewReader(entry.data)}, nil
+	}
+	if s.disk != nil {
+		if _, ok := s.disk.get(key); ok {
+			// Opened under the lock so the file cannot be evicted in between
+			file, err := os.Open(s.diskPath(key))
+			if err == nil {
+				s.mu.Unlock()
+				s.diskHits.Add(1)
+				return file, nil
+			}
+			slog.WarnContext(ctx, "failed to open cached object, reading through", "key", key, "error", err)
+			s.disk.remove(key)
+		}
+	}
+	s.mu.Unlock()
+
+	s.misses.Add(1)
+	generation := s.startFill(key)
+	defer s.endFill(key)
+	return s.fill(ctx, key, generation, id, quality)
+}
+
+func (s *CachedStorage) Delete(ctx context.Context, id string, quality models.ImageQuality) error {
+	err := s.inner.Delete(ctx, id, quality)
+	s.invalidate(cacheKey(id, quality))
+	return err
+}
+
+func (s *CachedStorage) List(ctx context.Context) ([]string, error) {
+	return s.inner.List(ctx)
+}
+
+// Stats returns the hit and miss counts since the cache was created
+func (s *CachedStorage) Stats() CacheStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats := CacheStats{
+		MemoryHits:  s.memoryHits.Load(),
+		DiskHits:    s.diskHits.Load(),
+		Misses:      s.misses.Load(),
+		Evictions:   s.evictions.Load(),
+		MemoryBytes: s.memory.size,
+	}
+	if s.disk != nil {
+		stats.DiskBytes = s.disk.size
+	}
+	return stats
+}
+
+// Describe and Collect export Stats to Prometheus
+func (s *CachedStorage) Describe(ch chan<- *prometheus.Desc) {
+	ch <- cacheHitsDesc
+	ch <- cacheMissesDesc
+	ch <- cacheEvictionsDesc
+	ch <- cacheBytesDesc
+}
+
+func (s *CachedStorage) Collect(ch chan<- prometheus.Metric) {
+	stats := s.Stats()
+	ch <- prometheus.MustNewConstMetric(cacheHitsDesc, prometheus.CounterValue, float64(stats.MemoryHits), "memory")
+	ch <- prometheus.MustNewConstMetric(cacheHitsDesc, prometheus.CounterValue, float64(stats.DiskHits), "disk")
+	ch <- prometheus.MustNewConstMetric(cacheMissesDesc, prometheus.CounterValue, float64(stats.Misses))
+	ch <- prometheus.MustNewConstMetric(cacheEvictionsDesc, prometheus.CounterValue, float64(stats.Evictions))
+	ch <- prometheus.MustNewConstMetric(cacheBytesDesc, prometheus.GaugeValue, float64(stats.MemoryBytes), "memory")
+	ch <- prometheus.MustNewConstMetric(cacheBytesDesc, prometheus.GaugeValue, float64(stats.DiskBytes), "disk")
+}
+
+// startFill registers a read of key from the wrapped storage and returns
+// the generation the read is admitted with
+func (s *CachedStorage) startFill(key string) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pending, ok := s.filling[key]
+	if !ok {
+		pending = &pendingFill{}
+		s.filling[key] = pending
+	}
+	pending.readers++
+	return pending.generation
+}
+
+func (s *CachedStorage) endFill(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if pending := s.filling[key]; pending != nil {
+		pending.readers--
+		if pending.readers == 0 {
+			delete(s.filling, key)
+		}
+	}
+}
+
+// current reports whether key was not invalidated since a read started
+// with generation. Must be called with s.mu held
+func (s *CachedStorage) current(key string, generation uint64) bool {
+	pending := s.filling[key]
+	return pending != nil && pending.generation == generation
+}
+
+// fill reads an object from the wrapped storage into the cache and returns
+// it. At most MemoryItemBytes are held in memory, larger objects are spooled
+// to disk before the first byte is returned
+func (s *CachedStorage) fill(ctx context.Context, key string, generation uint64, id string, quality models.ImageQuality) (io.ReadCloser, error) {
+	reader, err := s.inner.Get(ctx, id, quality)
+	if err != nil {
+		return nil, err
+	}
+
+	head, err := io.ReadAll(io.LimitReader(reader, s.cfg.MemoryItemBytes+1))
+	if err != nil {
+		closeReader(reader)
+		return nil, err
+	}
+	if int64(len(head)) <= s.cfg.MemoryItemBytes {
+		closeReader(reader)
+		s.mu.Lock()
+		if s.current(key, generation) {
+			s.admit(s.memory, &cacheEntry{key: key, size: int64(len(head)), data: head})
+		}
+		s.mu.Unlock()
+		return memoryReader{bytes.NewReader(head)}, nil
+	}
+
+	if s.disk == nil {
+		return readCloser{io.MultiReader(bytes.NewReader(head), reader), reader}, nil
+	}
+	defer closeReader(reader)
+	return s.fillDisk(key, generation, io.MultiReader(bytes.NewReader(head), reader))
+}
+
+// fillPrefix starts the names of files being filled
+const fillPrefix = "fill-"
+
+func (s *CachedStorage) fillDisk(key string, generation uint64, reader io.Reader) (io.ReadCloser, error) {
+	tmp, err := os.CreateTemp(s.cfg.DiskPath, fillPrefix+"*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cache file: %w", err)
+	}
+	size, err := io.Copy(tmp, reader)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		removeFile(tmp.Name())
+		return nil, fmt.Errorf("failed to fill cache: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Objects larger than the whole disk cache or invalidated while they
+	// were read are served once and dropped
+	if size > s.cfg.DiskBytes || !s.current(key, generation) {
+		file, err := os.Open(tmp.Name())
+		if err != nil {
+			removeFile(tmp.Name())
+			return nil, err
+		}
+		return &removeOnClose{file}, nil
+	}
+
+	path := s.diskPath(key)
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		removeFile(tmp.Name())
+		return nil, fmt.Errorf("failed to fill cache: %w", err)
+	}
+	s.admit(s.disk, &cacheEntry{key: key, size: size})
+	return os.Open(path)
+}
+
+// admit adds an entry to a tier and drops what it evicts. Must be called
+// with s.mu held
+func (s *CachedStorage) admit(tier *lruIndex, entry *cacheEntry) {
+	for _, evicted := range tier.add(entry) {
+		if evicted.key == entry.key {
+			continue
+		}
+		s.evictions.Add(1)
+		if tier == s.disk {
+			removeFile(s.diskPath(evicted.key))
+		}
+	}
+}
+
+func (s *CachedStorage) invalidate(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if pending := s.filling[key]; pending != nil {
+		pending.generation++
+	}
+
+	s.memory.remove(key)
+	if s.disk != nil {
+		if _, ok := s.disk.remove(key); ok {
+			removeFile(s.diskPath(key))
+		}
+	}
+}
+
+// cacheEntry is an object cached in memory (with data) or on disk
+type cacheEntry struct {
+	key  string
+	size int64
+	data []byte
+}
+
+// lruIndex orders entries from most to least recently used within a
+// budget of bytes
+type lruIndex struct {
+	order *list.List
+	items map[string]*list.Element
+	size  int64
+	max   int64
+}
+
+func newLRUIndex(budget int64) *lruIndex {
+	return &lruIndex{
+		order: list.New(),
+		items: make(map[string]*list.Element),
+		max:   budget,
+	}
+}
+
+func (l *lruIndex) get(key string) (*cacheEntry, bool) {
+	element, ok := l.items[key]
+	if !ok {
+		return nil, false
+	}
+	l.order.MoveToFront(element)
+	return element.Value.(*cacheEntry), true
+}
+
+// add inserts entry and returns the entries evicted to make room for it,
+// the entry itself when it is larger than the budget
+func (l *lruIndex) add(entry *cacheEntry) []*cacheEntry {
+	l.remove(entry.key)
+	if entry.size > l.max {
+		return []*cacheEntry{entry}
+	}
+
+	var evicted []*cacheEntry
+	for l.size+entry.size > l.max {
+		oldest := l.order.Back()
+		victim := oldest.Value.(*cacheEntry)
+		l.remove(victim.key)
+		evicted = append(evicted, victim)
+	}
+
+	l.items[entry.key] = l.order.PushFront(entry)
+	l.size += entry.size
+	return evicted
+}
+
+func (l *lruIndex) remove(key string) (*cacheEntry, bool) {
+	element, ok := l.items[key]
+	if !ok {
+		return nil, false
+	}
+	l.order.Remove(element)
+	delete(l.items, key)
+	entry := element.Value.(*cacheEntry)
+	l.size -= entry.size
+	return entry, true
+}
+
+// memoryReader serves a cached object. It can seek, so ranges and
+// conditional requests are answered without reading it again
+type memoryReader struct {
+	*bytes.Reader
+}
+
+func (memoryReader) Close() error {
+	return nil
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// removeOnClose deletes a spooled file once it was served
+type removeOnClose struct {
+	*os.File
+}
+
+func (f *removeOnClose) Close() error {
+	err := f.File.Close()
+	removeFile(f.Name())
+	return err
+}
+
+func closeReader(reader io.Closer) {
+	if err := reader.Close(); err != nil {
+		slog.Warn("failed to close storage reader", "error", err)
+	}
+}
+
+func removeFile(path string) {
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		slog.Warn("failed to remove cache file", "path", path, "error", err)
+	}
+}
@@ -0,0 +1,252 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"img-resizer/internal/filelock"
+	"img-resizer/internal/models"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// blobQuality is the reserved quality under which blobs are kept in the
+// wrapped storage
+const blobQuality models.ImageQuality = "blob"
+
+// ContentAddressedStorage stores every distinct content once. Blobs are
+// saved in the wrapped storage keyed by their SHA-256, within the prefix of
+// the tenant owning them, and each image variant becomes a small pointer to
+// its blob. Every variant referencing a blob has a marker file in the
+// references directory, created and removed atomically, and a blob is
+// deleted together with its last marker. Markers rather than a counter keep
+// saving the same variant twice (e.g. a retried task) from leaking a blob.
+//
+// Saving and collecting a blob is serialized across processes by file locks,
+// so the API, the workers and the admin tools can share the storage
+type ContentAddressedStorage struct {
+	inner Storage
+	dir   string
+}
+
+// NewContentAddressedStorage wraps inner with content-addressed deduplication.
+// References and locks are kept in dir, which must be shared by every
+// process using the storage
+func NewContentAddressedStorage(inner Storage, dir string) (*ContentAddressedStorage, error) {
+	for _, sub := range []string{"refs", "locks"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			return nil, fmt.Errorf("failed to create directory: %w", err)
+		}
+	}
+	return &ContentAddressedStorage{inner: inner, dir: dir}, nil
+}
+
+func (s *ContentAddressedStorage) Save(ctx context.Context, id string, quality models.ImageQuality, reader io.Reader) (string, error) {
+	// Spool to disk while hashing so large images are not held in memory
+	tmp, err := os.CreateTemp("", "cas-*")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temp file: %w", err)
+	}
+	defer func() {
+		if err := tmp.Close(); err != nil {
+			slog.WarnContext(ctx, "failed to close temp file", "error", err)
+		}
+		if err := os.Remove(tmp.Name()); err != nil {
+			slog.WarnContext(ctx, "failed to remove temp file", "path", tmp.Name(), "error", err)
+		}
+	}()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, hasher), reader); err != nil {
+		return "", fmt.Errorf("failed to spool blob: %w", err)
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return "", fmt.Errorf("failed to rewind blob: %w", err)
+	}
+	hash := hex.EncodeToString(hasher.Sum(nil))
+
+	if err := s.addRef(ctx, hash, id, quality, tmp); err != nil {
+		return "", err
+	}
+
+	// The pointer is switched before the blob it pointed to is released, so
+	// a variant never points to a collected blob. A variant saved for the
+	// first time has no pointer yet
+	previous, _ := s.readPointer(ctx, id, quality)
+	saved, err := s.inner.Save(ctx, id, quality, strings.NewReader(hash))
+	if err != nil {
+		return "", err
+	}
+	if previous != "" && previous != hash {
+		if err := s.release(ctx, previous, id, quality); err != nil {
+			return "", err
+		}
+	}
+	return saved, nil
+}
+
+func (s *ContentAddressedStorage) Get(ctx context.Context, id string, quality models.ImageQuality) (io.ReadCloser, error) {
+	hash, err := s.readPointer(ctx, id, quality)
+	if err != nil {
+		return nil, err
+	}
+	return s.inner.Get(ctx, blobKey(id, hash), blobQuality)
+}
+
+func (s *ContentAddressedStorage) Delete(ctx context.Context, id string, quality models.ImageQuality) error {
+	hash, err := s.readPointer(ctx, id, quality)
+	if err != nil {
+		return err
+	}
+	if err := s.inner.Delete(ctx, id, quality); err != nil {
+		return err
+	}
+	return s.release(ctx, hash, id, quality)
+}
+
+// List returns image ids, leaving out the blobs kept under their hashes
+func (s *ContentAddressedStorage) List(ctx context.Context) ([]string, error) {
+	ids, err := s.inner.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	images := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if !isBlobKey(path.Base(id)) {
+			images = append(images, id)
+		}
+	}
+	return images, nil
+}
+
+// addRef marks a variant as referencing a blob and saves the blob from
+// content unless it is stored already
+func (s *ContentAddressedStorage) addRef(ctx context.Context, hash, id string, quality models.ImageQuality, content io.Reader) error {
+	unlock, err := s.lock(hash)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	blob := blobKey(id, hash)
+	dir := s.refsDir(blob)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create blob references: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, refName(id, quality)), nil, 0644); err != nil {
+		return fmt.Errorf("failed to save blob reference: %w", err)
+	}
+
+	existing, err := s.inner.Get(ctx, blob, blobQuality)
+	if err == nil {
+		if err := existing.Close(); err != nil {
+			slog.WarnContext(ctx, "failed to close blob", "hash", hash, "error", err)
+		}
+		return nil
+	}
+	if !os.IsNotExist(err) {
+		return fmt.Errorf("failed to get blob: %w", err)
+	}
+	if _, err := s.inner.Save(ctx, blob, blobQuality, content); err != nil {
+		return fmt.Errorf("failed to save blob: %w", err)
+	}
+	return nil
+}
+
+// release drops a variant from a blob's references and collects the blob
+// once nothing references it
+func (s *ContentAddressedStorage) release(ctx context.Context, hash, id string, quality models.ImageQuality) error {
+	unlock, err := s.lock(hash)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	blob := blobKey(id, hash)
+	dir := s.refsDir(blob)
+	if err := os.Remove(filepath.Join(dir, refName(id, quality))); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete blob reference: %w", err)
+	}
+	refs, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read blob references: %w", err)
+	}
+	if len(refs) > 0 {
+		return nil
+	}
+
+	if err := s.inner.Delete(ctx, blob, blobQuality); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete blob: %w", err)
+	}
+	if err := os.Remove(dir); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete blob references: %w", err)
+	}
+	return nil
+}
+
+// lock takes the cross-process lock guarding a blob. Blobs share one of
+// 256 lock files by the first byte of their hash
+func (s *ContentAddressedStorage) lock(hash string) (func(), error) {
+	unlock, err := filelock.Lock(filepath.Join(s.dir, "locks", hash[:2]))
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock blob: %w", err)
+	}
+	return unlock, nil
+}
+
+// refsDir returns the directory holding the markers of a blob
+func (s *ContentAddressedStorage) refsDir(blob string) string {
+	namespace, hash := path.Split(blob)
+	return filepath.Join(s.dir, "refs", filepath.FromSlash(namespace), hash[:2], hash)
+}
+
+// blobKey returns the key of a blob in the namespace of the variant pointing
+// to it, so tenants never share blobs
+func blobKey(id, hash string) string {
+	namespace, _ := path.Split(id)
+	return namespace + hash
+}
+
+// refName names the marker of a variant in a blob's references directory
+func refName(id string, quality models.ImageQuality) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(id + "/" + string(quality)))
+}
+
+// readPointer returns the blob hash a variant points to
+func (s *ContentAddressedStorage) readPointer(ctx context.Context, id string, quality models.ImageQuality) (string, error) {
+	reader, err := s.inner.Get(ctx, id, quality)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if err := reader.Close(); err != nil {
+			slog.WarnContext(ctx, "failed to close pointer", "key", id, "error", err)
+		}
+	}()
+
+	data, err := io.ReadAll(io.LimitReader(reader, sha256.Size*2+1))
+	if err != nil {
+		return "", fmt.Errorf("failed to read pointer: %w", err)
+	}
+	hash := string(data)
+	if !isBlobKey(hash) {
+		return "", fmt.Errorf("invalid pointer for %s with quality %s", id, quality)
+	}
+	return hash, nil
+}
+
+// isBlobKey reports whether key is a hex SHA-256, which image ids never are
+func isBlobKey(key string) bool {
+	if len(key) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(key)
+	return err == nil
+}
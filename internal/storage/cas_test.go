@@ -0,0 +1,251 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"img-resizer/internal/models"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const testQuality models.ImageQuality = "high"
+
+// newTestCAS returns a content-addressed storage over a local one, and the
+// base directory of the local storage
+func newTestCAS(t *testing.T) (*ContentAddressedStorage, string) {
+	t.Helper()
+	base := t.TempDir()
+	inner, err := NewLocalStorage(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cas, err := NewContentAddressedStorage(inner, filepath.Join(base, ".cas"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cas, base
+}
+
+// blobFiles returns the paths of the blobs in a local storage, relative to
+// its base directory
+func blobFiles(t *testing.T, base string) []string {
+	t.Helper()
+	var blobs []string
+	err := filepath.WalkDir(base, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && strings.HasSuffix(path, "_"+string(blobQuality)+".jpg") {
+			rel, err := filepath.Rel(base, path)
+			if err != nil {
+				return err
+			}
+			blobs = append(blobs, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return blobs
+}
+
+// refCount returns the number of variants referencing the blob of content
+// saved under the namespace of id
+func refCount(t *testing.T, cas *ContentAddressedStorage, id, content string) int {
+	t.Helper()
+	sum := sha256.Sum256([]byte(content))
+	refs, err := os.ReadDir(cas.refsDir(blobKey(id, hex.EncodeToString(sum[:]))))
+	if os.IsNotExist(err) {
+		return 0
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(refs)
+}
+
+func save(t *testing.T, cas *ContentAddressedStorage, id, content string) {
+	t.Helper()
+	if _, err := cas.Save(context.Background(), id, testQuality, strings.NewReader(content)); err != nil {
+		t.Fatalf("Save %s: %v", id, err)
+	}
+}
+
+func read(t *testing.T, cas *ContentAddressedStorage, id string) string {
+	t.Helper()
+	reader, err := cas.Get(context.Background(), id, testQuality)
+	if err != nil {
+		t.Fatalf("Get %s: %v", id, err)
+	}
+	defer reader.Close()
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func remove(t *testing.T, cas *ContentAddressedStorage, id string) {
+	t.Helper()
+	if err := cas.Delete(context.Background(), id, testQuality); err != nil {
+		t.Fatalf("Delete %s: %v", id, err)
+	}
+}
+
+func TestContentAddressedDedupe(t *testing.T) {
+	cas, base := newTestCAS(t)
+
+	save(t, cas, "img-1", "same")
+	save(t, cas, "img-2", "same")
+	if blobs := blobFiles(t, base); len(blobs) != 1 {
+		t.Fatalf("got blobs %v, want one shared blob", blobs)
+	}
+	if n := refCount(t, cas, "img-1", "same"); n != 2 {
+		t.Fatalf("blob has %d references, want 2", n)
+	}
+	for _, id := range []string{"img-1", "img-2"} {
+		if got := read(t, cas, id); got != "same" {
+			t.Errorf("%s reads %q, want %q", id, got, "same")
+		}
+	}
+
+	remove(t, cas, "img-1")
+	if _, err := cas.Get(context.Background(), "img-1", testQuality); !os.IsNotExist(err) {
+		t.Errorf("Get of deleted variant returned %v, want not exist", err)
+	}
+	if got := read(t, cas, "img-2"); got != "same" {
+		t.Errorf("img-2 reads %q after img-1 was deleted", got)
+	}
+
+	remove(t, cas, "img-2")
+	if blobs := blobFiles(t, base); len(blobs) != 0 {
+		t.Errorf("got blobs %v after the last reference was deleted", blobs)
+	}
+	sum := sha256.Sum256([]byte("same"))
+	if _, err := os.Stat(cas.refsDir(hex.EncodeToString(sum[:]))); !os.IsNotExist(err) {
+		t.Errorf("references directory left behind: %v", err)
+	}
+}
+
+func TestContentAddressedResave(t *testing.T) {
+	tests := []struct {
+		name    string
+		content []string
+	}{
+		{name: "same content twice", content: []string{"a", "a"}},
+		{name: "replaced content", content: []string{"a", "b"}},
+		{name: "replaced and restored", content: []string{"a", "b", "a"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cas, base := newTestCAS(t)
+			for _, content := range tt.content {
+				save(t, cas, "img-1", content)
+			}
+
+			last := tt.content[len(tt.content)-1]
+			if got := read(t, cas, "img-1"); got != last {
+				t.Errorf("reads %q, want %q", got, last)
+			}
+			if blobs := blobFiles(t, base); len(blobs) != 1 {
+				t.Errorf("got blobs %v, want only the current one", blobs)
+			}
+			if n := refCount(t, cas, "img-1", last); n != 1 {
+				t.Errorf("blob has %d references, want 1", n)
+			}
+
+			remove(t, cas, "img-1")
+			if blobs := blobFiles(t, base); len(blobs) != 0 {
+				t.Errorf("got blobs %v after delete", blobs)
+			}
+		})
+	}
+}
+
+func TestContentAddressedTenantNamespaces(t *testing.T) {
+	cas, base := newTestCAS(t)
+
+	acme, globex := Key("acme", "img-1"), Key("globex", "img-2")
+	save(t, cas, acme, "same")
+	save(t, cas, globex, "same")
+
+	blobs := blobFiles(t, base)
+	if len(blobs) != 2 {
+		t.Fatalf("got blobs %v, want one per tenant", blobs)
+	}
+	for _, tenant := range []string{"acme", "globex"} {
+		found := false
+		for _, blob := range blobs {
+			found = found || strings.HasPrefix(blob, tenantsPrefix+tenant+"/")
+		}
+		if !found {
+			t.Errorf("no blob under the prefix of %s in %v", tenant, blobs)
+		}
+	}
+
+	ids, err := cas.List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range ids {
+		if isBlobKey(filepath.Base(id)) {
+			t.Errorf("List returned blob %s", id)
+		}
+	}
+
+	remove(t, cas, acme)
+	if got := read(t, cas, globex); got != "same" {
+		t.Errorf("globex reads %q after acme's variant was deleted", got)
+	}
+	if n := refCount(t, cas, globex, "same"); n != 1 {
+		t.Errorf("globex blob has %d references, want 1", n)
+	}
+}
+
+func TestContentAddressedConcurrentSaveAndDelete(t *testing.T) {
+	// Two storages over the same directories stand for two processes
+	first, base := newTestCAS(t)
+	second := &ContentAddressedStorage{inner: first.inner, dir: first.dir}
+
+	for range 200 {
+		save(t, first, "img-1", "shared")
+
+		start := make(chan struct{})
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			<-start
+			if err := first.Delete(context.Background(), "img-1", testQuality); err != nil {
+				t.Errorf("Delete: %v", err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			<-start
+			if _, err := second.Save(context.Background(), "img-2", testQuality, strings.NewReader("shared")); err != nil {
+				t.Errorf("Save: %v", err)
+			}
+		}()
+		close(start)
+		wg.Wait()
+		if t.Failed() {
+			return
+		}
+
+		// The blob must survive the delete of its other reference
+		if got := read(t, second, "img-2"); got != "shared" {
+			t.Fatalf("img-2 reads %q, want %q", got, "shared")
+		}
+		remove(t, second, "img-2")
+		if blobs := blobFiles(t, base); len(blobs) != 0 {
+			t.Fatalf("got blobs %v after every reference was deleted", blobs)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package storage
+
+import (
+	"context"
+	"img-resizer/internal/metrics"
+	"img-resizer/internal/models"
+	"img-resizer/internal/tracing"
+	"io"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// InstrumentedStorage records the latency of every operation on the
+// storage it wraps and traces it as a child of the span in its context
+type InstrumentedStorage struct {
+	inner Storage
+}
+
+func NewInstrumentedStorage(inner Storage) *InstrumentedStorage {
+	return &InstrumentedStorage{inner: inner}
+}
+
+func (s *InstrumentedStorage) Save(ctx context.Context, id string, quality models.ImageQuality, reader io.Reader) (string, error) {
+	ctx, span := startSpan(ctx, "save", id, quality)
+	start := time.Now()
+	path, err := s.inner.Save(ctx, id, quality, reader)
+	observe("save", start, err)
+	tracing.End(span, err)
+	return path, err
+}
+
+func (s *InstrumentedStorage) Get(ctx context.Context, id string, quality models.ImageQuality) (io.ReadCloser, error) {
+	ctx, span := startSpan(ctx, "get", id, quality)
+	start := time.Now()
+	reader, err := s.inner.Get(ctx, id, quality)
+	observe("get", start, err)
+	tracing.End(span, err)
+	return reader, err
+}
+
+func (s *InstrumentedStorage) Delete(ctx context.Context, id string, quality models.ImageQuality) error {
+	ctx, span := startSpan(ctx, "delete", id, quality)
+	start := time.Now()
+	err := s.inner.Delete(ctx, id, quality)
+	observe("delete", start, err)
+	tracing.End(span, err)
+	return err
+}
+
+func (s *InstrumentedStorage) List(ctx context.Context) ([]string, error) {
+	ctx, span := tracing.Tracer().Start(ctx, "storage list")
+	start := time.Now()
+	keys, err := s.inner.List(ctx)
+	observe("list", start, err)
+	tracing.End(span, err)
+	return keys, err
+}
+
+func observe(operation string, start time.Time, err error) {
+	metrics.StorageDuration.WithLabelValues(operation, metrics.Result(err)).Observe(time.Since(start).Seconds())
+}
+
+func startSpan(ctx context.Context, operation, id string, quality models.ImageQuality) (context.Context, trace.Span) {
+	return tracing.Tracer().Start(ctx, "storage "+operation, trace.WithAttributes(
+		attribute.String("storage.key", id),
+		attribute.String("image.quality", string(quality)),
+	))
+}
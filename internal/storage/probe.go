@@ -0,0 +1,27 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"img-resizer/internal/models"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// probeQuality is the reserved quality under which Probe writes
+const probeQuality models.ImageQuality = "probe"
+
+// Probe checks that s is writable by saving and deleting a small object.
+// Every probe writes its own key and content so that instances sharing a
+// storage, also a content-addressed one, do not collide
+func Probe(ctx context.Context, s Storage) error {
+	id := "health-" + uuid.New().String()
+	if _, err := s.Save(ctx, id, probeQuality, strings.NewReader(id)); err != nil {
+		return fmt.Errorf("failed to write probe: %w", err)
+	}
+	if err := s.Delete(ctx, id, probeQuality); err != nil {
+		return fmt.Errorf("failed to delete probe: %w", err)
+	}
+	return nil
+}
@@ -1,21 +1,25 @@
 package storage
 
 import (
+	"context"
 	"fmt"
 	"img-resizer/internal/config"
 	"img-resizer/internal/models"
 	"io"
+	"log/slog"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 )
 
-// Storage defines the interface for image storage
+// Storage defines the interface for image storage. The context carries
+// the trace of the request or task an operation is made for
 type Storage interface {
-	Save(id string, quality models.ImageQuality, reader io.Reader) (string, error)
-	Get(id string, quality models.ImageQuality) (io.ReadCloser, error)
-	Delete(id string, quality models.ImageQuality) error
-	List() ([]string, error)
+	Save(ctx context.Context, id string, quality models.ImageQuality, reader io.Reader) (string, error)
+	Get(ctx context.Context, id string, quality models.ImageQuality) (io.ReadCloser, error)
+	Delete(ctx context.Context, id string, quality models.ImageQuality) error
+	List(ctx context.Context) ([]string, error)
 }
 
 type LocalStorage struct {
@@ -24,12 +28,26 @@ type LocalStorage struct {
 
 // NewStorage creates a new storage based on configuration
 func NewStorage(cfg *config.Config) (Storage, error) {
+	var storage Storage
+	var err error
 	switch cfg.Storage.Type {
 	case "local":
-		return NewLocalStorage(cfg.Storage.LocalPath)
+		storage, err = NewLocalStorage(cfg.Storage.LocalPath)
 	default:
 		return nil, fmt.Errorf("unsupported storage type: %s", cfg.Storage.Type)
 	}
+	if err != nil {
+		return nil, err
+	}
+	storage = NewInstrumentedStorage(storage)
+
+	if cfg.Storage.ContentAddressed {
+		storage, err = NewContentAddressedStorage(storage, filepath.Join(cfg.Storage.LocalPath, ".cas"))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return storage, nil
 }
 
 func NewLocalStorage(basePath string) (Storage, error) {
@@ -43,9 +61,23 @@ func NewLocalStorage(basePath string) (Storage, error) {
 	}, nil
 }
 
-func (s *LocalStorage) getPath(id string, quality models.ImageQuality) (string, error) {
+// tenantsPrefix keeps the prefixes of tenants apart from the two character
+// directories images without a tenant are sharded into
+const tenantsPrefix = "tenants/"
+
+// Key returns the storage key of an image. Images of a tenant are kept
+// under its own prefix
+func Key(tenantID, id string) string {
+	if tenantID == "" {
+		return id
+	}
+	return tenantsPrefix + tenantID + "/" + id
+}
+
+func (s *LocalStorage) getPath(key string, quality models.ImageQuality) (string, error) {
+	namespace, id := path.Split(key)
 	prefix := id[:2]
-	dir := filepath.Join(s.basePath, prefix)
+	dir := filepath.Join(s.basePath, namespace, prefix)
 
 	if err := os.MkdirAll(dir, 0755); err != nil {
 		return "", fmt.Errorf("failed to create directory %s: %w", dir, err)
@@ -54,31 +86,44 @@ func (s *LocalStorage) getPath(id string, quality models.ImageQuality) (string,
 	return filepath.Join(dir, fmt.Sprintf("%s_%s.jpg", id, quality)), nil
 }
 
-func (s *LocalStorage) Save(id string, quality models.ImageQuality, reader io.Reader) (string, error) {
+func (s *LocalStorage) Save(_ context.Context, id string, quality models.ImageQuality, reader io.Reader) (string, error) {
 	path, err := s.getPath(id, quality)
 	if err != nil {
 		return "", err
 	}
 
-	file, err := os.Create(path)
+	// The content is written to a temp file renamed over the previous one,
+	// so readers never see a partly written file
+	file, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
 	if err != nil {
 		return "", err
 	}
 	defer func() {
-		if cerr := file.Close(); cerr != nil {
-			fmt.Printf("failed to close file after save error: %v", cerr)
+		if err := os.Remove(file.Name()); err != nil && !os.IsNotExist(err) {
+			slog.Warn("failed to remove temp file after save", "path", file.Name(), "error", err)
 		}
 	}()
 
-	_, err = io.Copy(file, reader)
-	if err != nil {
+	if _, err := io.Copy(file, reader); err != nil {
+		if cerr := file.Close(); cerr != nil {
+			slog.Warn("failed to close file after save", "path", file.Name(), "error", cerr)
+		}
+		return "", err
+	}
+	if err := file.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Chmod(file.Name(), 0644); err != nil {
+		return "", err
+	}
+	if err := os.Rename(file.Name(), path); err != nil {
 		return "", err
 	}
 
 	return path, nil
 }
 
-func (s *LocalStorage) Get(id string, quality models.ImageQuality) (io.ReadCloser, error) {
+func (s *LocalStorage) Get(_ context.Context, id string, quality models.ImageQuality) (io.ReadCloser, error) {
 	path, err := s.getPath(id, quality)
 	if err != nil {
 		return nil, err
@@ -92,7 +137,7 @@ func (s *LocalStorage) Get(id string, quality models.ImageQuality) (io.ReadClose
 	return file, nil
 }
 
-func (s *LocalStorage) Delete(id string, quality models.ImageQuality) error {
+func (s *LocalStorage) Delete(_ context.Context, id string, quality models.ImageQuality) error {
 	path, err := s.getPath(id, quality)
 	if err != nil {
 		return err
@@ -101,7 +146,7 @@ func (s *LocalStorage) Delete(id string, quality models.ImageQuality) error {
 	return os.Remove(path)
 }
 
-func (s *LocalStorage) List() ([]string, error) {
+func (s *LocalStorage) List(_ context.Context) ([]string, error) {
 	var images []string
 	err := filepath.Walk(s.basePath, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
@@ -113,6 +158,10 @@ func (s *LocalStorage) List() ([]string, error) {
 			parts := strings.Split(filename, "_")
 			if len(parts) > 0 {
 				id := parts[0]
+				// Images of tenants are listed by their prefixed key
+				if namespace, err := filepath.Rel(s.basePath, filepath.Dir(filepath.Dir(path))); err == nil && namespace != "." {
+					id = filepath.ToSlash(namespace) + "/" + id
+				}
 				if !contains(images, id) {
 					images = append(images, id)
 				}
@@ -0,0 +1,307 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"img-resizer/internal/config"
+	"img-resizer/internal/fetcher"
+	"img-resizer/internal/metadata"
+	"img-resizer/internal/models"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Headers sent with every delivery
+const (
+	HeaderEvent     = "X-Webhook-Event"
+	HeaderDelivery  = "X-Webhook-Delivery"
+	HeaderTimestamp = "X-Webhook-Timestamp"
+	HeaderSignature = "X-Webhook-Signature"
+)
+
+// Payload is the JSON body posted to a webhook
+type Payload struct {
+	Event      models.WebhookEvent   `json:"event"`
+	DeliveryID string                `json:"deliveryId"`
+	OccurredAt time.Time             `json:"occurredAt"`
+	Image      *models.ImageMetadata `json:"image"`
+}
+
+// Notifier posts signed payloads to webhooks, retrying failed attempts with
+// exponential backoff. Deliveries are recorded in the metadata store before
+// the first attempt and after every attempt, so pending ones can be resumed
+// by the next process
+type Notifier struct {
+	client         *http.Client
+	store          metadata.Store
+	secret         []byte // signs for keys and tenants without their own secret
+	maxAttempts    int
+	initialBackoff time.Duration
+	wg             sync.WaitGroup
+}
+
+func NewNotifier(cfg config.WebhookConfig, store metadata.Store) *Notifier {
+	return &Notifier{
+		client: &http.Client{
+			Transport: fetcher.NewTransport(cfg.Timeout, cfg.AllowPrivate),
+			Timeout:   cfg.Timeout,
+			// The configured URL is the one to call, redirects are failures
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		store:          store,
+		secret:         []byte(cfg.Secret),
+		maxAttempts:    max(cfg.MaxAttempts, 1),
+		initialBackoff: cfg.InitialBackoff,
+	}
+}
+
+// Notify sends event for an image in the background. Images without a
+// webhook URL are skipped
+func (n *Notifier) Notify(event models.WebhookEvent, meta *models.ImageMetadata) {
+	if meta.WebhookURL == "" {
+		return
+	}
+
+	delivery := &models.WebhookDelivery{
+		ID:        uuid.New().String(),
+		ImageID:   meta.ID,
+		Event:     event,
+		URL:       meta.WebhookURL,
+		Status:    models.DeliveryPending,
+		CreatedAt: time.Now(),
+		Attempts:  []models.WebhookAttempt{},
+		TenantID:  meta.TenantID,
+		OwnerID:   meta.OwnerID,
+	}
+
+	body, err := json.Marshal(&Payload{
+		Event:      event,
+		DeliveryID: delivery.ID,
+		OccurredAt: delivery.CreatedAt,
+		Image:      meta,
+	})
+	if err != nil {
+		slog.Error("failed to marshal webhook payload", "image_id", meta.ID, "error", err)
+		return
+	}
+	delivery.Payload = body
+
+	release, err := n.store.ClaimDelivery(delivery.ImageID, delivery.ID)
+	if err != nil {
+		slog.Error("failed to claim webhook delivery", "delivery_id", delivery.ID, "image_id", delivery.ImageID, "error", err)
+		return
+	}
+	n.save(delivery)
+	n.start(delivery, release)
+}
+
+// Resume continues, in the background, the deliveries left pending by
+// processes that stopped. Deliveries another process is still sending are
+// left to it
+func (n *Notifier) Resume() error {
+	deliveries, err := n.store.ListPendingDeliveries()
+	if err != nil {
+		return fmt.Errorf("failed to list pending webhook deliveries: %w", err)
+	}
+	for _, delivery := range deliveries {
+		n.resume(delivery.ImageID, delivery.ID)
+	}
+	return nil
+}
+
+func (n *Notifier) resume(imageID, id string) {
+	release, err := n.store.ClaimDelivery(imageID, id)
+	if errors.Is(err, metadata.ErrDeliveryClaimed) {
+		return
+	}
+	if err != nil {
+		slog.Error("failed to claim webhook delivery", "delivery_id", id, "image_id", imageID, "error", err)
+		return
+	}
+
+	// The delivery may have ended before it was claimed
+	delivery, err := n.store.GetDelivery(imageID, id)
+	if err != nil || delivery.Status != models.DeliveryPending {
+		if err != nil && !errors.Is(err, metadata.ErrNotFound) {
+			slog.Error("failed to get webhook delivery", "delivery_id", id, "image_id", imageID, "error", err)
+		}
+		release()
+		return
+	}
+	if len(delivery.Payload) == 0 {
+		// Deliveries recorded before payloads were kept cannot be sent again
+		delivery.Status = models.DeliveryFailed
+		n.save(delivery)
+		release()
+		return
+	}
+
+	slog.Info("resuming webhook delivery", "delivery_id", id, "image_id", imageID, "attempts", len(delivery.Attempts))
+	n.start(delivery, release)
+}
+
+// start sends a claimed delivery in the background and releases it once
+// it is no longer pending or the process stops
+func (n *Notifier) start(delivery *models.WebhookDelivery, release func()) {
+	n.wg.Add(1)
+	go func() {
+		defer n.wg.Done()
+		defer release()
+		n.deliver(delivery)
+	}()
+}
+
+// Shutdown waits for pending deliveries until ctx is done. Deliveries cut
+// short stay pending in the store for Resume
+func (n *Notifier) Shutdown(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		n.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// deliver makes the remaining attempts of a delivery, waiting for the time
+// recorded for the next one
+func (n *Notifier) deliver(delivery *models.WebhookDelivery) {
+	for attempt := len(delivery.Attempts) + 1; attempt <= n.maxAttempts; attempt++ {
+		time.Sleep(time.Until(delivery.NextAttemptAt))
+
+		result, retry := n.attempt(delivery, delivery.Payload)
+		delivery.Attempts = append(delivery.Attempts, result)
+
+		switch {
+		case result.Error == "":
+			delivery.Status = models.DeliverySucceeded
+		case !retry || attempt == n.maxAttempts:
+			delivery.Status = models.DeliveryFailed
+		default:
+			delivery.NextAttemptAt = time.Now().Add(n.initialBackoff << (attempt - 1))
+		}
+		n.save(delivery)
+
+		if delivery.Status != models.DeliveryPending {
+			return
+		}
+	}
+
+	// Resumed with every attempt made, WEBHOOK_MAX_ATTEMPTS was lowered
+	delivery.Status = models.DeliveryFailed
+	n.save(delivery)
+}
+
+// attempt posts the payload once and reports whether a failure is worth
+// retrying: network errors, timeouts, rate limiting and server errors are
+func (n *Notifier) attempt(delivery *models.WebhookDelivery, body []byte) (models.WebhookAttempt, bool) {
+	result := models.WebhookAttempt{At: time.Now()}
+
+	req, err := http.NewRequest(http.MethodPost, delivery.URL, bytes.NewReader(body))
+	if err != nil {
+		result.Error = err.Error()
+		return result, false
+	}
+
+	secret, err := n.signingSecret(delivery)
+	if err != nil {
+		result.Error = err.Error()
+		return result, true
+	}
+
+	timestamp := strconv.FormatInt(result.At.Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "img-resizer-webhook")
+	req.Header.Set(HeaderEvent, string(delivery.Event))
+	req.Header.Set(HeaderDelivery, delivery.ID)
+	req.Header.Set(HeaderTimestamp, timestamp)
+	if len(secret) > 0 {
+		req.Header.Set(HeaderSignature, "sha256="+Sign(secret, timestamp, body))
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		result.Error = err.Error()
+		return result, true
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			slog.Warn("failed to close webhook response", "delivery_id", delivery.ID, "error", err)
+		}
+	}()
+	// Drain a little of the body so the connection can be reused
+	if _, err := io.Copy(io.Discard, io.LimitReader(resp.Body, 4<<10)); err != nil {
+		slog.Warn("failed to read webhook response", "delivery_id", delivery.ID, "error", err)
+	}
+
+	result.StatusCode = resp.StatusCode
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return result, false
+	}
+
+	result.Error = fmt.Sprintf("unexpected status: %s", resp.Status)
+	retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusRequestTimeout
+	return result, retry
+}
+
+// signingSecret returns the secret of the tenant of the image or, without a
+// tenant, of the API key that uploaded it. Tenants and keys created before
+// they had secrets, and images of token subjects, fall back to the
+// configured secret
+func (n *Notifier) signingSecret(delivery *models.WebhookDelivery) ([]byte, error) {
+	switch {
+	case delivery.TenantID != "":
+		tenant, err := n.store.GetTenant(delivery.TenantID)
+		if err != nil && !errors.Is(err, metadata.ErrNotFound) {
+			return nil, fmt.Errorf("failed to get tenant: %w", err)
+		}
+		if err == nil && tenant.WebhookSecret != "" {
+			return []byte(tenant.WebhookSecret), nil
+		}
+	case delivery.OwnerID != "":
+		key, err := n.store.GetAPIKey(delivery.OwnerID)
+		if err != nil && !errors.Is(err, metadata.ErrNotFound) {
+			return nil, fmt.Errorf("failed to get api key: %w", err)
+		}
+		if err == nil && key.WebhookSecret != "" {
+			return []byte(key.WebhookSecret), nil
+		}
+	}
+	return n.secret, nil
+}
+
+func (n *Notifier) save(delivery *models.WebhookDelivery) {
+	if err := n.store.SaveDelivery(delivery); err != nil {
+		slog.Error("failed to save webhook delivery", "delivery_id", delivery.ID, "image_id", delivery.ImageID, "error", err)
+	}
+}
+
+// Sign returns the hex HMAC-SHA256 of "<timestamp>.<body>". Receivers
+// recompute it to authenticate the payload and reject stale timestamps to
+// prevent replays
+func Sign(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
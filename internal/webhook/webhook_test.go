@@ -0,0 +1,136 @@
+package webhook
+
+import (
+	"img-resizer/internal/config"
+	"img-resizer/internal/metadata"
+	"img-resizer/internal/models"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func newTestNotifier(t *testing.T, secret string) (*Notifier, metadata.Store) {
+	t.Helper()
+	store, err := metadata.NewLocalStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.WebhookConfig{
+		Secret:       secret,
+		MaxAttempts:  1,
+		Timeout:      time.Second,
+		AllowPrivate: true,
+	}
+	return NewNotifier(cfg, store), store
+}
+
+func TestSign(t *testing.T) {
+	// Computed independently with Python's hmac module
+	const want = "fce76c599a796754ce3e18c5701959051cbf54704e5b3d10148f3695ce8265d8"
+	if got := Sign([]byte("whsec_test"), "1700000000", []byte(`{"event":"image.processed"}`)); got != want {
+		t.Errorf("Sign = %s, want %s", got, want)
+	}
+	if Sign([]byte("whsec_test"), "1700000001", []byte(`{"event":"image.processed"}`)) == want {
+		t.Error("signature does not cover the timestamp")
+	}
+}
+
+func TestAttemptRetries(t *testing.T) {
+	tests := []struct {
+		status int
+		retry  bool
+	}{
+		{status: http.StatusOK},
+		{status: http.StatusNoContent},
+		{status: http.StatusFound},
+		{status: http.StatusBadRequest},
+		{status: http.StatusNotFound},
+		{status: http.StatusRequestTimeout, retry: true},
+		{status: http.StatusTooManyRequests, retry: true},
+		{status: http.StatusInternalServerError, retry: true},
+		{status: http.StatusServiceUnavailable, retry: true},
+	}
+	for _, tt := range tests {
+		t.Run(http.StatusText(tt.status), func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				if tt.status == http.StatusFound {
+					w.Header().Set("Location", "/elsewhere")
+				}
+				w.WriteHeader(tt.status)
+			}))
+			defer server.Close()
+
+			notifier, _ := newTestNotifier(t, "")
+			result, retry := notifier.attempt(&models.WebhookDelivery{ID: "d1", URL: server.URL}, []byte("{}"))
+			if result.StatusCode != tt.status {
+				t.Errorf("status recorded as %d, want %d", result.StatusCode, tt.status)
+			}
+			if failed := result.Error != ""; failed != (tt.status >= 300) {
+				t.Errorf("error %q for status %d", result.Error, tt.status)
+			}
+			if retry != tt.retry {
+				t.Errorf("retry is %v, want %v", retry, tt.retry)
+			}
+		})
+	}
+
+	t.Run("network error", func(t *testing.T) {
+		server := httptest.NewServer(http.NotFoundHandler())
+		server.Close()
+
+		notifier, _ := newTestNotifier(t, "")
+		result, retry := notifier.attempt(&models.WebhookDelivery{ID: "d1", URL: server.URL}, []byte("{}"))
+		if result.Error == "" || !retry {
+			t.Errorf("got error %q and retry %v, want a retried failure", result.Error, retry)
+		}
+	})
+}
+
+func TestAttemptSignsWithSecretOfTenantOrKey(t *testing.T) {
+	var signature string
+	server := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		signature = r.Header.Get(HeaderSignature)
+	}))
+	defer server.Close()
+
+	notifier, store := newTestNotifier(t, "global")
+	if err := store.SaveTenant(&models.Tenant{ID: "acme", WebhookSecret: "tenant"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SaveTenant(&models.Tenant{ID: "legacy"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SaveAPIKey(&models.APIKey{ID: "k1", WebhookSecret: "key"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		delivery models.WebhookDelivery
+		secret   string
+	}{
+		{name: "tenant", delivery: models.WebhookDelivery{TenantID: "acme", OwnerID: "k1"}, secret: "tenant"},
+		{name: "key", delivery: models.WebhookDelivery{OwnerID: "k1"}, secret: "key"},
+		{name: "tenant without secret", delivery: models.WebhookDelivery{TenantID: "legacy"}, secret: "global"},
+		{name: "token subject", delivery: models.WebhookDelivery{OwnerID: "user@example.com"}, secret: "global"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			delivery := tt.delivery
+			delivery.ID = "d1"
+			delivery.URL = server.URL
+			result, _ := notifier.attempt(&delivery, []byte("{}"))
+			if result.Error != "" {
+				t.Fatalf("attempt failed: %s", result.Error)
+			}
+
+			timestamp := strconv.FormatInt(result.At.Unix(), 10)
+			want := "sha256=" + Sign([]byte(tt.secret), timestamp, []byte("{}"))
+			if signature != want {
+				t.Errorf("signed with the wrong secret, want the one of the %s", tt.name)
+			}
+		})
+	}
+}